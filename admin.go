@@ -0,0 +1,635 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxAdminPageSize caps the number of records returned by a single
+// registry listing
+const maxAdminPageSize = 1000
+
+// adminMiddleware guards the admin api, which is only enabled when
+// ADMIN_USERNAME & ADMIN_PASSWORD are set. Requests must send these
+// credentials or an api key with the admin scope. admin requests aren't
+// subject to the upload deadline
+func adminMiddleware(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		// poor man's logging:
+		fmt.Println(r.Method, r.URL.Path, time.Now())
+
+		enc := json.NewEncoder(w)
+		if cfg.AdminUsername == "" || cfg.AdminPassword == "" {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(map[string]string{
+				"error": "the admin api is not enabled on this server",
+			})
+			return
+		}
+
+		if requestAPIKey(r) != "" {
+			if _, ok := authenticateAPIKey(w, r, []string{ScopeAdmin}); ok {
+				handler(w, r, p)
+			}
+			return
+		}
+
+		user, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(cfg.AdminUsername)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.AdminPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="upload server admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			enc.Encode(map[string]string{
+				"error": "admin credentials required",
+			})
+			return
+		}
+
+		handler(w, r, p)
+	}
+}
+
+// AdminUploadsHandler lists uploads in the registry as JSON, in key order.
+// Listings accept these optional query params:
+//
+//	dir       - only uploads within this directory
+//	status    - only uploads with this status, eg. "confirmed"
+//	method    - only uploads made this way, eg. "burner"
+//	requester - only uploads requested by this user
+//	since     - only uploads requested at or after this time
+//	limit     - number of uploads to return, 100 by default
+//	after     - key to start listing after. listings that have more results
+//	            return a "next" key to pass here
+func AdminUploadsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	filter := &RecordFilter{
+		Dir:       r.FormValue("dir"),
+		Status:    r.FormValue("status"),
+		Method:    r.FormValue("method"),
+		Requester: r.FormValue("requester"),
+		After:     r.FormValue("after"),
+		Limit:     100,
+	}
+
+	if since := r.FormValue("since"); since != "" {
+		t, _, err := parseStatsTime(since)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf("invalid 'since' param: %s", err.Error()),
+			})
+			return
+		}
+		filter.Since = t
+	}
+
+	if limit := r.FormValue("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxAdminPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf("limit must be a number between 1 and %d", maxAdminPageSize),
+			})
+			return
+		}
+		filter.Limit = n
+	}
+
+	records, next, err := registry.List(filter)
+	if err != nil {
+		fmt.Println("error listing registry", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := enc.Encode(map[string]interface{}{
+		"uploads": records,
+		"next":    next,
+	}); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminUploadHandler returns the registry record for a single upload
+func AdminUploadHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	key := strings.TrimPrefix(p.ByName("key"), "/")
+	rec, err := registry.Get(key)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf("no upload found at %s", key),
+			})
+			return
+		}
+		fmt.Println("error reading registry", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := enc.Encode(rec); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminUsersHandler lists user accounts as JSON, sorted by username.
+// Password hashes are left out
+func AdminUsersHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	list, err := users.List()
+	if err != nil {
+		fmt.Println("error listing users", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	for i, u := range list {
+		list[i] = u.withoutPassword()
+	}
+
+	if err := enc.Encode(map[string]interface{}{
+		"users": list,
+	}); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminUserHandler returns a single user account
+func AdminUserHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	u, err := users.Get(p.ByName("username"))
+	if err != nil {
+		writeUserError(w, p.ByName("username"), err)
+		return
+	}
+
+	if err := enc.Encode(u.withoutPassword()); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminPutUserHandler creates or updates a user account from a JSON body of:
+//
+//	{
+//	  "password" : "[password]",
+//	  "upload_dirs" : ["[dir]"],
+//	  "disabled" : false
+//	}
+//
+// A password is required for new users. Fields left out of an update keep
+// the user's current values
+func AdminPutUserHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	body := struct {
+		Password   string   `json:"password"`
+		UploadDirs []string `json:"upload_dirs"`
+		Disabled   *bool    `json:"disabled"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("invalid request body: %s", err.Error()),
+		})
+		return
+	}
+
+	username := p.ByName("username")
+	u, err := users.Get(username)
+	if err == ErrNotFound {
+		u = &User{Username: username}
+	} else if err != nil {
+		writeUserError(w, username, err)
+		return
+	}
+
+	if body.Password != "" {
+		if err := u.SetPassword(body.Password); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+	} else if u.PasswordHash == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": "a password is required for new users",
+		})
+		return
+	}
+
+	if body.UploadDirs != nil {
+		u.UploadDirs = make([]string, 0, len(body.UploadDirs))
+		for _, d := range body.UploadDirs {
+			if d = strings.Trim(d, "/"); d != "" {
+				u.UploadDirs = append(u.UploadDirs, d)
+			}
+		}
+	}
+	if body.Disabled != nil {
+		u.Disabled = *body.Disabled
+	}
+
+	if err := users.Put(u); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := enc.Encode(u.withoutPassword()); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminDeleteUserHandler removes a user account. Uploads the user made are
+// kept in the registry
+func AdminDeleteUserHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if err := users.Delete(p.ByName("username")); err != nil {
+		writeUserError(w, p.ByName("username"), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeUserError responds to a failed user lookup
+func writeUserError(w http.ResponseWriter, username string, err error) {
+	enc := json.NewEncoder(w)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("no user named %s", username),
+		})
+		return
+	}
+	fmt.Println("error reading users", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	enc.Encode(map[string]string{
+		"error": err.Error(),
+	})
+}
+
+// AdminInvitesHandler lists invites as JSON, sorted by id
+func AdminInvitesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	list, err := invites.List()
+	if err != nil {
+		fmt.Println("error listing invites", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := enc.Encode(map[string]interface{}{
+		"invites": list,
+	}); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminCreateInviteHandler issues an invite from a JSON body of:
+//
+//	{
+//	  "dir" : "[dir]",
+//	  "max_files" : 1,
+//	  "expires_in" : "24h",
+//	  "note" : "[who the invite is for]"
+//	}
+//
+// max_files defaults to 1, making the invite single-use. Set it to 0 for
+// no limit. expires_in is a duration, eg. "90m" or "72h", & defaults to 24h.
+// The response includes the invite's token & a link to the upload page
+// carrying it
+func AdminCreateInviteHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	body := struct {
+		Dir       string `json:"dir"`
+		MaxFiles  *int   `json:"max_files"`
+		ExpiresIn string `json:"expires_in"`
+		Note      string `json:"note"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("invalid request body: %s", err.Error()),
+		})
+		return
+	}
+
+	maxFiles := 1
+	if body.MaxFiles != nil {
+		maxFiles = *body.MaxFiles
+	}
+
+	expires := 24 * time.Hour
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf("invalid expires_in: %s", err.Error()),
+			})
+			return
+		}
+		expires = d
+	}
+
+	inv, err := invites.Create(body.Dir, maxFiles, expires, body.Note)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	writeInvite(w, r, inv)
+}
+
+// AdminInviteHandler returns a single invite, with its token & link
+func AdminInviteHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	inv, err := invites.Get(p.ByName("id"))
+	if err != nil {
+		writeInviteError(w, p.ByName("id"), err)
+		return
+	}
+	writeInvite(w, r, inv)
+}
+
+// AdminRevokeInviteHandler stops an invite from being used. Revoked invites
+// are kept, so they still show up in listings
+func AdminRevokeInviteHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	inv, err := invites.Revoke(p.ByName("id"))
+	if err != nil {
+		writeInviteError(w, p.ByName("id"), err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(inv); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// writeInvite responds with an invite along with its token & a link to the
+// upload page on the server r was sent to
+func writeInvite(w http.ResponseWriter, r *http.Request, inv *Invite) {
+	enc := json.NewEncoder(w)
+
+	token, err := invites.Token(inv)
+	if err != nil {
+		fmt.Println("error creating invite token", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := enc.Encode(map[string]interface{}{
+		"invite": inv,
+		"token":  token,
+		"link":   requestBaseURL(r) + "/?invite=" + token,
+	}); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// writeInviteError responds to a failed invite lookup
+func writeInviteError(w http.ResponseWriter, id string, err error) {
+	enc := json.NewEncoder(w)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("no invite with id %s", id),
+		})
+		return
+	}
+	fmt.Println("error reading invites", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	enc.Encode(map[string]string{
+		"error": err.Error(),
+	})
+}
+
+// AdminAPIKeysHandler lists api keys as JSON, sorted by id. Key hashes are
+// left out
+func AdminAPIKeysHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	list, err := apiKeys.List()
+	if err != nil {
+		fmt.Println("error listing api keys", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	for i, k := range list {
+		list[i] = k.withoutHash()
+	}
+
+	if err := enc.Encode(map[string]interface{}{
+		"keys": list,
+	}); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminCreateAPIKeyHandler issues an api key from a JSON body of:
+//
+//	{
+//	  "name" : "[what the key is for]",
+//	  "scopes" : ["sign", "burner", "stats", "admin"],
+//	  "upload_dirs" : ["[dir]"],
+//	  "expires_in" : "720h"
+//	}
+//
+// upload_dirs & expires_in are optional, keys without expires_in don't
+// expire. The key itself is only ever included in this response
+func AdminCreateAPIKeyHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	body := struct {
+		Name       string   `json:"name"`
+		Scopes     []string `json:"scopes"`
+		UploadDirs []string `json:"upload_dirs"`
+		ExpiresIn  string   `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("invalid request body: %s", err.Error()),
+		})
+		return
+	}
+
+	var expires time.Duration
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf("invalid expires_in: '%s', must be a duration such as '720h'", body.ExpiresIn),
+			})
+			return
+		}
+		expires = d
+	}
+
+	k, key, err := apiKeys.Create(body.Name, body.Scopes, body.UploadDirs, expires)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := enc.Encode(map[string]interface{}{
+		"apiKey": k.withoutHash(),
+		"key":    key,
+	}); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminRevokeAPIKeyHandler stops an api key from being used straight away
+func AdminRevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	k, err := apiKeys.Revoke(p.ByName("id"))
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf("no api key with id %s", p.ByName("id")),
+			})
+			return
+		}
+		fmt.Println("error revoking api key", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := enc.Encode(k.withoutHash()); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// burnerStatus is a burner along with its current status
+type burnerStatus struct {
+	*Burner
+	Status string `json:"status"`
+}
+
+// AdminBurnersHandler lists burner credentials as JSON, sorted by name.
+// Only active credentials are listed unless "status" is given, as one of
+// "active", "used", "expired", "revoked" or "all"
+func AdminBurnersHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	list, err := burners.List()
+	if err != nil {
+		fmt.Println("error listing burners", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	status := r.FormValue("status")
+	if status == "" {
+		status = BurnerActive
+	}
+	now := time.Now()
+	matching := make([]*burnerStatus, 0)
+	for _, b := range list {
+		if s := b.Status(now); status == "all" || s == status {
+			matching = append(matching, &burnerStatus{Burner: b, Status: s})
+		}
+	}
+
+	if err := enc.Encode(map[string]interface{}{
+		"burners": matching,
+	}); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminBurnerHandler returns a single set of burner credentials
+func AdminBurnerHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := burners.Get(p.ByName("name"))
+	if err != nil {
+		writeBurnerError(w, p.ByName("name"), err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&burnerStatus{Burner: b, Status: b.Status(time.Now())}); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// AdminRevokeBurnerHandler stops burner credentials from being used before
+// they expire, by denying them in the bucket policy
+func AdminRevokeBurnerHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := burners.Revoke(store, p.ByName("name"))
+	if err != nil {
+		writeBurnerError(w, p.ByName("name"), err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&burnerStatus{Burner: b, Status: b.Status(time.Now())}); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// writeBurnerError responds to a failed burner lookup
+func writeBurnerError(w http.ResponseWriter, name string, err error) {
+	enc := json.NewEncoder(w)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("no burner credentials named %s", name),
+		})
+		return
+	}
+	fmt.Println("error reading burners", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	enc.Encode(map[string]string{
+		"error": err.Error(),
+	})
+}
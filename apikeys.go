@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// apiKeysBucket is the bolt bucket api keys are kept in, keyed by key id
+var apiKeysBucket = []byte("api_keys")
+
+// apiKeyPrefix starts every api key, so they're easy to spot if leaked
+const apiKeyPrefix = "usk_"
+
+// apiKeyUseInterval is how often a key's last used time is updated, saving
+// a database write on every request
+const apiKeyUseInterval = time.Minute
+
+// api key scopes, each granting access to a group of endpoints
+const (
+	// ScopeSign allows signing uploads: /token, /complete & /multipart/*
+	ScopeSign = "sign"
+	// ScopeBurner allows creating burner credentials
+	ScopeBurner = "burner"
+	// ScopeStats allows reading /stats & /browse
+	ScopeStats = "stats"
+	// ScopeAdmin allows using the admin api
+	ScopeAdmin = "admin"
+)
+
+// apiKeyScopes lists every valid scope
+var apiKeyScopes = []string{ScopeSign, ScopeBurner, ScopeStats, ScopeAdmin}
+
+// apiKeys is the shared api key store, opened at startup
+var apiKeys *APIKeyStore
+
+// APIKey lets scripts use the server without a password, sending
+// "Authorization: Bearer [key]". Only a hash of the key is stored
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is the hex sha256 digest of the key
+	Hash   string   `json:"hash,omitempty"`
+	Scopes []string `json:"scopes"`
+	// UploadDirs limits the directories the key can upload to. if empty
+	// the server's UPLOAD_DIRS apply
+	UploadDirs []string   `json:"upload_dirs,omitempty"`
+	Created    time.Time  `json:"created"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	LastUsed   *time.Time `json:"lastUsed,omitempty"`
+	Revoked    bool       `json:"revoked,omitempty"`
+}
+
+// Username is the name uploads made with the key are recorded under.
+// usernames can't contain ':', so this never matches a user account
+func (k *APIKey) Username() string {
+	return "apikey:" + k.ID
+}
+
+// HasScope checks if the key grants scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutHash gives a copy of k that's safe to show
+func (k *APIKey) withoutHash() *APIKey {
+	c := *k
+	c.Hash = ""
+	return &c
+}
+
+// APIKeyStore keeps api keys in the registry database
+type APIKeyStore struct {
+	db *bolt.DB
+}
+
+// newAPIKeyStore creates an api key store in db
+func newAPIKeyStore(db *bolt.DB) (*APIKeyStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(apiKeysBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &APIKeyStore{db: db}, nil
+}
+
+// Create stores a new api key, returning its record & the key itself. The
+// key can't be recovered later, so it must be handed on straight away.
+// expires of 0 creates a key that doesn't expire
+func (s *APIKeyStore) Create(name string, scopes, uploadDirs []string, expires time.Duration) (*APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 128 {
+		return nil, "", fmt.Errorf("api keys need a name of up to 128 characters")
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("api keys need at least one scope, from: %s", strings.Join(apiKeyScopes, ", "))
+	}
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range apiKeyScopes {
+			valid = valid || scope == s
+		}
+		if !valid {
+			return nil, "", fmt.Errorf("invalid scope: '%s', must be one of: %s", scope, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+	if expires < 0 {
+		return nil, "", fmt.Errorf("api keys must expire in the future")
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	k := &APIKey{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+	}
+	for _, d := range uploadDirs {
+		if d = strings.Trim(d, "/"); d != "" {
+			k.UploadDirs = append(k.UploadDirs, d)
+		}
+	}
+	if expires > 0 {
+		t := k.Created.Add(expires)
+		k.Expires = &t
+	}
+
+	key := apiKeyPrefix + k.ID + "." + base64.RawURLEncoding.EncodeToString(secret)
+	k.Hash = hashAPIKey(key)
+
+	return k, key, s.put(k)
+}
+
+// Authenticate checks an api key, returning its record if it's valid. The
+// key's last used time is updated at most once per apiKeyUseInterval
+func (s *APIKeyStore) Authenticate(key string) (*APIKey, error) {
+	i := strings.Index(key, ".")
+	if !strings.HasPrefix(key, apiKeyPrefix) || i < 0 {
+		return nil, fmt.Errorf("invalid api key")
+	}
+
+	k, err := s.Get(key[len(apiKeyPrefix):i])
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("invalid api key")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(k.Hash)) != 1 {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	if k.Revoked {
+		return nil, fmt.Errorf("api key %s has been revoked", k.ID)
+	}
+	if k.Expires != nil && time.Now().After(*k.Expires) {
+		return nil, fmt.Errorf("api key %s has expired", k.ID)
+	}
+
+	if k.LastUsed == nil || time.Since(*k.LastUsed) > apiKeyUseInterval {
+		if err := s.touch(k.ID); err != nil {
+			fmt.Println("error recording api key use", err)
+		}
+	}
+	return k, nil
+}
+
+// touch sets a key's last used time. The key is reread within the update,
+// so a key revoked in the meantime stays revoked
+func (s *APIKeyStore) touch(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(apiKeysBucket)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		k := &APIKey{}
+		if err := json.Unmarshal(data, k); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		k.LastUsed = &now
+
+		data, err := json.Marshal(k)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+// Get returns the api key with id, or ErrNotFound
+func (s *APIKeyStore) Get(id string) (*APIKey, error) {
+	k := &APIKey{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(apiKeysBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, k)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// List returns all api keys, sorted by id
+func (s *APIKeyStore) List() ([]*APIKey, error) {
+	list := make([]*APIKey, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).ForEach(func(k, v []byte) error {
+			key := &APIKey{}
+			if err := json.Unmarshal(v, key); err != nil {
+				return err
+			}
+			list = append(list, key)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// Revoke stops an api key from being used. Revoked keys are kept, so
+// uploads made with them can still be traced
+func (s *APIKeyStore) Revoke(id string) (*APIKey, error) {
+	k, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	k.Revoked = true
+	return k, s.put(k)
+}
+
+// put adds or replaces an api key
+func (s *APIKeyStore) put(k *APIKey) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).Put([]byte(k.ID), data)
+	})
+}
+
+// hashAPIKey gives the hex sha256 digest of key. keys are long & random, so
+// unlike passwords they don't need a slow hash
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestAPIKey gives the api key sent as a bearer token with r, if any
+func requestAPIKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// authenticateAPIKey checks the api key sent with r grants one of scopes,
+// responding with an error if it doesn't. The key is returned as the user
+// the request is signed in as, limited to the key's upload dirs
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, scopes []string) (*User, bool) {
+	k, err := apiKeys.Authenticate(requestAPIKey(r))
+	if err != nil {
+		denyAPIKey(w, http.StatusUnauthorized, err)
+		return nil, false
+	}
+
+	for _, scope := range scopes {
+		if k.HasScope(scope) {
+			return &User{Username: k.Username(), UploadDirs: k.UploadDirs}, true
+		}
+	}
+
+	if len(scopes) == 0 {
+		err = fmt.Errorf("api keys can't be used for %s", r.URL.Path)
+	} else {
+		err = fmt.Errorf("api key %s needs the '%s' scope for %s", k.ID, strings.Join(scopes, "' or '"), r.URL.Path)
+	}
+	denyAPIKey(w, http.StatusForbidden, err)
+	return nil, false
+}
+
+// denyAPIKey responds to a request with an invalid api key, or a key
+// without the scope the endpoint needs
+func denyAPIKey(w http.ResponseWriter, status int, err error) {
+	fmt.Println("api key refused:", err)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAPIKeyStoreAuthenticate(t *testing.T) {
+	setupTest(t)
+	var err error
+	if apiKeys, err = newAPIKeyStore(registry.db); err != nil {
+		t.Fatal(err)
+	}
+
+	valid, validKey, err := apiKeys.Create("uploads", []string{ScopeSign}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedKey, err := apiKeys.Create("revoked", []string{ScopeSign}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apiKeys.Revoke(revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	expired, expiredKey, err := apiKeys.Create("expired", []string{ScopeSign}, nil, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	cases := []struct {
+		description string
+		key         string
+		err         string
+	}{
+		{"valid", validKey, ""},
+		{"empty", "", "invalid api key"},
+		{"no prefix", strings.TrimPrefix(validKey, apiKeyPrefix), "invalid api key"},
+		{"no secret", apiKeyPrefix + valid.ID, "invalid api key"},
+		{"wrong secret", apiKeyPrefix + valid.ID + ".secret", "invalid api key"},
+		{"unknown id", apiKeyPrefix + "0000000000000000" + validKey[strings.Index(validKey, "."):], "invalid api key"},
+		{"another key's secret", apiKeyPrefix + valid.ID + revokedKey[strings.Index(revokedKey, "."):], "invalid api key"},
+		{"revoked", revokedKey, "api key " + revoked.ID + " has been revoked"},
+		{"expired", expiredKey, "api key " + expired.ID + " has expired"},
+	}
+	for _, c := range cases {
+		k, err := apiKeys.Authenticate(c.key)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error %q, got %v", c.description, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.description, err)
+		} else if k.ID != valid.ID {
+			t.Errorf("%s: expected key %s, got %s", c.description, valid.ID, k.ID)
+		}
+	}
+
+	if k, err := apiKeys.Get(valid.ID); err != nil || k.LastUsed == nil {
+		t.Errorf("expected the key's use to be recorded, got %v, %v", k, err)
+	}
+	if k, err := apiKeys.Get(revoked.ID); err != nil || k.LastUsed != nil {
+		t.Errorf("expected a revoked key's use not to be recorded, got %v, %v", k, err)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	ls := setupTest(t)
+	cfg.UploadDirs = []string{"docs", "private"}
+	var err error
+	if apiKeys, err = newAPIKeyStore(registry.db); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.PutObject("docs/a.txt", strings.NewReader("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	key := func(scopes []string, uploadDirs []string) string {
+		_, key, err := apiKeys.Create("test", scopes, uploadDirs, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	sign := key([]string{ScopeSign}, nil)
+	stats := key([]string{ScopeStats}, []string{"docs"})
+	both := key([]string{ScopeSign, ScopeStats}, nil)
+	admin := key([]string{ScopeAdmin}, nil)
+
+	cases := []struct {
+		description string
+		handler     httprouter.Handle
+		url, key    string
+		status      int
+	}{
+		{"sign with sign scope", middleware(SignS3Handler, ScopeSign), "/token?dir=docs&object_name=a.txt", sign, http.StatusOK},
+		{"sign with stats scope", middleware(SignS3Handler, ScopeSign), "/token?dir=docs&object_name=a.txt", stats, http.StatusForbidden},
+		{"sign with admin scope", middleware(SignS3Handler, ScopeSign), "/token?dir=docs&object_name=a.txt", admin, http.StatusForbidden},
+		{"stats with stats scope", middleware(StatsHandler, ScopeStats), "/stats?dir=docs", stats, http.StatusOK},
+		{"stats outside key's dirs", middleware(StatsHandler, ScopeStats), "/stats?dir=private", stats, http.StatusForbidden},
+		{"stats with sign scope", middleware(StatsHandler, ScopeStats), "/stats?dir=docs", sign, http.StatusForbidden},
+		{"stats with both scopes", middleware(StatsHandler, ScopeStats), "/stats?dir=private", both, http.StatusOK},
+		{"page without scopes", middleware(HomeHandler), "/", both, http.StatusForbidden},
+		{"invalid key", middleware(StatsHandler, ScopeStats), "/stats?dir=docs", "usk_invalid", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.Header.Set("Authorization", "Bearer "+c.key)
+		w := httptest.NewRecorder()
+		c.handler(w, r, nil)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d: %s", c.description, c.status, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// browsePageSize is the number of files listed on each page of the browse view
+const browsePageSize = 100
+
+// browseObject is a single file as displayed by the browse view
+type browseObject struct {
+	Name     string
+	URL      string
+	Size     string
+	Uploaded string
+}
+
+// BrowseHandler renders an html listing of the files uploaded to a directory.
+// Only the signed in user's upload dirs & their subdirectories can be browsed.
+// If there are no upload dirs the top level of the bucket is browsable instead.
+// Each page lists a single level of the directory from storage, so even a
+// whole bucket is never listed at once. Listings accept these optional query
+// params:
+//
+//	sort  - one of "name" (the default), "size" or "uploaded", sorting the
+//	        files on the page
+//	order - "asc" (the default) or "desc"
+//	after - where the page starts, from the "next" link of the page before
+//	page  - the number of the page, for display
+func BrowseHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	dir := strings.Trim(p.ByName("dir"), "/")
+	dirs := allowedUploadDirs(r)
+
+	if !browsableDir(dirs, dir) {
+		if dir == "" && len(dirs) > 0 {
+			renderBrowseIndex(w, dirs)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		renderTemplate(w, "notFound.html")
+		return
+	}
+
+	prefix := dir
+	if prefix != "" {
+		prefix += "/"
+	}
+	after := r.FormValue("after")
+	listing, err := store.ListDir(prefix, after, browsePageSize)
+	if err != nil {
+		fmt.Println("error listing directory", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stats := make([]*Stat, 0, len(listing.Objects))
+	var bytes int64
+	for _, o := range listing.Objects {
+		// manifests describe uploads, they aren't uploads themselves
+		if isManifest(o.Key) {
+			continue
+		}
+		stats = append(stats, &Stat{Key: o.Key, Created: o.LastModified, Size: o.Size})
+		bytes += o.Size
+	}
+
+	sortBy := r.FormValue("sort")
+	desc := r.FormValue("order") == "desc"
+	sort.Sort(statSorter{stats: stats, by: sortBy, desc: desc})
+
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 || after == "" {
+		page = 1
+	}
+
+	objects := make([]*browseObject, 0, len(stats))
+	for _, o := range stats {
+		objects = append(objects, &browseObject{
+			Name:     strings.TrimPrefix(o.Key, prefix),
+			URL:      store.ObjectURL(o.Key),
+			Size:     humanBytes(o.Size),
+			Uploaded: o.Created.Format(time.RFC1123),
+		})
+	}
+
+	subdirs := make([]*DirStat, 0, len(listing.Dirs))
+	for _, d := range listing.Dirs {
+		subdirs = append(subdirs, &DirStat{Dir: strings.TrimSuffix(d, "/")})
+	}
+
+	// pageLink builds a link to this listing, changing only the given params
+	pageLink := func(params map[string]string) string {
+		q := url.Values{}
+		if sortBy != "" {
+			q.Set("sort", sortBy)
+		}
+		if desc {
+			q.Set("order", "desc")
+		}
+		if after != "" {
+			q.Set("after", after)
+			q.Set("page", strconv.Itoa(page))
+		}
+		for k, v := range params {
+			if v == "" {
+				q.Del(k)
+			} else {
+				q.Set(k, v)
+			}
+		}
+		return "?" + q.Encode()
+	}
+
+	// sorting by the current column again flips the order
+	sortLink := func(by string) string {
+		order := "asc"
+		if (by == sortBy || (by == "name" && sortBy == "")) && !desc {
+			order = "desc"
+		}
+		return pageLink(map[string]string{"sort": by, "order": order})
+	}
+
+	data := map[string]interface{}{
+		"Config":      cfg.TemplateData,
+		"Dir":         dir,
+		"Parent":      browseParent(dirs, dir),
+		"Count":       len(stats),
+		"Bytes":       humanBytes(bytes),
+		"Objects":     objects,
+		"Directories": subdirs,
+		"Page":        page,
+		"SortName":    sortLink("name"),
+		"SortSize":    sortLink("size"),
+		"SortTime":    sortLink("uploaded"),
+	}
+	if after != "" {
+		data["FirstPage"] = pageLink(map[string]string{"after": "", "page": ""})
+	}
+	if listing.Next != "" {
+		data["NextPage"] = pageLink(map[string]string{"after": listing.Next, "page": strconv.Itoa(page + 1)})
+	}
+
+	renderBrowse(w, data)
+}
+
+// renderBrowseIndex lists the upload dirs that can be browsed
+func renderBrowseIndex(w http.ResponseWriter, dirs []string) {
+	stats := make([]*DirStat, len(dirs))
+	for i, d := range dirs {
+		stats[i] = &DirStat{Dir: strings.Trim(d, "/")}
+	}
+
+	renderBrowse(w, map[string]interface{}{
+		"Config":      cfg.TemplateData,
+		"Index":       true,
+		"Directories": stats,
+	})
+}
+
+func renderBrowse(w http.ResponseWriter, data map[string]interface{}) {
+	if err := templates.ExecuteTemplate(w, "browse.html", data); err != nil {
+		fmt.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// browsableDir checks dir is one of the upload dirs or inside one
+func browsableDir(dirs []string, dir string) bool {
+	if strings.Contains(dir, "..") {
+		return false
+	}
+
+	if len(dirs) == 0 {
+		return dir == ""
+	}
+
+	for _, d := range dirs {
+		d = strings.Trim(d, "/")
+		if dir == d || strings.HasPrefix(dir, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// browseParent gives the link to the directory above dir, if it can be browsed
+func browseParent(dirs []string, dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	parent := ""
+	if i := strings.LastIndex(dir, "/"); i >= 0 {
+		parent = dir[:i]
+	}
+	if browsableDir(dirs, parent) || (parent == "" && len(dirs) > 0) {
+		return "/browse/" + parent
+	}
+	return ""
+}
+
+// humanBytes formats a byte count for display, eg. "1.5 GB"
+func humanBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// statSorter sorts stats by "name", "size" or "uploaded"
+type statSorter struct {
+	stats []*Stat
+	by    string
+	desc  bool
+}
+
+func (s statSorter) Len() int      { return len(s.stats) }
+func (s statSorter) Swap(i, j int) { s.stats[i], s.stats[j] = s.stats[j], s.stats[i] }
+func (s statSorter) Less(i, j int) bool {
+	a, b := s.stats[i], s.stats[j]
+	if s.desc {
+		a, b = b, a
+	}
+
+	switch s.by {
+	case "size":
+		return a.Size < b.Size
+	case "uploaded":
+		return a.Created.Before(b.Created)
+	default:
+		return a.Key < b.Key
+	}
+}
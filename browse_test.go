@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestLocalListDir(t *testing.T) {
+	ls := newTestLocalStorage(t)
+	for _, key := range []string{"docs/b.txt", "docs/a.txt", "docs/a/1.txt", "docs/a/2.txt", "docs/c/d/3.txt", "other.txt"} {
+		if err := ls.PutObject(key, strings.NewReader(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var pages []string
+	after := ""
+	for {
+		l, err := ls.ListDir("docs/", after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := append([]string{}, l.Dirs...)
+		for _, o := range l.Objects {
+			page = append(page, o.Key)
+		}
+		pages = append(pages, strings.Join(page, " "))
+		if l.Next == "" {
+			break
+		}
+		after = l.Next
+	}
+
+	// "a.txt" sorts before "a/", as it does on S3
+	expect := []string{"docs/a/ docs/a.txt", "docs/c/ docs/b.txt"}
+	if fmt.Sprint(pages) != fmt.Sprint(expect) {
+		t.Errorf("expected pages %q, got %q", expect, pages)
+	}
+
+	l, err := ls.ListDir("", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Dirs) != 1 || l.Dirs[0] != "docs/" || len(l.Objects) != 1 {
+		t.Errorf("expected the top level to list docs/ & other.txt, without internal dirs, got %v & %d objects", l.Dirs, len(l.Objects))
+	}
+
+	if l, err := ls.ListDir("missing/", "", 10); err != nil || len(l.Objects)+len(l.Dirs) != 0 {
+		t.Errorf("expected a dir that doesn't exist to be empty, got %v, %v", l, err)
+	}
+}
+
+func TestBrowseHandlerPages(t *testing.T) {
+	ls := setupTest(t)
+	cfg.UploadDirs = []string{"docs"}
+	for i := 0; i < browsePageSize+5; i++ {
+		if err := ls.PutObject(fmt.Sprintf("docs/%03d.txt", i), strings.NewReader("x"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := httprouter.New()
+	router.GET("/browse/*dir", BrowseHandler)
+
+	get := func(url string) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", url, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	next := regexp.MustCompile(`href="(\?[^"]*)">next`)
+
+	body := get("/browse/docs")
+	if !strings.Contains(body, fmt.Sprintf("%d files on this page", browsePageSize)) {
+		t.Errorf("expected a full first page")
+	}
+	m := next.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("expected a link to the next page")
+	}
+
+	body = get("/browse/docs" + strings.Replace(m[1], "&amp;", "&", -1))
+	if !strings.Contains(body, "5 files on this page") || !strings.Contains(body, "104.txt") || strings.Contains(body, "000.txt") {
+		t.Errorf("expected the second page to list the last 5 files")
+	}
+	if next.MatchString(body) {
+		t.Error("expected no link past the last page")
+	}
+}
+
+func TestBrowseHandler(t *testing.T) {
+	ls := setupTest(t)
+	cfg.UploadDirs = []string{"docs"}
+	objects := map[string]string{
+		"docs/small.txt":                  "x",
+		"docs/large.txt":                  strings.Repeat("x", 100),
+		"docs/large.txt" + manifestSuffix: "{}",
+		"docs/sub/nested.txt":             "x",
+		"private/secret.txt":              "x",
+	}
+	for key, body := range objects {
+		if err := ls.PutObject(key, strings.NewReader(body), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		description string
+		dir, query  string
+		user        *User
+		status      int
+		// contains lists text the page must include, in order
+		contains []string
+		excludes []string
+	}{
+		{"index", "/", "", nil, http.StatusOK, []string{`href="/browse/docs"`}, []string{"private"}},
+		{"dir", "/docs", "", nil, http.StatusOK, []string{"2 files on this page", `href="/browse/docs/sub"`, "large.txt", "small.txt"}, []string{manifestSuffix, "nested.txt"}},
+		{"sorted by size", "/docs", "sort=size", nil, http.StatusOK, []string{"small.txt", "large.txt"}, nil},
+		{"sorted by name descending", "/docs", "order=desc", nil, http.StatusOK, []string{"small.txt", "large.txt"}, nil},
+		{"subdirectory", "/docs/sub", "", nil, http.StatusOK, []string{"nested.txt"}, []string{"small.txt"}},
+		{"other dir", "/private", "", nil, http.StatusNotFound, nil, []string{"secret.txt"}},
+		{"climbs out of dir", "/docs/../private", "", nil, http.StatusNotFound, nil, []string{"secret.txt"}},
+		{"user's dirs", "/private", "", &User{Username: "a", UploadDirs: []string{"private"}}, http.StatusOK, []string{"secret.txt"}, nil},
+		{"outside user's dirs", "/docs", "", &User{Username: "a", UploadDirs: []string{"private"}}, http.StatusNotFound, nil, []string{"small.txt"}},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/browse"+c.dir+"?"+c.query, nil)
+		if c.user != nil {
+			r = withUser(r, c.user)
+		}
+		w := httptest.NewRecorder()
+		BrowseHandler(w, r, httprouter.Params{{Key: "dir", Value: c.dir}})
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.description, c.status, w.Code)
+			continue
+		}
+		body := w.Body.String()
+		at := 0
+		for _, s := range c.contains {
+			i := strings.Index(body[at:], s)
+			if i < 0 {
+				t.Errorf("%s: expected %q in order %q", c.description, s, c.contains)
+				break
+			}
+			at += i + len(s)
+		}
+		for _, s := range c.excludes {
+			if strings.Contains(body, s) {
+				t.Errorf("%s: expected %q not to be shown", c.description, s)
+			}
+		}
+	}
+}
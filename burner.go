@@ -1,21 +1,120 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/julienschmidt/httprouter"
 )
 
-// BurnerTokenHandler
+// burnerDuration is how long burner credentials last by default
+const burnerDuration = 24 * time.Hour
+
+// roleBurnerDuration is how long burner credentials issued by assuming
+// BURNER_ROLE_ARN last by default, the longest most roles allow
+const roleBurnerDuration = time.Hour
+
+// limits on the duration of federation tokens & assumed roles, set by STS
+const (
+	minBurnerDuration     = 15 * time.Minute
+	maxBurnerDuration     = 36 * time.Hour
+	maxRoleBurnerDuration = 12 * time.Hour
+)
+
+// burnerMaxFiles is the default number of files a single set of burner
+// credentials can name
+const burnerMaxFiles = 10
+
+// defaultBurnerActions are the S3 actions burner credentials allow by
+// default. uploads too big for a single request use the multipart actions,
+// which "aws s3 cp" needs to clean up after itself
+var defaultBurnerActions = []string{
+	"s3:PutObject",
+	"s3:PutObjectAcl",
+	"s3:DeleteObject",
+	"s3:AbortMultipartUpload",
+	"s3:ListMultipartUploadParts",
+}
+
+// BurnerScope configures the burner credentials issued for an upload dir.
+// Scopes are set per upload dir with the BURNER_SCOPES config key. Zero
+// values use the defaults
+type BurnerScope struct {
+	// Actions are the S3 actions credentials allow, replacing the defaults
+	Actions []string `json:"actions,omitempty"`
+	// DurationSeconds is how long credentials last, between 15 minutes &
+	// 36 hours, or 12 hours for assumed roles. defaults to 24 hours, or 1
+	// hour for assumed roles
+	DurationSeconds int64 `json:"duration_seconds,omitempty"`
+	// AllowPrefix lets requests ask for credentials that can upload any
+	// number of files under a new prefix
+	AllowPrefix bool `json:"allow_prefix,omitempty"`
+	// MaxFiles is the number of files a request can name, defaults to 10
+	MaxFiles int `json:"max_files,omitempty"`
+}
+
+// validate checks a scope's settings are ones STS will accept, with
+// credentials lasting at most max
+func (s *BurnerScope) validate(max time.Duration) error {
+	if d := time.Duration(s.DurationSeconds) * time.Second; s.DurationSeconds != 0 && (d < minBurnerDuration || d > max) {
+		return fmt.Errorf("duration_seconds must be between %d & %d", int64(minBurnerDuration/time.Second), int64(max/time.Second))
+	}
+	for _, a := range s.Actions {
+		if !strings.HasPrefix(a, "s3:") {
+			return fmt.Errorf("invalid action: '%s', actions must be S3 actions, eg. 's3:PutObject'", a)
+		}
+	}
+	return nil
+}
+
+// Duration gives how long credentials last
+func (s *BurnerScope) Duration() time.Duration {
+	if s.DurationSeconds > 0 {
+		return time.Duration(s.DurationSeconds) * time.Second
+	}
+	if cfg.BurnerRoleArn != "" {
+		return roleBurnerDuration
+	}
+	return burnerDuration
+}
+
+// AllowedActions gives the S3 actions credentials allow
+func (s *BurnerScope) AllowedActions() []string {
+	if len(s.Actions) > 0 {
+		return s.Actions
+	}
+	return defaultBurnerActions
+}
+
+// FileLimit gives the number of files a request can name
+func (s *BurnerScope) FileLimit() int {
+	if s.MaxFiles > 0 {
+		return s.MaxFiles
+	}
+	return burnerMaxFiles
+}
+
+// dirBurnerScope gives the burner scope for dir, falling back to the scope
+// for "*" & then the defaults
+func dirBurnerScope(dir string) *BurnerScope {
+	if s, ok := cfg.BurnerScopes[strings.Trim(dir, "/")]; ok {
+		return s
+	}
+	if s, ok := cfg.BurnerScopes["*"]; ok {
+		return s
+	}
+	return &BurnerScope{}
+}
+
+// BurnerTokenHandler issues temporary credentials for uploading with aws
+// tools. Credentials can upload to each "object_name" given, or with
+// scope=prefix to anything under a new prefix in "dir"
 func BurnerTokenHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// response can be json, allocate an encoder that operates
 	// on the http writer
@@ -28,27 +127,176 @@ func BurnerTokenHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		return
 	}
 
-	// Generate the path for this request
-	path, err := RequestPath(r)
+	if !limitRate(w, r) {
+		return
+	}
+
+	// check the format before issuing credentials no one will see
+	format := r.FormValue("format")
+	script := findBurnerScript(format)
+	if script == nil && format != "" && format != "json" && format != "html" {
+		w.WriteHeader(http.StatusBadRequest)
+		formats := []string{"html", "json"}
+		for _, s := range burnerScripts {
+			formats = append(formats, s.Format)
+		}
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("invalid format: '%s', must be one of: %s", format, strings.Join(formats, ", ")),
+		})
+		return
+	}
+
+	// check the file is allowed before using up any of an invite. burner
+	// credentials can't limit what's uploaded, so only declared details
+	// are checked
+	if _, err := RequestUploadLimits(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	if _, err := requestQuotaSize(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	scope := dirBurnerScope(r.FormValue("dir"))
+	duration := scope.Duration()
+	prefix := r.FormValue("scope") == "prefix"
+	names := r.Form["object_name"]
+	if prefix {
+		// an invite is used up a file at a time, which a prefix can't be
+		if requestInvite(r) != nil {
+			w.WriteHeader(http.StatusForbidden)
+			enc.Encode(map[string]string{
+				"error": "prefix burner credentials aren't allowed with an invite",
+			})
+			return
+		}
+		if !scope.AllowPrefix {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(map[string]string{
+				"error": "prefix burner credentials aren't allowed for this directory",
+			})
+			return
+		}
+		// any number of files of any size could be uploaded under a prefix
+		if dirUploadLimits(r.FormValue("dir")) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(map[string]string{
+				"error": "prefix burner credentials aren't allowed in directories with upload limits",
+			})
+			return
+		}
+		if uq, dq := requestQuotas(r); uq != nil || dq != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(map[string]string{
+				"error": "prefix burner credentials aren't allowed with upload quotas",
+			})
+			return
+		}
+		// a random prefix no one else will be given
+		id := make([]byte, 6)
+		if _, err := rand.Read(id); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+		names = []string{hex.EncodeToString(id)}
+	} else if len(names) == 0 {
+		names = []string{""}
+	} else if len(names) > scope.FileLimit() {
+		// clients can ask again in batches of max_files
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]interface{}{
+			"error":     fmt.Sprintf("burner credentials can upload at most %d files", scope.FileLimit()),
+			"max_files": scope.FileLimit(),
+		})
+		return
+	}
+
+	// hold one of the requester's burner credentials until they'd expire
+	username := randomUsername()
+	if !holdBurnerCredentials(w, r, username, time.Now().Add(duration)) {
+		return
+	}
+	issued := false
+	defer func() {
+		if !issued {
+			releaseBurnerCredentials(requestSubject(r), username)
+		}
+	}()
+
+	// Generate the paths for this request
+	paths := make([]string, len(names))
+	for i, name := range names {
+		path, err := requestPath(r, name)
+		if err != nil {
+			writePathError(w, enc, err)
+			return
+		}
+		paths[i] = path
+	}
+
+	provenance, err := RequestProvenance(r)
 	if err != nil {
-		fmt.Println("path error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		enc.Encode(map[string]string{
 			"error": err.Error(),
 		})
 		return
 	}
 
-	// intialize S3 service to check path
-	s3Svc := s3.New(session.New(&aws.Config{
-		Region:      aws.String(cfg.AwsRegion),
-		Credentials: credentials.NewStaticCredentials(cfg.AwsAccessKeyId, cfg.AwsSecretAccessKey, ""),
-	}))
+	credScope := &CredentialScope{
+		Actions: scope.AllowedActions(),
+		Tags: map[string]string{
+			"uploader":   requestSubject(r),
+			"dir":        strings.Trim(r.FormValue("dir"), "/"),
+			"request-id": username,
+		},
+	}
+	if prefix {
+		paths[0] += "/"
+		credScope.Prefix = paths[0]
+	} else {
+		// Get empty paths, reserved for as long as the credentials last
+		for i, path := range paths {
+			if paths[i], err = GetEmptyPath(store, path, duration); err != nil {
+				fmt.Println("path error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				enc.Encode(map[string]string{
+					"error": err.Error(),
+				})
+				return
+			}
+		}
+		credScope.Keys = paths
+	}
 
-	// Get an empty path
-	path, err = GetEmptyPath(s3Svc, path)
+	// credentials can't be taken back once they're created, so the invite
+	// is used first & given back if they aren't issued
+	if err := useInvite(r, len(paths)); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	defer func() {
+		if !issued {
+			releaseInvite(r, len(paths))
+		}
+	}()
+
+	creds, err := CreateBurnerToken(store, username, credScope, duration)
 	if err != nil {
-		fmt.Println("path error", err)
+		fmt.Println("error creating burner credentials", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		enc.Encode(map[string]string{
 			"error": err.Error(),
@@ -56,9 +304,25 @@ func BurnerTokenHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		return
 	}
 
-	res, err := CreateBurnerToken(randomUsername(), path, 3600*24)
+	// only credentials that were issued count against daily quotas. ones
+	// that are refused here are never handed out
+	if !chargeQuotas(w, r) {
+		return
+	}
+	issued = true
+
+	err = burners.Put(&Burner{
+		Name:      username,
+		Paths:     credScope.Keys,
+		Prefix:    credScope.Prefix,
+		Dir:       strings.Trim(r.FormValue("dir"), "/"),
+		Requester: requestUsername(r),
+		IP:        requestIP(r),
+		Created:   time.Now().UTC(),
+		Expires:   creds.Expiration,
+	})
 	if err != nil {
-		fmt.Println("path error", err)
+		fmt.Println("error recording burner", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		enc.Encode(map[string]string{
 			"error": err.Error(),
@@ -66,20 +330,53 @@ func BurnerTokenHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		return
 	}
 
-	if r.FormValue("format") == "json" {
+	for _, path := range paths {
+		rec := NewRecord(r, NewManifest(r, path, "burner", provenance))
+		rec.CredentialsName = username
+		rec.CredentialsExpire = &creds.Expiration
+		if err := RecordUpload(rec); err != nil {
+			fmt.Println("error recording upload", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	if format == "json" {
+		res := map[string]interface{}{
+			"Name":        username,
+			"Credentials": creds,
+			"Path":        paths[0],
+			"Paths":       paths,
+			"Actions":     credScope.Actions,
+			"Bucket":      cfg.AwsS3BucketName,
+			"Region":      cfg.AwsRegion,
+			"Endpoint":    cfg.AwsS3Endpoint,
+			"PathStyle":   cfg.AwsS3ForcePathStyle,
+		}
+		if prefix {
+			res["Prefix"] = credScope.Prefix
+		}
 		if err := enc.Encode(res); err != nil {
 			fmt.Printf("json encoding error: %s", err)
 		}
 		return
 	}
 
-	renderBurnerInstrcutions(w, res, path)
+	data := burnerTemplateData(username, names, creds, credScope)
+	if script != nil {
+		writeBurnerScript(w, script, data)
+		return
+	}
+	renderBurnerInstrcutions(w, data)
 }
 
-// CreateBurnerToken creates a temporary federated token to upload a file to an an empty path using aws tools.
-// from the base aws profile scoped to the passed-in path
-func CreateBurnerToken(username, path string, durationsSeconds int64) (*sts.GetFederationTokenOutput, error) {
-	if path == "" {
+// CreateBurnerToken creates temporary credentials to upload files within scope using aws tools.
+// credentials are issued by the passed-in storage
+func CreateBurnerToken(svc Storage, username string, scope *CredentialScope, duration time.Duration) (*Credentials, error) {
+	if len(scope.Keys) == 0 && scope.Prefix == "" {
 		return nil, fmt.Errorf("must specify a path to upload to")
 	}
 
@@ -87,59 +384,113 @@ func CreateBurnerToken(username, path string, durationsSeconds int64) (*sts.GetF
 		username = randomUsername()
 	}
 
-	stsSvc := sts.New(session.New(&aws.Config{
-		Region:      aws.String(cfg.AwsRegion),
-		Credentials: credentials.NewStaticCredentials(cfg.AwsAccessKeyId, cfg.AwsSecretAccessKey, ""),
-	}))
+	return svc.TempCredentials(username, scope, duration)
+}
+
+// randomUsername generates a unique name for a set of burner credentials,
+// which identifies them in the registry & in aws logs
+func randomUsername() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return "burner_" + hex.EncodeToString(id)
+}
+
+// PolicyDocument is an IAM policy, limiting what credentials can do
+type PolicyDocument struct {
+	Version   string             `json:"Version"`
+	Statement []*PolicyStatement `json:"Statement"`
+}
+
+// PolicyStatement allows or denies actions on a list of resources
+type PolicyStatement struct {
+	Sid    string `json:"Sid,omitempty"`
+	Effect string `json:"Effect"`
+	// Principal is only set in resource policies, like bucket policies
+	Principal interface{} `json:"Principal,omitempty"`
+	Action    []string    `json:"Action"`
+	Resource  []string    `json:"Resource"`
+	// Condition maps condition operators to the keys & values they test
+	Condition map[string]map[string][]string `json:"Condition,omitempty"`
+}
 
-	return stsSvc.GetFederationToken(&sts.GetFederationTokenInput{
-		DurationSeconds: aws.Int64(durationsSeconds),
-		Name:            aws.String(username),
-		Policy:          aws.String(PutS3ObjectPolicyDocument(cfg.AwsS3BucketName, path)),
+// BurnerPolicyDocument generates a policy document that only allows the
+// actions in scope on its keys & prefix. With the default actions a user can
+// upload an object to each key, in one request or in parts, delete that same
+// object, and set the ACL of that object (to make the object publically
+// accessible)
+func BurnerPolicyDocument(bucketName string, scope *CredentialScope) (string, error) {
+	stmt := &PolicyStatement{
+		Effect: "Allow",
+		Action: scope.Actions,
+	}
+	for _, key := range scope.Keys {
+		stmt.Resource = append(stmt.Resource, fmt.Sprintf("arn:aws:s3:::%s/%s", bucketName, key))
+	}
+	if scope.Prefix != "" {
+		stmt.Resource = append(stmt.Resource, fmt.Sprintf("arn:aws:s3:::%s/%s*", bucketName, scope.Prefix))
+	}
+
+	data, err := json.Marshal(&PolicyDocument{
+		Version:   "2012-10-17",
+		Statement: []*PolicyStatement{stmt},
 	})
+	return string(data), err
 }
 
-// randomUsername generates a random user from the current date, hour, and minute
-func randomUsername() string {
-	return fmt.Sprintf("user_%s", time.Now().Format("2006_01_02_15_04"))
-}
-
-// PutS3OBjectPolicyDocument generates a policy document scoped to the passed-in path
-// The generated policy will only allow a user to put an object to the specified path,
-// delete that same object, and set the ACL of that object (to make the object publically accessible)
-func PutS3ObjectPolicyDocument(bucketName, path string) string {
-	format := `{
-    "Version": "2012-10-17",
-    "Statement": [
-        {
-            "Effect": "Allow",
-            "Action": [
-                "s3:PutObject",
-                "s3:PutObjectAcl",
-                "s3:DeleteObject"
-            ],
-            "Resource": [
-                "arn:aws:s3:::%s/%s"
-            ]
-        }
-    ]
-   }`
-	return fmt.Sprintf(format, bucketName, path)
-}
-
-func renderBurnerInstrcutions(w http.ResponseWriter, res *sts.GetFederationTokenOutput, path string) {
-	err := templates.ExecuteTemplate(w, "burner.html", map[string]interface{}{
+// burnerFile is a file burner credentials can upload, as shown on the
+// instructions page & in scripts
+type burnerFile struct {
+	Path string
+	// Filename is the name of the file on the uploader's computer, the
+	// object_name it was requested with
+	Filename  string
+	ObjectURL string
+}
+
+// burnerTemplateData gives the values the instructions page & scripts are
+// rendered with, for credentials named name issued to upload the files
+// requested as names
+func burnerTemplateData(name string, names []string, creds *Credentials, scope *CredentialScope) map[string]interface{} {
+	files := make([]*burnerFile, len(scope.Keys))
+	for i, key := range scope.Keys {
+		filename := filepath.Base(key)
+		if i < len(names) && names[i] != "" {
+			filename = filepath.Base(names[i])
+		}
+		files[i] = &burnerFile{Path: key, Filename: filename, ObjectURL: store.ObjectURL(key)}
+	}
+
+	return map[string]interface{}{
 		"Config":                cfg.TemplateData,
+		"Name":                  name,
 		"Bucket":                cfg.AwsS3BucketName,
 		"Region":                cfg.AwsRegion,
-		"Path":                  path,
-		"Credentials":           res.Credentials.String(),
-		"Filename":              filepath.Base(path),
-		"Expiry":                res.Credentials.Expiration.Format(time.RubyDate),
-		"AWS_ACCESS_KEY_ID":     res.Credentials.AccessKeyId,
-		"AWS_SECRET_ACCESS_KEY": res.Credentials.SecretAccessKey,
-		"AWS_SESSION_TOKEN":     res.Credentials.SessionToken,
-	})
+		"Endpoint":              cfg.AwsS3Endpoint,
+		"PathStyle":             cfg.AwsS3ForcePathStyle,
+		"Files":                 files,
+		"Prefix":                scope.Prefix,
+		"PrefixURL":             store.ObjectURL(scope.Prefix),
+		"Credentials":           creds.String(),
+		"Expiry":                creds.Expiration.Format(time.RubyDate),
+		"MultipartThresholdMB":  scriptMultipartThresholdMB,
+		"MultipartChunkMB":      scriptMultipartChunkMB,
+		"MaxConcurrency":        scriptMaxConcurrency,
+		"AWS_ACCESS_KEY_ID":     creds.AccessKeyId,
+		"AWS_SECRET_ACCESS_KEY": creds.SecretAccessKey,
+		"AWS_SESSION_TOKEN":     creds.SessionToken,
+	}
+}
+
+func renderBurnerInstrcutions(w http.ResponseWriter, data map[string]interface{}) {
+	downloads, err := burnerDownloads(data)
+	if err != nil {
+		fmt.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["Downloads"] = downloads
+
+	err = templates.ExecuteTemplate(w, "burner.html", data)
 	if err != nil {
 		fmt.Println(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// multipart settings burner scripts give aws tools, matching the upload page
+const (
+	scriptMultipartThresholdMB = 100
+	scriptMultipartChunkMB     = 50
+	scriptMaxConcurrency       = 4
+)
+
+// burnerScript is a ready-to-run script or config file burner credentials
+// can be downloaded as, so volunteers don't have to copy & paste the long
+// session token
+type burnerScript struct {
+	// Format is the /burner format param that returns the script
+	Format string
+	// Template is the script's template in the views directory
+	Template string
+	// Filename is the name the script downloads as, formatted with the
+	// credentials' name
+	Filename string
+	// Label describes the script on the instructions page
+	Label string
+}
+
+// burnerScripts lists every script format, in the order they're offered
+var burnerScripts = []*burnerScript{
+	{Format: "sh", Template: "burner.sh", Filename: "upload-%s.sh", Label: "Bash script (Mac & Linux)"},
+	{Format: "ps1", Template: "burner.ps1", Filename: "upload-%s.ps1", Label: "PowerShell script (Windows)"},
+	{Format: "rclone", Template: "burner.rclone.conf", Filename: "%s.rclone.conf", Label: "rclone config"},
+	{Format: "awsprofile", Template: "burner.credentials", Filename: "%s.credentials", Label: "aws credentials file profile"},
+}
+
+// scriptTemplates are the templates for burnerScripts. values are quoted
+// for the script's language with shquote & psquote, and kept to a single
+// line in comments & config files with line
+var scriptTemplates = template.Must(template.New("scripts").Funcs(template.FuncMap{
+	"shquote": shellQuote,
+	"psquote": powershellQuote,
+	"line":    singleLine,
+}).ParseFiles(
+	"views/burner.sh",
+	"views/burner.ps1",
+	"views/burner.rclone.conf",
+	"views/burner.credentials",
+))
+
+// findBurnerScript gives the script for a format param, or nil if format
+// isn't a script
+func findBurnerScript(format string) *burnerScript {
+	for _, s := range burnerScripts {
+		if s.Format == format {
+			return s
+		}
+	}
+	return nil
+}
+
+// render executes the script's template with burner template data
+func (s *burnerScript) render(data map[string]interface{}) ([]byte, error) {
+	vars := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		vars[k] = v
+	}
+	vars["ScriptName"] = fmt.Sprintf(s.Filename, data["Name"])
+
+	buf := &bytes.Buffer{}
+	if err := scriptTemplates.ExecuteTemplate(buf, s.Template, vars); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// burnerDownload links to a script on the instructions page. scripts are
+// embedded in the page as data urls, since requesting one from /burner
+// would issue new credentials
+type burnerDownload struct {
+	Label    string
+	Filename string
+	URL      string
+}
+
+// burnerDownloads renders every script for the instructions page
+func burnerDownloads(data map[string]interface{}) ([]*burnerDownload, error) {
+	downloads := make([]*burnerDownload, len(burnerScripts))
+	for i, s := range burnerScripts {
+		script, err := s.render(data)
+		if err != nil {
+			return nil, err
+		}
+		downloads[i] = &burnerDownload{
+			Label:    s.Label,
+			Filename: fmt.Sprintf(s.Filename, data["Name"]),
+			URL:      "data:text/plain;charset=utf-8;base64," + base64.StdEncoding.EncodeToString(script),
+		}
+	}
+	return downloads, nil
+}
+
+// writeBurnerScript responds with a script as a file download
+func writeBurnerScript(w http.ResponseWriter, s *burnerScript, data map[string]interface{}) {
+	script, err := s.render(data)
+	if err != nil {
+		fmt.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fmt.Sprintf(s.Filename, data["Name"])))
+	w.Write(script)
+}
+
+// shellQuote quotes s as a single word for bash
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// powershellQuote quotes s as a literal powershell string
+func powershellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// singleLine replaces control characters in s with "?", so it can't end a
+// comment or config line early
+func singleLine(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"html"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBurnerScriptsEscapeValues(t *testing.T) {
+	setupTest(t)
+	cfg.AwsS3BucketName = "bucket"
+	cfg.AwsRegion = "us-east-1"
+	cfg.AwsS3Endpoint = "https://storage.example.org"
+	cfg.AwsS3ForcePathStyle = true
+
+	// names are refused before they get here, but every value is escaped
+	// for the script anyway
+	name := "it's\nrm -rf ~\n$(touch pwned).txt"
+	creds := &Credentials{AccessKeyId: "ASIATEST", SecretAccessKey: "secret", SessionToken: "token", Expiration: time.Now().Add(time.Hour)}
+	for _, scope := range []*CredentialScope{
+		{Keys: []string{"docs/" + name}},
+		{Prefix: "docs/0a1b2c/"},
+	} {
+		data := burnerTemplateData("burner-1", []string{name}, creds, scope)
+		for _, s := range burnerScripts {
+			script, err := s.render(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// quoted strings in scripts can span lines, but comments &
+			// config files can't
+			lines := strings.Split(string(script), "\n")
+			for i, line := range lines[1:] {
+				injected := strings.HasPrefix(line, "rm ") || strings.HasPrefix(line, "$(touch")
+				quoted := (s.Format == "sh" || s.Format == "ps1") && !strings.HasPrefix(lines[i], "#")
+				if injected && !quoted {
+					t.Errorf("%s: expected the file name to stay on its line, got: %s", s.Format, line)
+				}
+			}
+
+			if s.Format == "sh" {
+				if _, err := exec.LookPath("bash"); err != nil {
+					continue
+				}
+				cmd := exec.Command("bash", "-n")
+				cmd.Stdin = strings.NewReader(string(script))
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Errorf("expected the bash script to parse: %s %s", err, out)
+				}
+			}
+		}
+	}
+}
+
+func TestRequestPathRefusesControlCharacters(t *testing.T) {
+	setupTest(t)
+	for _, name := range []string{"a\nb.txt", "a\rb.txt", "a\x00b.txt", "a\tb.txt"} {
+		r := httptest.NewRequest("GET", "/token", nil)
+		if _, err := requestPath(r, name); err == nil {
+			t.Errorf("expected %q to be refused", name)
+		}
+	}
+	if _, err := requestPath(httptest.NewRequest("GET", "/token", nil), "a b é.txt"); err != nil {
+		t.Errorf("unexpected error for a name with spaces & accents: %s", err)
+	}
+}
+
+func TestBurnerInstructionsEscapeValues(t *testing.T) {
+	setupTest(t)
+	cfg.AwsS3BucketName = "bucket"
+	cfg.AwsRegion = "us-east-1"
+
+	name := "it's <img src=x onerror=alert(1)> $(touch pwned).txt"
+	creds := &Credentials{AccessKeyId: "ASIATEST", SecretAccessKey: "secret", SessionToken: "token", Expiration: time.Now().Add(time.Hour)}
+	data := burnerTemplateData("burner-1", []string{name}, creds, &CredentialScope{Keys: []string{"docs/" + name}})
+
+	w := httptest.NewRecorder()
+	renderBurnerInstrcutions(w, data)
+	body := w.Body.String()
+	if strings.Contains(body, "<img") {
+		t.Errorf("expected the file name to be escaped for html, got %s", body)
+	}
+	command := "aws s3 cp " + shellQuote(name) + " " + shellQuote("s3://bucket/docs/"+name) + " --region 'us-east-1'"
+	if !strings.Contains(html.UnescapeString(body), command) {
+		t.Errorf("expected the upload command to quote the file name, like %s, got %s", command, body)
+	}
+}
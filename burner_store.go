@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// burnersBucket is the bolt bucket issued burner credentials are kept in,
+// keyed by name
+var burnersBucket = []byte("burners")
+
+// burnerWatchInterval is how often storage is checked for files uploaded
+// with burner credentials
+const burnerWatchInterval = time.Minute
+
+// burners is the shared burner credential store, opened at startup
+var burners *BurnerStore
+
+// burner credential statuses
+const (
+	// BurnerActive credentials can still be used
+	BurnerActive = "active"
+	// BurnerUsed credentials have uploaded every path they were issued for
+	BurnerUsed = "used"
+	// BurnerExpired credentials ran out before they were used
+	BurnerExpired = "expired"
+	// BurnerRevoked credentials were revoked by an admin
+	BurnerRevoked = "revoked"
+)
+
+// Burner records a set of burner credentials issued by the server. The
+// credentials themselves aren't kept
+type Burner struct {
+	// Name identifies the credentials, as the federated user or role
+	// session name they were issued to
+	Name   string   `json:"name"`
+	Paths  []string `json:"paths,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Dir    string   `json:"dir"`
+	// Requester is the user the credentials were issued to, if any
+	Requester string    `json:"requester,omitempty"`
+	IP        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	// Uploaded lists the files that have arrived in storage
+	Uploaded []string `json:"uploaded,omitempty"`
+	// Used is when the first file arrived
+	Used    *time.Time `json:"used,omitempty"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// Status gives the state of the credentials at now
+func (b *Burner) Status(now time.Time) string {
+	switch {
+	case b.Revoked != nil:
+		return BurnerRevoked
+	case b.Prefix == "" && len(b.Paths) > 0 && len(b.Uploaded) >= len(b.Paths):
+		return BurnerUsed
+	case now.After(b.Expires):
+		if b.Used != nil {
+			return BurnerUsed
+		}
+		return BurnerExpired
+	}
+	return BurnerActive
+}
+
+// subject is who the credentials count against for MAX_BURNER_CREDENTIALS
+func (b *Burner) subject() string {
+	if b.Requester != "" {
+		return b.Requester
+	}
+	return "ip:" + b.IP
+}
+
+// watching checks if storage should still be checked for files uploaded
+// with the credentials at now. uploads can take a while to show up, so
+// credentials are watched for one more interval after they expire
+func (b *Burner) watching(now time.Time) bool {
+	if b.Revoked != nil || now.After(b.Expires.Add(burnerWatchInterval)) {
+		return false
+	}
+	return b.Prefix != "" || len(b.Uploaded) < len(b.Paths)
+}
+
+// hasUploaded checks if key is already listed as uploaded
+func (b *Burner) hasUploaded(key string) bool {
+	for _, k := range b.Uploaded {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// BurnerStore keeps issued burner credentials in the registry database
+type BurnerStore struct {
+	db *bolt.DB
+	// revoking serializes revocations, so each one sees the last
+	revoking sync.Mutex
+}
+
+// newBurnerStore creates a burner store in db
+func newBurnerStore(db *bolt.DB) (*BurnerStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(burnersBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BurnerStore{db: db}, nil
+}
+
+// Put adds or replaces a burner
+func (s *BurnerStore) Put(b *Burner) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(burnersBucket).Put([]byte(b.Name), data)
+	})
+}
+
+// Get returns the burner named name, or ErrNotFound
+func (s *BurnerStore) Get(name string) (*Burner, error) {
+	b := &Burner{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(burnersBucket).Get([]byte(name))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// List returns all burners, sorted by name
+func (s *BurnerStore) List() ([]*Burner, error) {
+	list := make([]*Burner, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(burnersBucket).ForEach(func(k, v []byte) error {
+			b := &Burner{}
+			if err := json.Unmarshal(v, b); err != nil {
+				return err
+			}
+			list = append(list, b)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// update rereads the burner named name & saves the changes fn makes to it
+func (s *BurnerStore) update(name string, fn func(*Burner)) (*Burner, error) {
+	b := &Burner{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(burnersBucket)
+		data := bucket.Get([]byte(name))
+		if data == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(data, b); err != nil {
+			return err
+		}
+
+		fn(b)
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Revoke stops the burner credentials named name from being used. Storage
+// is told to deny every revoked set of credentials that hasn't expired
+// yet, and only once it has is the burner marked as revoked
+func (s *BurnerStore) Revoke(svc Storage, name string) (*Burner, error) {
+	s.revoking.Lock()
+	defer s.revoking.Unlock()
+
+	b, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.Revoked != nil {
+		return b, nil
+	}
+
+	list, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	// the list is replaced every time, so names drop off once they've
+	// expired, keeping the bucket policy under S3's size limit
+	now := time.Now()
+	var denied []string
+	for _, other := range list {
+		if (other.Name == name || other.Revoked != nil) && now.Before(other.Expires) {
+			denied = append(denied, other.Name)
+		}
+	}
+	if err := svc.DenyCredentials(denied); err != nil {
+		return nil, fmt.Errorf("error denying credentials: %s", err)
+	}
+
+	b, err = s.update(name, func(b *Burner) {
+		t := now.UTC()
+		b.Revoked = &t
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// revoked credentials no longer count against the requester
+	releaseBurnerCredentials(b.subject(), b.Name)
+	return b, nil
+}
+
+// watchBurners checks storage for files uploaded with burner credentials
+// every interval, for the life of the server
+func watchBurners(svc Storage, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := checkBurners(svc); err != nil {
+			fmt.Println("error checking burner uploads", err)
+		}
+	}
+}
+
+// checkBurners looks for files uploaded with burner credentials that are
+// still being watched. Files uploaded to a burner's paths are confirmed
+// against their manifests, recording the result in the registry
+func checkBurners(svc Storage) error {
+	list, err := burners.List()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, b := range list {
+		if !b.watching(now) {
+			continue
+		}
+
+		arrived, err := burnerUploads(svc, b)
+		if err != nil {
+			fmt.Printf("error checking uploads for burner %s: %s\n", b.Name, err)
+			continue
+		}
+		if len(arrived) == 0 {
+			continue
+		}
+
+		for _, key := range arrived {
+			if b.Prefix != "" {
+				continue
+			}
+			if _, err := ConfirmUpload(svc, key); err != nil {
+				fmt.Printf("error confirming burner upload %s: %s\n", key, err)
+			}
+		}
+
+		_, err = burners.update(b.Name, func(b *Burner) {
+			for _, key := range arrived {
+				if !b.hasUploaded(key) {
+					b.Uploaded = append(b.Uploaded, key)
+				}
+			}
+			if b.Used == nil {
+				t := now.UTC()
+				b.Used = &t
+			}
+		})
+		if err != nil {
+			fmt.Printf("error updating burner %s: %s\n", b.Name, err)
+			continue
+		}
+		fmt.Printf("burner %s uploaded: %v\n", b.Name, arrived)
+	}
+	return nil
+}
+
+// burnerUploads gives the files uploaded with b since it was last checked
+func burnerUploads(svc Storage, b *Burner) ([]string, error) {
+	var arrived []string
+
+	if b.Prefix != "" {
+		objects, err := svc.List(b.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			if !isManifest(o.Key) && !b.hasUploaded(o.Key) {
+				arrived = append(arrived, o.Key)
+			}
+		}
+		return arrived, nil
+	}
+
+	for _, key := range b.Paths {
+		if b.hasUploaded(key) {
+			continue
+		}
+		if _, err := svc.Head(key); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		arrived = append(arrived, key)
+	}
+	return arrived, nil
+}
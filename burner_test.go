@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBurnerPrefixRefusedWithLimits(t *testing.T) {
+	setupTest(t)
+	cfg.EnableBurnerCredentials = true
+	cfg.BurnerScopes = map[string]*BurnerScope{"*": {AllowPrefix: true}}
+	cfg.UploadLimits = map[string]*UploadLimits{"docs": {MaxSize: 1024}}
+
+	r := httptest.NewRequest("GET", "/burner?format=json&scope=prefix&dir=docs&object_size=10", nil)
+	w := httptest.NewRecorder()
+	BurnerTokenHandler(w, r, nil)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "upload limits") {
+		t.Errorf("expected prefix credentials to be refused for a dir with limits, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// issuingStorage is local storage that issues burner credentials, failing
+// if fail is set
+type issuingStorage struct {
+	*localStorage
+	issued int
+	fail   bool
+}
+
+func (s *issuingStorage) TempCredentials(name string, scope *CredentialScope, duration time.Duration) (*Credentials, error) {
+	if s.fail {
+		return nil, fmt.Errorf("no credentials today")
+	}
+	s.issued++
+	return &Credentials{AccessKeyId: name, Expiration: time.Now().Add(duration)}, nil
+}
+
+func TestBurnerInviteUses(t *testing.T) {
+	svc := &issuingStorage{localStorage: setupTest(t)}
+	store = svc
+	cfg.EnableBurnerCredentials = true
+	cfg.BurnerScopes = map[string]*BurnerScope{"*": {AllowPrefix: true}}
+	inv, err := invites.Create("docs", 2, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := invites.Token(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := middleware(BurnerTokenHandler, ScopeBurner)
+
+	cases := []struct {
+		description string
+		query       string
+		fail        bool
+		status      int
+		issued      int
+		used        int
+	}{
+		{"prefix", "scope=prefix", false, http.StatusForbidden, 0, 0},
+		{"more files than are left", "object_name=a.txt&object_name=b.txt&object_name=c.txt", false, http.StatusForbidden, 0, 0},
+		{"credentials that fail", "object_name=a.txt", true, http.StatusInternalServerError, 0, 0},
+		{"files", "object_name=a.txt&object_name=b.txt", false, http.StatusOK, 1, 2},
+		{"used up", "object_name=c.txt", false, http.StatusForbidden, 1, 2},
+	}
+	for _, c := range cases {
+		svc.fail = c.fail
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/burner?format=json&dir=docs&invite="+token+"&"+c.query, nil), nil)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d: %s", c.description, c.status, w.Code, w.Body.String())
+		}
+		if svc.issued != c.issued {
+			t.Errorf("%s: expected %d credentials issued, got %d", c.description, c.issued, svc.issued)
+		}
+		if inv, _ := invites.Get(inv.ID); inv.Used != c.used {
+			t.Errorf("%s: expected %d files of the invite used, got %d", c.description, c.used, inv.Used)
+		}
+	}
+}
+
+// denyingStorage is local storage that records the credentials it's told
+// to deny
+type denyingStorage struct {
+	*localStorage
+	denied []string
+}
+
+func (s *denyingStorage) DenyCredentials(names []string) error {
+	s.denied = names
+	return nil
+}
+
+func TestBurnerRevokePrunesExpired(t *testing.T) {
+	svc := &denyingStorage{localStorage: setupTest(t)}
+	now := time.Now()
+	for _, b := range []*Burner{
+		{Name: "expired", Expires: now.Add(-time.Hour)},
+		{Name: "active", Expires: now.Add(time.Hour)},
+		{Name: "to-revoke", Expires: now.Add(time.Hour)},
+		{Name: "expired-to-revoke", Expires: now.Add(-time.Hour)},
+	} {
+		if err := burners.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"expired", "active", "to-revoke"} {
+		if _, err := burners.Revoke(svc, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(svc.denied)
+	if strings.Join(svc.denied, ",") != "active,to-revoke" {
+		t.Errorf("expected only unexpired credentials to be denied, got %v", svc.denied)
+	}
+
+	b, err := burners.Revoke(svc, "expired-to-revoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Revoked == nil {
+		t.Error("expected expired credentials to still be marked revoked")
+	}
+	sort.Strings(svc.denied)
+	if strings.Join(svc.denied, ",") != "active,to-revoke" {
+		t.Errorf("expected expired credentials not to be denied, got %v", svc.denied)
+	}
+}
+
+func TestBurnerPolicyDocument(t *testing.T) {
+	cases := []struct {
+		description string
+		scope       *CredentialScope
+		resources   []string
+	}{
+		{"one key", &CredentialScope{Keys: []string{"docs/a.txt"}, Actions: defaultBurnerActions}, []string{"arn:aws:s3:::bucket/docs/a.txt"}},
+		{"keys", &CredentialScope{Keys: []string{"docs/a.txt", "docs/b c.txt"}, Actions: defaultBurnerActions}, []string{"arn:aws:s3:::bucket/docs/a.txt", "arn:aws:s3:::bucket/docs/b c.txt"}},
+		{"prefix", &CredentialScope{Prefix: "docs/burner-1/", Actions: []string{"s3:PutObject"}}, []string{"arn:aws:s3:::bucket/docs/burner-1/*"}},
+		{"keys & prefix", &CredentialScope{Keys: []string{"docs/a.txt"}, Prefix: "docs/b/", Actions: defaultBurnerActions}, []string{"arn:aws:s3:::bucket/docs/a.txt", "arn:aws:s3:::bucket/docs/b/*"}},
+	}
+	for _, c := range cases {
+		policy, err := BurnerPolicyDocument("bucket", c.scope)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.description, err)
+			continue
+		}
+		if got := policyResources(t, policy); fmt.Sprint(got) != fmt.Sprint(c.resources) {
+			t.Errorf("%s: expected resources %q, got %q", c.description, c.resources, got)
+		}
+
+		doc := &PolicyDocument{}
+		if err := json.Unmarshal([]byte(policy), doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Version != "2012-10-17" || len(doc.Statement) != 1 {
+			t.Fatalf("%s: expected a single statement policy, got %s", c.description, policy)
+		}
+		stmt := doc.Statement[0]
+		if stmt.Effect != "Allow" || fmt.Sprint(stmt.Action) != fmt.Sprint(c.scope.Actions) || stmt.Principal != nil || stmt.Condition != nil {
+			t.Errorf("%s: expected only the scope's actions to be allowed, got %s", c.description, policy)
+		}
+	}
+}
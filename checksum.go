@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RequestContentMD5 reads the optional md5 request param, the base64
+// encoded md5 digest of the file being uploaded as calculated by the client.
+// The digest is signed into the upload as a Content-MD5 header, so storage
+// rejects any upload whose body doesn't match it
+func RequestContentMD5(r *http.Request) (string, error) {
+	sum := strings.TrimSpace(r.FormValue("md5"))
+	if sum == "" {
+		return "", nil
+	}
+
+	if _, err := md5Hex(sum); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// RequestSHA256 reads the optional sha256 request param, the hex encoded
+// sha256 digest of the file being uploaded as calculated by the client.
+// Storage can't check it, so it's only recorded, alongside the md5 it does
+// check
+func RequestSHA256(r *http.Request) (string, error) {
+	sum := strings.ToLower(strings.TrimSpace(r.FormValue("sha256")))
+	if sum == "" {
+		return "", nil
+	}
+
+	if digest, err := hex.DecodeString(sum); err != nil || len(digest) != sha256.Size {
+		return "", fmt.Errorf("sha256 must be a hex encoded sha256 digest")
+	}
+	return sum, nil
+}
+
+// md5Hex converts a base64 md5 digest to the hex form used by ETags &
+// command line tools like md5sum
+func md5Hex(sum string) (string, error) {
+	digest, err := base64.StdEncoding.DecodeString(sum)
+	if err != nil || len(digest) != md5.Size {
+		return "", fmt.Errorf("md5 must be a base64 encoded md5 digest")
+	}
+	return hex.EncodeToString(digest), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestChecksums(t *testing.T) {
+	// digests of "hello"
+	md5Sum := "XUFAKrxLKna5cZ2REBfFkg=="
+	sha256Sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	cases := []struct {
+		description string
+		params      url.Values
+		md5, sha256 string
+		err         string
+	}{
+		{"none", url.Values{}, "", "", ""},
+		{"both", url.Values{"md5": {md5Sum}, "sha256": {sha256Sum}}, md5Sum, sha256Sum, ""},
+		{"trimmed", url.Values{"md5": {" " + md5Sum + " "}, "sha256": {" " + strings.ToUpper(sha256Sum) + " "}}, md5Sum, sha256Sum, ""},
+		{"md5 as hex", url.Values{"md5": {"5d41402abc4b2a76b9719d911017c592"}}, "", "", "md5 must be"},
+		{"md5 too short", url.Values{"md5": {"XUFAKrxLKna5cZ2R"}}, "", "", "md5 must be"},
+		{"md5 not base64", url.Values{"md5": {"not an md5!"}}, "", "", "md5 must be"},
+		{"sha256 as base64", url.Values{"sha256": {"LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="}}, "", "", "sha256 must be"},
+		{"sha256 too short", url.Values{"sha256": {sha256Sum[:32]}}, "", "", "sha256 must be"},
+		{"sha256 not hex", url.Values{"sha256": {strings.Repeat("z", 64)}}, "", "", "sha256 must be"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/token?"+c.params.Encode(), nil)
+		md5Got, md5Err := RequestContentMD5(r)
+		sha256Got, sha256Err := RequestSHA256(r)
+		err := md5Err
+		if err == nil {
+			err = sha256Err
+		}
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error %q, got %v", c.description, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.description, err)
+		} else if md5Got != c.md5 || sha256Got != c.sha256 {
+			t.Errorf("%s: expected md5 %q & sha256 %q, got %q & %q", c.description, c.md5, c.sha256, md5Got, sha256Got)
+		}
+	}
+}
+
+func TestMD5Hex(t *testing.T) {
+	cases := []struct {
+		sum, hex string
+		ok       bool
+	}{
+		{"XUFAKrxLKna5cZ2REBfFkg==", "5d41402abc4b2a76b9719d911017c592", true},
+		{base64MD5(""), "d41d8cd98f00b204e9800998ecf8427e", true},
+		{"", "", false},
+		{"XUFAKrxLKna5cZ2REBfFkg", "", false},
+		{"LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=", "", false},
+	}
+	for _, c := range cases {
+		got, err := md5Hex(c.sum)
+		if (err == nil) != c.ok || got != c.hex {
+			t.Errorf("%q: expected %q & ok %t, got %q, %v", c.sum, c.hex, c.ok, got, err)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// burnerMargin is how long burner credentials must have left to be reused
+// by a later run
+const burnerMargin = 15 * time.Minute
+
+// Burner is a set of burner credentials, as returned by
+// /burner?format=json
+type Burner struct {
+	Name        string
+	Credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      time.Time
+	}
+	Paths     []string
+	Prefix    string
+	Bucket    string
+	Region    string
+	Endpoint  string
+	PathStyle bool
+
+	// Keys are the paths each file is uploaded to, keyed by absolute path.
+	// prefix credentials can upload anything under their prefix instead
+	Keys map[string]string `json:"keys,omitempty"`
+}
+
+// key gives the key to upload f to, or "" if the credentials can't upload it
+func (b *Burner) key(f *localFile) string {
+	if b.Prefix != "" {
+		return b.Prefix + f.Name
+	}
+	return b.Keys[f.Path]
+}
+
+// usable checks the credentials won't run out for a while after now
+func (b *Burner) usable(now time.Time) bool {
+	return now.Add(burnerMargin).Before(b.Credentials.Expiration)
+}
+
+// client gives an s3 client signing requests with the credentials
+func (b *Burner) client() *s3.S3 {
+	cfg := &aws.Config{
+		Region:           aws.String(b.Region),
+		Credentials:      credentials.NewStaticCredentials(b.Credentials.AccessKeyId, b.Credentials.SecretAccessKey, b.Credentials.SessionToken),
+		S3ForcePathStyle: aws.Bool(b.PathStyle),
+		// the upload runner retries failed requests itself
+		MaxRetries: aws.Int(0),
+	}
+	if b.Endpoint != "" {
+		cfg.Endpoint = aws.String(b.Endpoint)
+	}
+	return s3.New(session.New(cfg))
+}
+
+// burnerTarget uploads straight to storage with burner credentials. each
+// set of credentials can only upload so many files, so files can be spread
+// over several
+type burnerTarget struct {
+	// files & keys give the credentials each file is uploaded with, keyed
+	// by the file's absolute path & by the key it's uploaded to
+	files   map[string]*Burner
+	keys    map[string]*Burner
+	clients map[string]*s3.S3
+}
+
+// newBurnerTarget gets burner credentials for files from the server,
+// reusing the ones in state that can upload a file & won't run out soon.
+// paths are requested for each file, in batches as large as the server
+// allows, or a prefix for directories
+func newBurnerTarget(c *client, state *State, files []*localFile, prefix bool) (*burnerTarget, error) {
+	t := &burnerTarget{
+		files:   map[string]*Burner{},
+		keys:    map[string]*Burner{},
+		clients: map[string]*s3.S3{},
+	}
+
+	var need []*localFile
+	for _, f := range files {
+		if b := state.burner(f); b != nil {
+			t.add(b, f)
+		} else {
+			need = append(need, f)
+		}
+	}
+
+	batch := len(need)
+	for len(need) > 0 {
+		n := batch
+		if n > len(need) {
+			n = len(need)
+		}
+
+		b, err := requestBurner(c, need[:n], prefix)
+		if e, ok := err.(*httpError); ok && e.Status == http.StatusBadRequest {
+			switch {
+			case prefix:
+				// directories with limits or quotas only issue paths
+				fmt.Printf("the server won't issue folder credentials (%s), asking for a path for each file\n", e.Message)
+				prefix = false
+				continue
+			case e.MaxFiles > 0 && e.MaxFiles < n:
+				batch = e.MaxFiles
+				continue
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting burner credentials: %s", err)
+		}
+
+		state.update(func() {
+			state.addBurner(b)
+		})
+		for _, f := range need[:n] {
+			t.add(b, f)
+		}
+		need = need[n:]
+		fmt.Printf("got burner credentials %s, which expire %s\n", b.Name, b.Credentials.Expiration.Local().Format(time.RFC1123))
+	}
+
+	// uploads started with other credentials can't be finished with these
+	state.update(func() {
+		for _, f := range files {
+			if fs := state.Files[f.Path]; fs != nil && fs.Key != t.files[f.Path].key(f) {
+				fs.reset()
+			}
+		}
+	})
+	return t, nil
+}
+
+// requestBurner asks the server for credentials that can upload files, or
+// anything under a new prefix
+func requestBurner(c *client, files []*localFile, prefix bool) (*Burner, error) {
+	params := url.Values{}
+	for k, v := range c.params {
+		params[k] = v
+	}
+	params.Set("format", "json")
+	if prefix {
+		params.Set("scope", "prefix")
+	}
+	// quotas count the files' total size
+	var size int64
+	for _, f := range files {
+		size += f.Size
+		if !prefix {
+			params.Add("object_name", f.Name)
+		}
+	}
+	params.Set("object_size", strconv.FormatInt(size, 10))
+
+	b := &Burner{}
+	if err := c.call("GET", "/burner", params, nil, b); err != nil {
+		return nil, err
+	}
+	if b.Bucket == "" {
+		return nil, fmt.Errorf("the server didn't say which bucket to upload to, it may need updating")
+	}
+	if prefix {
+		if b.Prefix == "" {
+			return nil, fmt.Errorf("the server didn't give a prefix to upload to")
+		}
+		return b, nil
+	}
+
+	if len(b.Paths) != len(files) {
+		return nil, fmt.Errorf("the server gave %d paths for %d files", len(b.Paths), len(files))
+	}
+	b.Keys = map[string]string{}
+	for i, f := range files {
+		if b.Paths[i] == "" {
+			return nil, fmt.Errorf("the server didn't give a path for %s", f.Path)
+		}
+		b.Keys[f.Path] = b.Paths[i]
+	}
+	return b, nil
+}
+
+// add records that f is uploaded with b
+func (t *burnerTarget) add(b *Burner, f *localFile) {
+	t.files[f.Path] = b
+	t.keys[b.key(f)] = b
+	if t.clients[b.Name] == nil {
+		t.clients[b.Name] = b.client()
+	}
+}
+
+// keyClient gives the credentials & client that upload to key
+func (t *burnerTarget) keyClient(key string) (*Burner, *s3.S3, error) {
+	b := t.keys[key]
+	if b == nil {
+		return nil, nil, fmt.Errorf("no burner credentials can upload to %s", key)
+	}
+	return b, t.clients[b.Name], nil
+}
+
+// put uploads f with its credentials. burner paths are never taken by
+// another upload, so replaces isn't needed
+func (t *burnerTarget) put(f *localFile, contentMD5, replaces string) (string, error) {
+	b := t.files[f.Path]
+	key := b.key(f)
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return key, err
+	}
+	defer file.Close()
+
+	req, _ := t.clients[b.Name].PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(b.Bucket),
+		Key:         aws.String(key),
+		Body:        file,
+		ContentType: contentTypeParam(f),
+		Metadata:    map[string]*string{"md5": aws.String(md5Hex(contentMD5))},
+	})
+	return key, sendWithMD5(req, contentMD5)
+}
+
+// confirm does nothing, the server checks for files uploaded with burner
+// credentials itself
+func (t *burnerTarget) confirm(key string) error {
+	return nil
+}
+
+func (t *burnerTarget) start(f *localFile, contentMD5 string) (string, string, error) {
+	b := t.files[f.Path]
+	key := b.key(f)
+	out, err := t.clients[b.Name].CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(b.Bucket),
+		Key:         aws.String(key),
+		ContentType: contentTypeParam(f),
+		Metadata:    map[string]*string{"md5": aws.String(md5Hex(contentMD5))},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if aws.StringValue(out.UploadId) == "" {
+		return "", "", fmt.Errorf("storage didn't return an upload id")
+	}
+	return key, *out.UploadId, nil
+}
+
+func (t *burnerTarget) uploadPart(key, uploadId string, partNumber int64, body []byte, contentMD5 string) (string, error) {
+	b, svc, err := t.keyClient(key)
+	if err != nil {
+		return "", err
+	}
+	req, out := svc.UploadPartRequest(&s3.UploadPartInput{
+		Bucket:     aws.String(b.Bucket),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadId),
+		PartNumber: aws.Int64(partNumber),
+		Body:       bytes.NewReader(body),
+	})
+	if err := sendWithMD5(req, contentMD5); err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+func (t *burnerTarget) listParts(key, uploadId string) ([]*part, error) {
+	b, svc, err := t.keyClient(key)
+	if err != nil {
+		return nil, err
+	}
+	var parts []*part
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(b.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}
+	for {
+		out, err := svc.ListParts(input)
+		if e, ok := err.(awserr.Error); ok && e.Code() == "NoSuchUpload" {
+			return nil, errNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, p := range out.Parts {
+			parts = append(parts, &part{PartNumber: aws.Int64Value(p.PartNumber), ETag: aws.StringValue(p.ETag)})
+		}
+		if out.IsTruncated == nil || !*out.IsTruncated {
+			return parts, nil
+		}
+		input.PartNumberMarker = out.NextPartNumberMarker
+	}
+}
+
+func (t *burnerTarget) complete(key, uploadId string, parts []*part) error {
+	b, svc, err := t.keyClient(key)
+	if err != nil {
+		return err
+	}
+	completed := make([]*s3.CompletedPart, len(parts))
+	for i, p := range parts {
+		completed[i] = &s3.CompletedPart{PartNumber: aws.Int64(p.PartNumber), ETag: aws.String(p.ETag)}
+	}
+
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+// sendWithMD5 sends req with a Content-MD5 header, so storage refuses a
+// body that changed on the way
+func sendWithMD5(req *request.Request, contentMD5 string) error {
+	req.HTTPRequest.Header.Set("Content-MD5", contentMD5)
+	return req.Send()
+}
+
+// storageRetryDelay checks if a failed storage request is worth trying
+// again: requests that never got a response & server errors are
+func storageRetryDelay(err error, wait time.Duration) (time.Duration, bool) {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		return wait, e.StatusCode() >= 500
+	}
+	if e, ok := err.(awserr.Error); ok {
+		return wait, e.Code() == "RequestError"
+	}
+	return 0, false
+}
+
+// contentTypeParam gives f's content type for the s3 api, or nil if it isn't
+// known
+func contentTypeParam(f *localFile) *string {
+	if t := contentType(f.Name); t != "" {
+		return aws.String(t)
+	}
+	return nil
+}
+
+// md5Hex converts a base64 md5 digest to hex, the format md5sum prints
+func md5Hex(sum string) string {
+	digest, err := base64.StdEncoding.DecodeString(sum)
+	if err != nil || len(digest) != md5.Size {
+		return ""
+	}
+	return hex.EncodeToString(digest)
+}
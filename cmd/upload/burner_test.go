@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// burnerServer issues burner credentials for at most maxFiles files at a
+// time, giving no path for any file named in missing
+func burnerServer(t *testing.T, maxFiles int, missing string) (*httptest.Server, *[][]string) {
+	var requests [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names := r.URL.Query()["object_name"]
+		requests = append(requests, names)
+		if len(names) > maxFiles {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "too many files", "max_files": maxFiles})
+			return
+		}
+
+		b := &Burner{Name: fmt.Sprintf("burner-%d", len(requests)), Bucket: "bucket", Region: "us-east-1"}
+		b.Credentials.Expiration = time.Now().Add(time.Hour)
+		for _, name := range names {
+			if name == missing {
+				name = ""
+			} else {
+				name = "docs/" + name
+			}
+			b.Paths = append(b.Paths, name)
+		}
+		json.NewEncoder(w).Encode(b)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestNewBurnerTargetBatches(t *testing.T) {
+	srv, requests := burnerServer(t, 2, "")
+	c, err := newClient(srv.URL, "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := newTestState(t)
+	var files []*localFile
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		files = append(files, newTestFile(t, name, name))
+	}
+
+	target, err := newBurnerTarget(c, state, files, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := [][]string{{"a.txt", "b.txt", "c.txt"}, {"a.txt", "b.txt"}, {"c.txt"}}
+	if fmt.Sprint(*requests) != fmt.Sprint(expect) {
+		t.Errorf("expected requests for %v, got %v", expect, *requests)
+	}
+	for _, f := range files {
+		b := target.files[f.Path]
+		if b == nil || b.key(f) != "docs/"+f.Name {
+			t.Errorf("expected %s to be uploaded to docs/%s", f.Name, f.Name)
+		}
+	}
+	if len(state.Burners) != 2 {
+		t.Errorf("expected both sets of credentials to be saved, got %d", len(state.Burners))
+	}
+
+	// a later run reuses them
+	*requests = nil
+	if _, err := newBurnerTarget(c, state, files, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 0 {
+		t.Errorf("expected saved credentials to be reused, got requests for %v", *requests)
+	}
+}
+
+func TestNewBurnerTargetRefusesMissingPath(t *testing.T) {
+	srv, _ := burnerServer(t, 10, "b.txt")
+	c, err := newClient(srv.URL, "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []*localFile{newTestFile(t, "a.txt", "a"), newTestFile(t, "b.txt", "b")}
+
+	_, err = newBurnerTarget(c, newTestState(t), files, false)
+	if err == nil || !strings.Contains(err.Error(), "b.txt") {
+		t.Errorf("expected a file without a path to fail, got %v", err)
+	}
+}
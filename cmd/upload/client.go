@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client talks to the upload server
+type client struct {
+	base     *url.URL
+	username string
+	password string
+	apiKey   string
+	invite   string
+	// params are sent with every request that asks for an upload, the
+	// upload dir & provenance details
+	params url.Values
+	http   *http.Client
+}
+
+// newClient creates a client for the server at server. requests are signed
+// in with an api key, basic auth credentials or an invite, whichever is set
+func newClient(server, username, password, apiKey, invite string) (*client, error) {
+	base, err := url.Parse(strings.TrimRight(server, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("server must be an http or https url, eg. https://uploads.example.org")
+	}
+
+	return &client{
+		base:     base,
+		username: username,
+		password: password,
+		apiKey:   apiKey,
+		invite:   invite,
+		http:     &http.Client{},
+	}, nil
+}
+
+// httpError is an unsuccessful response from the server or storage
+type httpError struct {
+	// Status is the response's status code, or 0 if no response arrived
+	Status  int
+	Message string
+	// RetryAfter is how long the server asked to wait before trying again
+	RetryAfter time.Duration
+	// MaxFiles is how many files the server allows in a burner request,
+	// given when it refuses one naming more
+	MaxFiles int
+}
+
+func (e *httpError) Error() string {
+	if e.Status == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+// resolve gives the absolute url for ref, which may be relative to the
+// server, as local storage urls are
+func (c *client) resolve(ref string) (string, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return c.base.ResolveReference(u).String(), nil
+}
+
+// call makes a request to the server api at path, decoding the JSON
+// response into v
+func (c *client) call(method, path string, params url.Values, body interface{}, v interface{}) error {
+	u := *c.base
+	u.Path = strings.TrimRight(u.Path, "/") + path
+	q := url.Values{}
+	for k, vals := range params {
+		q[k] = vals
+	}
+	if c.invite != "" {
+		q.Set("invite", c.invite)
+	}
+	u.RawQuery = q.Encode()
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case c.apiKey != "":
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return &httpError{Message: err.Error()}
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return &httpError{Message: err.Error()}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return responseError(res, data)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error reading response from %s: %s", path, err)
+	}
+	return nil
+}
+
+// send makes a request to storage, returning the response's ETag
+func (c *client) send(req *http.Request) (string, error) {
+	res, err := c.http.Do(req)
+	if err != nil {
+		return "", &httpError{Message: err.Error()}
+	}
+	defer res.Body.Close()
+
+	data, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", responseError(res, data)
+	}
+	return res.Header.Get("ETag"), nil
+}
+
+// responseError describes an unsuccessful response, using the server's
+// JSON error message if there is one
+func responseError(res *http.Response, body []byte) error {
+	e := &httpError{Status: res.StatusCode, Message: http.StatusText(res.StatusCode)}
+
+	msg := map[string]interface{}{}
+	if json.Unmarshal(body, &msg) == nil && msg["error"] != nil {
+		e.Message = fmt.Sprint(msg["error"])
+		if n, ok := msg["max_files"].(float64); ok {
+			e.MaxFiles = int(n)
+		}
+	} else if res.StatusCode == http.StatusUnauthorized {
+		e.Message = "sign in with -user & UPLOAD_PASSWORD, UPLOAD_API_KEY or -invite"
+	} else if s := strings.TrimSpace(string(body)); s != "" && len(s) < 512 {
+		// storage describes errors in xml
+		e.Message = s
+	}
+
+	if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+// uploadParams gives the params for requesting an upload of f, along with
+// the upload dir & provenance details
+func (c *client) uploadParams(f *localFile) url.Values {
+	params := url.Values{}
+	for k, v := range c.params {
+		params[k] = v
+	}
+	params.Set("object_name", f.Name)
+	params.Set("object_size", strconv.FormatInt(f.Size, 10))
+	if t := contentType(f.Name); t != "" {
+		params.Set("mime_type", t)
+	}
+	return params
+}
@@ -0,0 +1,205 @@
+// Command upload sends files & whole directories to an upload server from
+// the command line, a single binary that can be handed to volunteers in
+// place of the aws cli.
+//
+// Files are uploaded through urls signed by the server, the same way the
+// upload page does it, or with -burner straight to storage with burner
+// credentials. Files over 100MB are sent in parts, several at a time, and
+// every request carries an md5 checksum storage checks it against. Progress
+// is saved to a state file, so running the same command again after an
+// interruption resumes where it left off & skips files already uploaded.
+//
+// Usage:
+//
+//	upload -server https://uploads.example.org -dir example_directory [flags] path...
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// multipartThreshold is the size above which files are uploaded in parts,
+// matching the upload page
+const multipartThreshold = 100 * 1024 * 1024
+
+// localFile is a file to upload
+type localFile struct {
+	// Path is where the file is on disk
+	Path string
+	// Name is the object_name the file is uploaded as. files found in a
+	// directory keep their path within it, eg. "dataset/2017/data.csv"
+	Name string
+	Size int64
+	// ModTime is used with Size to notice files that changed since they
+	// were last uploaded
+	ModTime int64
+}
+
+func main() {
+	var (
+		server    = flag.String("server", os.Getenv("UPLOAD_SERVER"), "upload server url, or UPLOAD_SERVER")
+		dir       = flag.String("dir", "", "directory on the server to upload to")
+		username  = flag.String("user", os.Getenv("UPLOAD_USERNAME"), "username to sign in with, or UPLOAD_USERNAME. the password is read from UPLOAD_PASSWORD")
+		invite    = flag.String("invite", "", "invite token to upload with")
+		burner    = flag.Bool("burner", false, "upload straight to storage with burner credentials")
+		parallel  = flag.Int("parallel", 4, "number of parts to upload at once")
+		partSize  = flag.Int64("part-size", 50, "size of each part of a multipart upload, in MB")
+		retries   = flag.Int("retries", 5, "number of times to retry a failed request")
+		statePath = flag.String("state", ".upload-state.json", "file progress is saved to, for resuming")
+
+		uploader  = flag.String("uploader", "", "name of the person uploading, recorded with each file")
+		sourceURL = flag.String("source-url", "", "url the files were collected from")
+		agency    = flag.String("agency", "", "agency that published the files")
+		notes     = flag.String("notes", "", "notes recorded with each file")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -server [url] -dir [dir] [flags] path...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Uploads each file & everything in each directory given. API keys are read from UPLOAD_API_KEY.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *server == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *parallel < 1 || *partSize < 5 || *retries < 0 {
+		fatal(fmt.Errorf("parallel must be at least 1, part-size at least 5 & retries can't be negative"))
+	}
+
+	files, hasDirs, err := collectFiles(flag.Args(), *statePath)
+	if err != nil {
+		fatal(err)
+	}
+	if len(files) == 0 {
+		fatal(fmt.Errorf("no files to upload"))
+	}
+
+	state, err := loadState(*statePath, *server, *dir)
+	if err != nil {
+		fatal(err)
+	}
+
+	c, err := newClient(*server, *username, os.Getenv("UPLOAD_PASSWORD"), os.Getenv("UPLOAD_API_KEY"), *invite)
+	if err != nil {
+		fatal(err)
+	}
+	c.params = url.Values{}
+	for k, v := range map[string]string{
+		"dir":        *dir,
+		"uploader":   *uploader,
+		"source_url": *sourceURL,
+		"agency":     *agency,
+		"notes":      *notes,
+	} {
+		if v != "" {
+			c.params.Set(k, v)
+		}
+	}
+
+	// files uploaded by an earlier run are skipped
+	var pending []*localFile
+	for _, f := range files {
+		if fs := state.file(f); fs.Done {
+			fmt.Printf("%s: already uploaded to %s\n", f.Path, fs.Key)
+			continue
+		}
+		pending = append(pending, f)
+	}
+	if len(pending) == 0 {
+		fmt.Println("nothing left to upload")
+		return
+	}
+
+	var t target = &serverTarget{c: c}
+	if *burner {
+		if t, err = newBurnerTarget(c, state, pending, hasDirs); err != nil {
+			fatal(err)
+		}
+	}
+
+	u := &uploadRunner{
+		target:   t,
+		state:    state,
+		parallel: *parallel,
+		partSize: *partSize * 1024 * 1024,
+		retries:  *retries,
+	}
+	failed := 0
+	for _, f := range pending {
+		if err := u.upload(f); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", f.Path, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d files failed, run the same command again to retry them\n", failed, len(pending))
+		os.Exit(1)
+	}
+	fmt.Printf("uploaded %d files\n", len(pending))
+}
+
+// collectFiles finds every file in paths, walking directories. hasDirs
+// reports if any path was a directory. the state file is never uploaded
+func collectFiles(paths []string, statePath string) (files []*localFile, hasDirs bool, err error) {
+	skip, _ := filepath.Abs(statePath)
+
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, newLocalFile(p, filepath.Base(p), info))
+			continue
+		}
+
+		hasDirs = true
+		root := filepath.Dir(filepath.Clean(p))
+		err = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if abs, _ := filepath.Abs(path); !info.Mode().IsRegular() || abs == skip {
+				return nil
+			}
+
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, newLocalFile(path, filepath.ToSlash(name), info))
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return files, hasDirs, nil
+}
+
+// newLocalFile describes the file at path, to be uploaded as name
+func newLocalFile(path, name string, info os.FileInfo) *localFile {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return &localFile{
+		Path:    path,
+		Name:    strings.TrimPrefix(name, "./"),
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+	}
+}
+
+// fatal prints err & exits
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// State records the progress of uploads in a file, so an interrupted run
+// can pick up where it left off. It's kept per server & upload dir
+type State struct {
+	Server string `json:"server"`
+	Dir    string `json:"dir"`
+	// Burners are the burner credentials issued that haven't expired,
+	// reused while they last so resumed uploads keep their paths
+	Burners []*Burner `json:"burners,omitempty"`
+	// Files are keyed by absolute path
+	Files map[string]*FileState `json:"files"`
+
+	path string
+	sync.Mutex
+}
+
+// FileState is the progress of a single file's upload
+type FileState struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"modTime"`
+	// Key is where the file is being uploaded to
+	Key string `json:"key,omitempty"`
+	// UploadId, PartSize & Parts track a multipart upload, with the ETag
+	// of each uploaded part keyed by part number
+	UploadId string           `json:"uploadId,omitempty"`
+	PartSize int64            `json:"partSize,omitempty"`
+	Parts    map[int64]string `json:"parts,omitempty"`
+	Done     bool             `json:"done,omitempty"`
+}
+
+// reset forgets an upload in progress
+func (fs *FileState) reset() {
+	fs.Key = ""
+	fs.UploadId = ""
+	fs.PartSize = 0
+	fs.Parts = nil
+	fs.Done = false
+}
+
+// loadState reads the state file at path, or starts a new one if it doesn't
+// exist. A state file kept for a different server or dir is refused, so
+// files aren't skipped because they went somewhere else
+func loadState(path, server, dir string) (*State, error) {
+	s := &State{
+		Server: server,
+		Dir:    dir,
+		Files:  map[string]*FileState{},
+		path:   path,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("error reading state file %s: %s", path, err)
+	}
+	if s.Server != server || s.Dir != dir {
+		return nil, fmt.Errorf("state file %s is for uploads to '%s' on %s, use -state to pick another file", path, s.Dir, s.Server)
+	}
+	if s.Files == nil {
+		s.Files = map[string]*FileState{}
+	}
+	return s, nil
+}
+
+// file gives the state of f's upload, starting over if f has changed since
+// it was recorded
+func (s *State) file(f *localFile) *FileState {
+	s.Lock()
+	defer s.Unlock()
+
+	fs := s.Files[f.Path]
+	if fs == nil || fs.Size != f.Size || fs.ModTime != f.ModTime {
+		fs = &FileState{Size: f.Size, ModTime: f.ModTime}
+		s.Files[f.Path] = fs
+	}
+	return fs
+}
+
+// burner gives the newest credentials that can upload f & won't run out
+// soon, or nil if there aren't any
+func (s *State) burner(f *localFile) *Burner {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for i := len(s.Burners) - 1; i >= 0; i-- {
+		if b := s.Burners[i]; b.usable(now) && b.key(f) != "" {
+			return b
+		}
+	}
+	return nil
+}
+
+// addBurner keeps new credentials, dropping any that have expired. call
+// it through update
+func (s *State) addBurner(b *Burner) {
+	now := time.Now()
+	kept := make([]*Burner, 0, len(s.Burners)+1)
+	for _, old := range s.Burners {
+		if now.Before(old.Credentials.Expiration) {
+			kept = append(kept, old)
+		}
+	}
+	s.Burners = append(kept, b)
+}
+
+// hasPart checks if part n of fs has been uploaded
+func (s *State) hasPart(fs *FileState, n int64) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := fs.Parts[n]
+	return ok
+}
+
+// update makes changes with fn & saves them. fn is called with the state
+// locked, so workers can update it at once
+func (s *State) update(fn func()) {
+	s.Lock()
+	defer s.Unlock()
+
+	fn()
+	if err := s.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "error saving %s, progress may be lost: %s\n", s.path, err)
+	}
+}
+
+// save writes the state file. it can hold burner credentials, so only the
+// current user can read it. the file is replaced in one go, so it's never
+// left half-written
+func (s *State) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".upload-state")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := loadState(path, "https://uploads.example.org", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Files) != 0 {
+		t.Errorf("expected a new state file to be empty, got %d files", len(s.Files))
+	}
+
+	f := &localFile{Path: "/data/a.txt", Name: "a.txt", Size: 100, ModTime: 1}
+	fs := s.file(f)
+	s.update(func() {
+		fs.Key, fs.UploadId, fs.PartSize = "docs/a.txt", "upload-1", 50
+		fs.Parts = map[int64]string{1: `"etag-1"`}
+	})
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the state file to only be readable by its owner, got %s", info.Mode().Perm())
+	}
+
+	// a later run picks up the multipart upload
+	s, err = loadState(path, "https://uploads.example.org", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs = s.file(f)
+	if fs.UploadId != "upload-1" || !s.hasPart(fs, 1) || s.hasPart(fs, 2) {
+		t.Errorf("expected the upload to be resumed with part 1 done, got %+v", fs)
+	}
+
+	// the file changed since, so it starts over
+	changed := &localFile{Path: f.Path, Name: f.Name, Size: f.Size, ModTime: 2}
+	if fs := s.file(changed); fs.UploadId != "" || len(fs.Parts) != 0 {
+		t.Errorf("expected a changed file to start over, got %+v", fs)
+	}
+
+	for _, c := range []struct{ server, dir string }{
+		{"https://other.example.org", "docs"},
+		{"https://uploads.example.org", "other"},
+	} {
+		if _, err := loadState(path, c.server, c.dir); err == nil || !strings.Contains(err.Error(), "-state") {
+			t.Errorf("expected a state file for another server or dir to be refused, got %v", err)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(path, "https://uploads.example.org", "docs"); err == nil {
+		t.Error("expected a corrupt state file to be refused")
+	}
+}
+
+func TestStateBurners(t *testing.T) {
+	s := newTestState(t)
+	now := time.Now()
+	a := &localFile{Path: "/data/a.txt", Name: "a.txt"}
+	b := &localFile{Path: "/data/b.txt", Name: "b.txt"}
+
+	expired := &Burner{Name: "expired", Keys: map[string]string{a.Path: "docs/a.txt"}}
+	expired.Credentials.Expiration = now.Add(-time.Minute)
+	expiring := &Burner{Name: "expiring", Keys: map[string]string{a.Path: "docs/a.txt"}}
+	expiring.Credentials.Expiration = now.Add(burnerMargin / 2)
+	active := &Burner{Name: "active", Keys: map[string]string{a.Path: "docs/a_1.txt"}}
+	active.Credentials.Expiration = now.Add(time.Hour)
+
+	s.update(func() {
+		s.Burners = []*Burner{expired, expiring}
+		s.addBurner(active)
+	})
+	if len(s.Burners) != 2 || s.Burners[0] != expiring || s.Burners[1] != active {
+		t.Errorf("expected expired credentials to be dropped, got %d burners", len(s.Burners))
+	}
+	if got := s.burner(a); got != active {
+		t.Errorf("expected credentials that won't run out soon, got %v", got)
+	}
+	if got := s.burner(b); got != nil {
+		t.Errorf("expected no credentials for a file none were issued for, got %s", got.Name)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxUploadParts is the largest number of parts storage accepts for a
+// single multipart upload
+const maxUploadParts = 10000
+
+// errNotFound is returned when a multipart upload no longer exists
+var errNotFound = errors.New("upload not found")
+
+// part is an uploaded part of a multipart upload
+type part struct {
+	PartNumber int64  `json:"partNumber"`
+	ETag       string `json:"etag"`
+}
+
+// partsByNumber sorts parts by part number, the order storage needs them in
+type partsByNumber []*part
+
+func (p partsByNumber) Len() int           { return len(p) }
+func (p partsByNumber) Less(i, j int) bool { return p[i].PartNumber < p[j].PartNumber }
+func (p partsByNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// target is where files are uploaded to: storage through urls the server
+// signs, or storage directly with burner credentials. contentMD5 is the
+// base64 md5 digest of the body being sent, which storage checks
+type target interface {
+	// put uploads a whole file in one request, returning its key even if
+	// the upload failed. replaces is the key of an earlier attempt whose
+	// path was taken by another upload, if any
+	put(f *localFile, contentMD5, replaces string) (string, error)
+	// confirm asks the server to check an upload arrived intact
+	confirm(key string) error
+	// start begins a multipart upload of f, returning its key & upload id.
+	// contentMD5 is the whole file's digest, recorded for checking once the
+	// parts are assembled
+	start(f *localFile, contentMD5 string) (string, string, error)
+	// uploadPart sends a single part of a multipart upload, returning its ETag
+	uploadPart(key, uploadId string, partNumber int64, body []byte, contentMD5 string) (string, error)
+	// listParts gives the parts already uploaded, or errNotFound
+	listParts(key, uploadId string) ([]*part, error)
+	// complete assembles uploaded parts into the file
+	complete(key, uploadId string, parts []*part) error
+}
+
+// serverTarget uploads through urls signed by the server, the same way the
+// upload page does
+type serverTarget struct {
+	c *client
+}
+
+func (t *serverTarget) put(f *localFile, contentMD5, replaces string) (string, error) {
+	params := t.c.uploadParams(f)
+	params.Set("md5", contentMD5)
+	if replaces != "" {
+		params.Set("replaces", replaces)
+	}
+
+	signed := struct {
+		Method        string            `json:"method"`
+		SignedRequest string            `json:"signedRequest"`
+		Key           string            `json:"key"`
+		Headers       map[string]string `json:"headers"`
+		Fields        map[string]string `json:"fields"`
+	}{}
+	if err := t.c.call("GET", "/token", params, nil, &signed); err != nil {
+		return "", err
+	}
+	signedURL, err := t.c.resolve(signed.SignedRequest)
+	if err != nil {
+		return signed.Key, err
+	}
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return signed.Key, err
+	}
+	defer file.Close()
+
+	var req *http.Request
+	if signed.Method == "POST" {
+		req, err = postRequest(signedURL, signed.Fields, f, file)
+	} else {
+		// a nil body sends an empty file without chunked encoding
+		var body io.Reader = file
+		if f.Size == 0 {
+			body = nil
+		}
+		req, err = http.NewRequest("PUT", signedURL, body)
+		if req != nil {
+			req.ContentLength = f.Size
+			for k, v := range signed.Headers {
+				req.Header.Set(k, v)
+			}
+		}
+	}
+	if err != nil {
+		return signed.Key, err
+	}
+
+	_, err = t.c.send(req)
+	return signed.Key, err
+}
+
+// postRequest builds a form upload of file with the signed fields. the file
+// must be the last field, after the policy that covers it
+func postRequest(signedURL string, fields map[string]string, f *localFile, file io.Reader) (*http.Request, error) {
+	head := &bytes.Buffer{}
+	w := multipart.NewWriter(head)
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := w.CreateFormFile("file", filepath.Base(f.Name)); err != nil {
+		return nil, err
+	}
+	tail := "\r\n--" + w.Boundary() + "--\r\n"
+
+	req, err := http.NewRequest("POST", signedURL, io.MultiReader(head, file, bytes.NewBufferString(tail)))
+	if err != nil {
+		return nil, err
+	}
+	// storage needs the length up front
+	req.ContentLength = int64(head.Len()) + f.Size + int64(len(tail))
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req, nil
+}
+
+func (t *serverTarget) confirm(key string) error {
+	return t.c.call("POST", "/complete", url.Values{"key": {key}}, nil, nil)
+}
+
+func (t *serverTarget) start(f *localFile, contentMD5 string) (string, string, error) {
+	started := struct {
+		UploadId string `json:"uploadId"`
+		Key      string `json:"key"`
+	}{}
+	params := t.c.uploadParams(f)
+	params.Set("md5", contentMD5)
+	err := t.c.call("GET", "/multipart/start", params, nil, &started)
+	return started.Key, started.UploadId, err
+}
+
+func (t *serverTarget) uploadPart(key, uploadId string, partNumber int64, body []byte, contentMD5 string) (string, error) {
+	signed := struct {
+		SignedRequest string            `json:"signedRequest"`
+		Headers       map[string]string `json:"headers"`
+	}{}
+	params := url.Values{
+		"key":        {key},
+		"uploadId":   {uploadId},
+		"partNumber": {strconv.FormatInt(partNumber, 10)},
+		"md5":        {contentMD5},
+	}
+	if err := t.c.call("GET", "/multipart/sign", params, nil, &signed); err != nil {
+		return "", err
+	}
+	signedURL, err := t.c.resolve(signed.SignedRequest)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("PUT", signedURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-MD5", contentMD5)
+	for k, v := range signed.Headers {
+		req.Header.Set(k, v)
+	}
+	return t.c.send(req)
+}
+
+func (t *serverTarget) listParts(key, uploadId string) ([]*part, error) {
+	var parts []*part
+	err := t.c.call("GET", "/multipart/parts", url.Values{"key": {key}, "uploadId": {uploadId}}, nil, &parts)
+	if e, ok := err.(*httpError); ok && e.Status == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	return parts, err
+}
+
+func (t *serverTarget) complete(key, uploadId string, parts []*part) error {
+	return t.c.call("POST", "/multipart/complete", nil, map[string]interface{}{
+		"key":      key,
+		"uploadId": uploadId,
+		"parts":    parts,
+	}, nil)
+}
+
+// uploadRunner uploads files to a target, saving progress to state
+type uploadRunner struct {
+	target   target
+	state    *State
+	parallel int
+	partSize int64
+	retries  int
+}
+
+// upload sends f to the target, in parts if it's large, resuming any
+// multipart upload an earlier run started
+func (u *uploadRunner) upload(f *localFile) error {
+	fs := u.state.file(f)
+	if f.Size <= multipartThreshold && fs.UploadId == "" {
+		return u.uploadWhole(f, fs)
+	}
+	return u.uploadMultipart(f, fs)
+}
+
+// uploadWhole sends f in a single request
+func (u *uploadRunner) uploadWhole(f *localFile, fs *FileState) error {
+	fmt.Printf("%s: calculating checksum\n", f.Path)
+	sum, err := fileMD5(f.Path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: uploading %s\n", f.Path, humanBytes(f.Size))
+	var key, replaces string
+	err = u.retry(f.Path, func() (err error) {
+		key, err = u.target.put(f, sum, replaces)
+		if e, ok := err.(*httpError); ok && e.Status == http.StatusPreconditionFailed {
+			// another upload took the path after it was signed, ask for
+			// a new one in place of it
+			replaces = key
+			return &pathTakenError{e}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return u.finish(f, fs, key)
+}
+
+// uploadMultipart sends f in parts, u.parallel at a time
+func (u *uploadRunner) uploadMultipart(f *localFile, fs *FileState) error {
+	if fs.UploadId != "" {
+		var parts []*part
+		err := u.retry(f.Path, func() (err error) {
+			parts, err = u.target.listParts(fs.Key, fs.UploadId)
+			return err
+		})
+		switch err {
+		case nil:
+			fmt.Printf("%s: resuming upload to %s, %d parts already uploaded\n", f.Path, fs.Key, len(parts))
+			u.state.update(func() {
+				fs.Parts = map[int64]string{}
+				for _, p := range parts {
+					fs.Parts[p.PartNumber] = p.ETag
+				}
+			})
+		case errNotFound:
+			fmt.Printf("%s: earlier upload to %s can't be resumed, starting again\n", f.Path, fs.Key)
+			u.state.update(func() { fs.reset() })
+		default:
+			return err
+		}
+	}
+
+	if fs.UploadId == "" {
+		fmt.Printf("%s: calculating checksum\n", f.Path)
+		sum, err := fileMD5(f.Path)
+		if err != nil {
+			return err
+		}
+
+		var key, uploadId string
+		err = u.retry(f.Path, func() (err error) {
+			key, uploadId, err = u.target.start(f, sum)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		u.state.update(func() {
+			fs.Key, fs.UploadId = key, uploadId
+			fs.PartSize = partSize(f.Size, u.partSize)
+			fs.Parts = map[int64]string{}
+		})
+	}
+
+	total := (f.Size + fs.PartSize - 1) / fs.PartSize
+	if total == 0 {
+		total = 1
+	}
+	fmt.Printf("%s: uploading %s in %d parts to %s\n", f.Path, humanBytes(f.Size), total, fs.Key)
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// send each part that hasn't been uploaded yet
+	todo := make(chan int64)
+	errs := make(chan error, u.parallel)
+	wg := sync.WaitGroup{}
+	for i := 0; i < u.parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range todo {
+				if err := u.uploadPart(f, fs, file, n, total); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var failed error
+	for n := int64(1); n <= total && failed == nil; n++ {
+		if u.state.hasPart(fs, n) {
+			continue
+		}
+		select {
+		case todo <- n:
+		case failed = <-errs:
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if failed == nil && len(errs) > 0 {
+		failed = <-errs
+	}
+	if failed != nil {
+		return failed
+	}
+
+	parts := make([]*part, 0, total)
+	for n, etag := range fs.Parts {
+		parts = append(parts, &part{PartNumber: n, ETag: etag})
+	}
+	sort.Sort(partsByNumber(parts))
+
+	err = u.retry(f.Path, func() error {
+		return u.target.complete(fs.Key, fs.UploadId, parts)
+	})
+	if err != nil {
+		return err
+	}
+	return u.finish(f, fs, fs.Key)
+}
+
+// uploadPart reads & sends part n of total
+func (u *uploadRunner) uploadPart(f *localFile, fs *FileState, file io.ReaderAt, n, total int64) error {
+	size := fs.PartSize
+	if offset := (n - 1) * fs.PartSize; offset+size > f.Size {
+		size = f.Size - offset
+	}
+	body := make([]byte, size)
+	if _, err := file.ReadAt(body, (n-1)*fs.PartSize); err != nil && err != io.EOF {
+		return err
+	}
+	sum := md5.Sum(body)
+
+	var etag string
+	err := u.retry(fmt.Sprintf("%s part %d", f.Path, n), func() (err error) {
+		etag, err = u.target.uploadPart(fs.Key, fs.UploadId, n, body, base64.StdEncoding.EncodeToString(sum[:]))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	done := 0
+	u.state.update(func() {
+		fs.Parts[n] = etag
+		done = len(fs.Parts)
+	})
+	fmt.Printf("%s: part %d uploaded, %d of %d done\n", f.Path, n, done, total)
+	return nil
+}
+
+// finish confirms a finished upload with the server & records it as done
+func (u *uploadRunner) finish(f *localFile, fs *FileState, key string) error {
+	err := u.retry(f.Path, func() error {
+		return u.target.confirm(key)
+	})
+	if err != nil {
+		return err
+	}
+
+	u.state.update(func() {
+		fs.Key = key
+		fs.Done = true
+		fs.UploadId = ""
+		fs.Parts = nil
+	})
+	fmt.Printf("%s: uploaded to %s\n", f.Path, key)
+	return nil
+}
+
+// retry calls fn until it succeeds, giving up after u.retries retries or an
+// error that trying again won't fix. waits double after each attempt
+func (u *uploadRunner) retry(what string, fn func() error) error {
+	wait := time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		delay, ok := retryDelay(err, wait)
+		if !ok || attempt >= u.retries {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s, retrying in %s\n", what, err, delay)
+		time.Sleep(delay)
+		wait *= 2
+	}
+}
+
+// pathTakenError is a put refused because another upload took its path
+// after it was signed. put asks for a new path when it's tried again
+type pathTakenError struct {
+	*httpError
+}
+
+// retryDelay checks if a failed request is worth trying again, giving how
+// long to wait first. requests that never got a response, server errors,
+// short rate limits & puts to a taken path are retried
+func retryDelay(err error, wait time.Duration) (time.Duration, bool) {
+	if _, ok := err.(*pathTakenError); ok {
+		return 0, true
+	}
+	e, ok := err.(*httpError)
+	if !ok {
+		return storageRetryDelay(err, wait)
+	}
+
+	switch {
+	case e.Status == 0 || e.Status >= 500:
+		return wait, true
+	case e.Status == http.StatusTooManyRequests && e.RetryAfter <= time.Minute:
+		if e.RetryAfter > wait {
+			return e.RetryAfter, true
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// partSize gives the size of each part of a multipart upload of size bytes,
+// at least min & large enough to stay within maxUploadParts
+func partSize(size, min int64) int64 {
+	if s := (size + maxUploadParts - 1) / maxUploadParts; s > min {
+		return s
+	}
+	return min
+}
+
+// fileMD5 gives the base64 md5 digest of the file at path
+func fileMD5(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// contentType guesses a file's content type from its name
+func contentType(name string) string {
+	return mime.TypeByExtension(filepath.Ext(name))
+}
+
+// humanBytes formats a byte count for display, eg. "1.5 GB"
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
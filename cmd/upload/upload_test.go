@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPartSize(t *testing.T) {
+	const mb = 1024 * 1024
+	cases := []struct {
+		size, min, expect int64
+	}{
+		{200 * mb, 50 * mb, 50 * mb},
+		{0, 50 * mb, 50 * mb},
+		// large files get parts big enough to stay within maxUploadParts
+		{maxUploadParts * 50 * mb, 50 * mb, 50 * mb},
+		{maxUploadParts*50*mb + 1, 50 * mb, 50*mb + 1},
+		{1024 * 1024 * mb, 50 * mb, (1024*1024*mb + maxUploadParts - 1) / maxUploadParts},
+	}
+	for _, c := range cases {
+		got := partSize(c.size, c.min)
+		if got != c.expect {
+			t.Errorf("partSize(%d, %d): expected %d, got %d", c.size, c.min, c.expect, got)
+		}
+		if (c.size+got-1)/got > maxUploadParts {
+			t.Errorf("partSize(%d, %d): %d parts is more than storage accepts", c.size, c.min, (c.size+got-1)/got)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	wait := 2 * time.Second
+	cases := []struct {
+		description string
+		err         error
+		delay       time.Duration
+		retry       bool
+	}{
+		{"no response", &httpError{Message: "connection reset"}, wait, true},
+		{"server error", &httpError{Status: http.StatusBadGateway}, wait, true},
+		{"bad request", &httpError{Status: http.StatusBadRequest}, 0, false},
+		{"path taken", &httpError{Status: http.StatusPreconditionFailed}, 0, false},
+		{"path taken on put", &pathTakenError{&httpError{Status: http.StatusPreconditionFailed}}, 0, true},
+		{"short rate limit", &httpError{Status: http.StatusTooManyRequests, RetryAfter: 30 * time.Second}, 30 * time.Second, true},
+		{"shorter rate limit than wait", &httpError{Status: http.StatusTooManyRequests, RetryAfter: time.Second}, wait, true},
+		{"daily quota", &httpError{Status: http.StatusTooManyRequests, RetryAfter: 12 * time.Hour}, 0, false},
+		{"other error", fmt.Errorf("file changed"), 0, false},
+	}
+	for _, c := range cases {
+		delay, retry := retryDelay(c.err, wait)
+		if retry != c.retry || (retry && delay != c.delay) {
+			t.Errorf("%s: expected (%s, %t), got (%s, %t)", c.description, c.delay, c.retry, delay, retry)
+		}
+	}
+}
+
+// takenTarget is a target whose first put finds its path taken
+type takenTarget struct {
+	target
+	puts      int
+	replaces  []string
+	confirmed []string
+	completes int
+}
+
+func (t *takenTarget) put(f *localFile, contentMD5, replaces string) (string, error) {
+	t.puts++
+	t.replaces = append(t.replaces, replaces)
+	key := fmt.Sprintf("docs/%d-%s", t.puts, f.Name)
+	if t.puts == 1 {
+		return key, &httpError{Status: http.StatusPreconditionFailed, Message: "a file already exists"}
+	}
+	return key, nil
+}
+
+func (t *takenTarget) confirm(key string) error {
+	t.confirmed = append(t.confirmed, key)
+	return nil
+}
+
+func (t *takenTarget) complete(key, uploadId string, parts []*part) error {
+	t.completes++
+	return &httpError{Status: http.StatusPreconditionFailed, Message: "a file already exists"}
+}
+
+func newTestFile(t *testing.T, name, body string) *localFile {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newLocalFile(path, name, info)
+}
+
+func newTestState(t *testing.T) *State {
+	s, err := loadState(filepath.Join(t.TempDir(), "state.json"), "https://uploads.example.org", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestUploadWholeReplacesTakenPath(t *testing.T) {
+	f := newTestFile(t, "a.txt", "hello")
+	target := &takenTarget{}
+	u := &uploadRunner{target: target, state: newTestState(t), parallel: 1, partSize: 5 * 1024 * 1024, retries: 2}
+
+	if err := u.upload(f); err != nil {
+		t.Fatal(err)
+	}
+	if target.puts != 2 || target.replaces[0] != "" || target.replaces[1] != "docs/1-a.txt" {
+		t.Errorf("expected the retry to replace the taken key, got puts with replaces %q", target.replaces)
+	}
+	if len(target.confirmed) != 1 || target.confirmed[0] != "docs/2-a.txt" {
+		t.Errorf("expected only the new key to be confirmed, got %v", target.confirmed)
+	}
+}
+
+func TestUploadMultipartDoesntRetryTakenPath(t *testing.T) {
+	f := newTestFile(t, "a.txt", "hello")
+	target := &takenTarget{}
+	u := &uploadRunner{target: target, state: newTestState(t), parallel: 1, partSize: 5 * 1024 * 1024, retries: 2}
+
+	// a multipart upload already sent, waiting to be completed
+	fs := u.state.file(f)
+	fs.Key, fs.UploadId, fs.PartSize = "docs/a.txt", "upload-1", 5*1024*1024
+	fs.Parts = map[int64]string{1: `"etag"`}
+	target.target = &partsTarget{parts: []*part{{PartNumber: 1, ETag: `"etag"`}}}
+
+	if err := u.upload(f); err == nil {
+		t.Error("expected completing to a taken path to fail")
+	}
+	if target.completes != 1 {
+		t.Errorf("expected a 412 from complete not to be retried, completed %d times", target.completes)
+	}
+}
+
+// partsTarget lists parts already uploaded
+type partsTarget struct {
+	target
+	parts []*part
+}
+
+func (t *partsTarget) listParts(key, uploadId string) ([]*part, error) {
+	return t.parts, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// CompleteHandler confirms a file uploaded to a signed url arrived intact,
+// checking the stored file against what was declared when the upload was
+// signed & recording the result in the upload's manifest.
+// Clients call it after a successful upload with the key given by the
+// signing response: POST /complete?key=dir/file.zip
+// Uploads that don't match their manifest respond with a 409 listing the problems
+func CompleteHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	key, err := requestKey(r, r.FormValue("key"))
+	if err != nil {
+		writePathError(w, enc, err)
+		return
+	}
+
+	m, err := ConfirmUpload(store, key)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf("no upload found at %s", key),
+			})
+			return
+		}
+		fmt.Println("error confirming upload", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if m.Status == ManifestMismatch {
+		writeUploadMismatch(w, enc, m)
+		return
+	}
+
+	if err := enc.Encode(m); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// writeUploadMismatch responds with the problems found confirming an upload
+func writeUploadMismatch(w http.ResponseWriter, enc *json.Encoder, m *Manifest) {
+	w.WriteHeader(http.StatusConflict)
+	enc.Encode(map[string]interface{}{
+		"error":    fmt.Sprintf("uploaded file doesn't match what was declared: %s", strings.Join(m.Problems, ", ")),
+		"problems": m.Problems,
+	})
+}
+
+// ConfirmUpload checks the object stored at key against its manifest,
+// recording the outcome in the manifest & the registry. It returns
+// ErrNotFound if either the manifest or the object don't exist. A file that
+// doesn't match is flagged with the ManifestMismatch status, and the
+// problems found are logged
+func ConfirmUpload(svc Storage, key string) (*Manifest, error) {
+	m, err := uploadManifest(svc, key)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := svc.Head(key)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	m.Confirmed = &now
+	m.ETag = obj.ETag
+	m.Problems = verifyUpload(m, obj)
+	m.Status = ManifestConfirmed
+	if len(m.Problems) > 0 {
+		m.Status = ManifestMismatch
+		fmt.Printf("upload %s doesn't match its manifest: %s\n", key, strings.Join(m.Problems, ", "))
+	}
+
+	if err := WriteManifest(svc, m); err != nil {
+		return nil, err
+	}
+	if err := registry.UpdateManifest(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// uploadManifest finds the manifest recorded for key in the registry,
+// falling back to storage for uploads recorded before manifests were kept
+// until confirmation
+func uploadManifest(svc Storage, key string) (*Manifest, error) {
+	rec, err := registry.Get(key)
+	if err == ErrNotFound {
+		return ReadManifest(svc, key)
+	} else if err != nil {
+		return nil, err
+	}
+	return rec.Manifest, nil
+}
+
+// verifyUpload compares a stored object with the size, checksum & content
+// type declared in its manifest, describing any differences. declared values
+// that were left blank aren't checked
+func verifyUpload(m *Manifest, obj *Object) []string {
+	problems := []string{}
+
+	if m.Size > 0 && obj.Size != m.Size {
+		problems = append(problems, fmt.Sprintf("size is %d bytes, expected %d", obj.Size, m.Size))
+	}
+
+	if m.ContentType != "" && obj.ContentType != m.ContentType {
+		problems = append(problems, fmt.Sprintf("content type is '%s', expected '%s'", obj.ContentType, m.ContentType))
+	}
+
+	// the ETag of a file uploaded in a single request is its md5. multipart
+	// ETags have a "-[parts]" suffix & can't be compared
+	etag := strings.Trim(obj.ETag, `"`)
+	if m.MD5 != "" && !strings.Contains(etag, "-") && etag != m.MD5 {
+		problems = append(problems, fmt.Sprintf("md5 is %s, expected %s", etag, m.MD5))
+	}
+
+	return problems
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func openTestRegistry(t *testing.T) {
+	var err error
+	registry, err = openRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.db.Close() })
+}
+
+func TestConfirmUploadWritesPrivateManifest(t *testing.T) {
+	ls := newTestLocalStorage(t)
+	cfg = &config{}
+	store = ls
+	openTestRegistry(t)
+
+	r := httptest.NewRequest("GET", "/token?object_name=a.txt&object_size=5", nil)
+	m := NewManifest(r, "docs/a.txt", "signed_put", &Provenance{Account: "volunteer"})
+	if err := RecordUpload(NewRecord(r, m)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Head(ManifestKey("docs/a.txt")); err != ErrNotFound {
+		t.Fatalf("expected no manifest in storage before the upload is confirmed, got %v", err)
+	}
+
+	if err := ls.PutObject("docs/a.txt", strings.NewReader("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	confirmed, err := ConfirmUpload(ls, "docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed.Status != ManifestConfirmed {
+		t.Errorf("expected status %s, got %s: %v", ManifestConfirmed, confirmed.Status, confirmed.Problems)
+	}
+
+	stored, err := ReadManifest(ls, "docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != ManifestConfirmed || stored.Provenance.Account != "volunteer" {
+		t.Errorf("unexpected stored manifest: %+v", stored)
+	}
+
+	w := httptest.NewRecorder()
+	LocalFileHandler(w, httptest.NewRequest("GET", "/files/docs/a.txt.manifest.json", nil), httprouter.Params{{Key: "key", Value: "/" + ManifestKey("docs/a.txt")}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected manifests not to be served, got status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	LocalFileHandler(w, httptest.NewRequest("GET", "/files/docs/a.txt", nil), httprouter.Params{{Key: "key", Value: "/docs/a.txt"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the upload to be served, got status %d", w.Code)
+	}
+}
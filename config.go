@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -17,16 +18,62 @@ type config struct {
 	// port to listen on, will be read from PORT env variable if present.
 	Port string `json:"port"`
 
+	// read from env variable: STORAGE_BACKEND
+	// where uploads are stored, either "s3" (the default) or "local".
+	// local storage writes uploads to LOCAL_STORAGE_DIR, with the server
+	// accepting uploads itself in place of S3
+	StorageBackend string `json:"STORAGE_BACKEND"`
+	// read from env variable: LOCAL_STORAGE_DIR
+	// directory to write uploads to when using local storage
+	LocalStorageDir string `json:"LOCAL_STORAGE_DIR"`
+	// read from env variable: URL_SIGNING_SECRET
+	// secret used to sign upload urls issued by local storage. if left blank
+	// a random secret is generated at startup
+	UrlSigningSecret string `json:"URL_SIGNING_SECRET"`
+
 	// read from env variable: AWS_REGION
 	// the region your bucket is in, eg "us-east-1"
 	AwsRegion string `json:"AWS_REGION"`
 	// read from env variable: AWS_S3_BUCKET_NAME
 	// should be just the name of your bucket, no protocol prefixes or paths
 	AwsS3BucketName string `json:"AWS_S3_BUCKET_NAME"`
+	// read from env variable: AWS_S3_ENDPOINT
+	// url of an S3-compatible service to use instead of AWS, eg. a MinIO server
+	// at "https://minio.example.org". leave blank to use AWS
+	AwsS3Endpoint string `json:"AWS_S3_ENDPOINT"`
+	// read from env variable: AWS_S3_FORCE_PATH_STYLE
+	// address buckets as endpoint/bucket/key instead of bucket.endpoint/key.
+	// most self-hosted S3-compatible services require this
+	AwsS3ForcePathStyle bool `json:"AWS_S3_FORCE_PATH_STYLE"`
+	// read from env variable: PUBLIC_URL_BASE
+	// base url uploaded files are publicly available at, eg. a CDN in front
+	// of the bucket. object keys are appended to this url. if left blank
+	// urls are built from the bucket & endpoint
+	PublicUrlBase string `json:"PUBLIC_URL_BASE"`
 	// read from env variable: AWS_ACCESS_KEY_ID
+	// access keys for the aws user the server acts as. if left blank along
+	// with AWS_SECRET_ACCESS_KEY the server uses the role it's running
+	// under, eg. an EC2 instance profile or ECS task role
 	AwsAccessKeyId string `json:"AWS_ACCESS_KEY_ID"`
 	// read from env variable: AWS_SECRET_ACCESS_KEY
 	AwsSecretAccessKey string `json:"AWS_SECRET_ACCESS_KEY"`
+	// read from env variable: AWS_STS_ENDPOINT
+	// url of an STS-compatible service to issue burner credentials from,
+	// eg. a MinIO server. leave blank to use AWS
+	AwsStsEndpoint string `json:"AWS_STS_ENDPOINT"`
+	// read from env variable: BURNER_ROLE_ARN
+	// setting a role arn issues burner credentials by assuming the role
+	// with sts:AssumeRole, instead of with sts:GetFederationToken, which
+	// needs the keys of an aws user. sessions are tagged with who they're
+	// for, the upload dir & a request id
+	BurnerRoleArn string `json:"BURNER_ROLE_ARN"`
+	// read from env variable: UPLOAD_METHOD
+	// how uploads signed with /token are sent to S3, either "put" (the
+	// default) to a presigned url, or "post" as a form with a presigned
+	// POST policy. POST policies have S3 enforce the size range, content
+	// type & metadata of each upload, but can't refuse to replace an
+	// existing file. local storage only supports "put"
+	UploadMethod string `json:"UPLOAD_METHOD"`
 
 	// setting HTTP_AUTH_USERNAME & HTTP_AUTH_PASSWORD
 	// will enable basic http auth for the server. This is a single
@@ -37,8 +84,64 @@ type config struct {
 	// read from env variable: HTTP_AUTH_PASSWORD
 	HttpAuthPassword string `json:"HTTP_AUTH_PASSWORD"`
 
+	// user accounts with their own credentials & upload dirs. users listed
+	// here & in USERS_FILE are added the first time the server starts,
+	// after that they're managed through the admin api. Passwords are
+	// given as bcrypt hashes in "password_hash"
+	Users []*User `json:"users"`
+	// read from env variable: USERS_FILE
+	// path to a JSON file with a list of users to add, in the same format
+	// as "users"
+	UsersFile string `json:"USERS_FILE"`
+
+	// setting OIDC_ISSUER lets users sign in with an OpenID Connect identity
+	// provider, eg. "https://accounts.google.com". the server must be
+	// registered with the provider as a client
+	// read from env variable: OIDC_ISSUER
+	OidcIssuer string `json:"OIDC_ISSUER"`
+	// read from env variable: OIDC_CLIENT_ID
+	OidcClientId string `json:"OIDC_CLIENT_ID"`
+	// read from env variable: OIDC_CLIENT_SECRET
+	OidcClientSecret string `json:"OIDC_CLIENT_SECRET"`
+	// read from env variable: OIDC_REDIRECT_URL
+	// url the provider sends users back to, ending in /auth/callback. if
+	// left blank it's worked out from each request
+	OidcRedirectUrl string `json:"OIDC_REDIRECT_URL"`
+	// read from env variable: OIDC_SCOPES
+	// scopes to request, defaults to "openid", "email" & "profile"
+	OidcScopes []string `json:"OIDC_SCOPES"`
+	// rules deciding who can sign in & which dirs they can upload to, based
+	// on their email domain or id token claims. if no rules are set anyone
+	// the provider signs in is allowed. only read from config.json
+	OidcRules []*OIDCRule `json:"OIDC_RULES"`
+	// read from env variable: SESSION_SECRET
+	// secret used to sign session cookies. if left blank a random secret
+	// is generated & kept in the registry database
+	SessionSecret string `json:"SESSION_SECRET"`
+
+	// read from env variable: INVITE_SECRET
+	// secret used to sign invite links. if left blank a random secret is
+	// generated & kept in the registry database
+	InviteSecret string `json:"INVITE_SECRET"`
+
+	// setting ADMIN_USERNAME & ADMIN_PASSWORD enables the admin api, which
+	// requires these credentials. leaving them blank disables the admin api
+	// read from env variable: ADMIN_USERNAME
+	AdminUsername string `json:"ADMIN_USERNAME"`
+	// read from env variable: ADMIN_PASSWORD
+	AdminPassword string `json:"ADMIN_PASSWORD"`
+
+	// read from env variable: REGISTRY_PATH
+	// path of the database file that records every upload, defaults to
+	// "registry.db" in the working directory
+	RegistryPath string `json:"REGISTRY_PATH"`
+
 	// flag to activate Burner Credentials feature
 	EnableBurnerCredentials bool `json:"enable_burner_credentials"`
+	// burner credential settings for each upload dir, keyed by dir. the
+	// scope for "*" applies to any dir without its own. only read from
+	// config.json
+	BurnerScopes map[string]*BurnerScope `json:"BURNER_SCOPES"`
 
 	// deadline sets a time that beyond which, the server will no longer
 	// accept upload requests.
@@ -51,6 +154,34 @@ type config struct {
 	// can also be set with an ENV variable, using commas to separate dirs
 	UploadDirs []string `json:"UPLOAD_DIRS"`
 
+	// limits on the files that can be uploaded to each upload dir, keyed by
+	// dir. limits for "*" apply to any dir without its own. only read from
+	// config.json
+	UploadLimits map[string]*UploadLimits `json:"UPLOAD_LIMITS"`
+
+	// read from env variable: RATE_LIMIT
+	// the number of uploads each user can request per minute from /token,
+	// /multipart/start & /burner. requests without a user are counted by
+	// ip address. 0 for no limit
+	RateLimit int `json:"RATE_LIMIT"`
+	// daily quotas for each user, keyed by username. the quota for "*"
+	// applies to every user without their own, and to each ip address
+	// uploading without a user. only read from config.json
+	UserQuotas map[string]*Quota `json:"USER_QUOTAS"`
+	// daily quotas for each upload dir, shared by everyone uploading to it,
+	// keyed by dir. the quota for "*" applies to each dir without its own.
+	// only read from config.json
+	DirQuotas map[string]*Quota `json:"DIR_QUOTAS"`
+	// read from env variable: TRUST_PROXY
+	// set when the server is behind a proxy like heroku's router, to take
+	// client ip addresses from the X-Forwarded-For header the proxy adds.
+	// without a proxy clients could set the header to anything
+	TrustProxy bool `json:"TRUST_PROXY"`
+	// read from env variable: MAX_BURNER_CREDENTIALS
+	// the number of unexpired burner credentials each user or ip address
+	// can hold at once. 0 for no limit
+	MaxBurnerCredentials int `json:"MAX_BURNER_CREDENTIALS"`
+
 	// support CORS signing from a list of origins
 	AllowedOrigins []string `json:"ALLOWED_ORIGINS"`
 
@@ -86,14 +217,67 @@ func initConfig() (cfg *config, err error) {
 	// as the default. This has the effect of leaving the config.json value unchanged
 	// if the env variable is empty
 	cfg.Port = readEnvString("PORT", cfg.AwsAccessKeyId)
+	cfg.StorageBackend = readEnvString("STORAGE_BACKEND", cfg.StorageBackend)
+	cfg.LocalStorageDir = readEnvString("LOCAL_STORAGE_DIR", cfg.LocalStorageDir)
+	cfg.UrlSigningSecret = readEnvString("URL_SIGNING_SECRET", cfg.UrlSigningSecret)
 	cfg.AwsRegion = readEnvString("AWS_REGION", cfg.AwsRegion)
 	cfg.AwsS3BucketName = readEnvString("AWS_S3_BUCKET_NAME", cfg.AwsS3BucketName)
+	cfg.AwsS3Endpoint = readEnvString("AWS_S3_ENDPOINT", cfg.AwsS3Endpoint)
+	cfg.AwsS3ForcePathStyle = readEnvBool("AWS_S3_FORCE_PATH_STYLE", cfg.AwsS3ForcePathStyle)
+	cfg.PublicUrlBase = readEnvString("PUBLIC_URL_BASE", cfg.PublicUrlBase)
 	cfg.AwsAccessKeyId = readEnvString("AWS_ACCESS_KEY_ID", cfg.AwsAccessKeyId)
 	cfg.AwsSecretAccessKey = readEnvString("AWS_SECRET_ACCESS_KEY", cfg.AwsSecretAccessKey)
+	cfg.AwsStsEndpoint = readEnvString("AWS_STS_ENDPOINT", cfg.AwsStsEndpoint)
+	cfg.BurnerRoleArn = readEnvString("BURNER_ROLE_ARN", cfg.BurnerRoleArn)
+	cfg.UploadMethod = readEnvString("UPLOAD_METHOD", cfg.UploadMethod)
 	cfg.HttpAuthUsername = readEnvString("HTTP_AUTH_USERNAME", cfg.HttpAuthUsername)
 	cfg.HttpAuthPassword = readEnvString("HTTP_AUTH_PASSWORD", cfg.HttpAuthPassword)
+	cfg.UsersFile = readEnvString("USERS_FILE", cfg.UsersFile)
+	cfg.OidcIssuer = readEnvString("OIDC_ISSUER", cfg.OidcIssuer)
+	cfg.OidcClientId = readEnvString("OIDC_CLIENT_ID", cfg.OidcClientId)
+	cfg.OidcClientSecret = readEnvString("OIDC_CLIENT_SECRET", cfg.OidcClientSecret)
+	cfg.OidcRedirectUrl = readEnvString("OIDC_REDIRECT_URL", cfg.OidcRedirectUrl)
+	cfg.OidcScopes = readEnvStringSlice("OIDC_SCOPES", cfg.OidcScopes)
+	cfg.SessionSecret = readEnvString("SESSION_SECRET", cfg.SessionSecret)
+	cfg.InviteSecret = readEnvString("INVITE_SECRET", cfg.InviteSecret)
+	cfg.AdminUsername = readEnvString("ADMIN_USERNAME", cfg.AdminUsername)
+	cfg.AdminPassword = readEnvString("ADMIN_PASSWORD", cfg.AdminPassword)
+	cfg.RegistryPath = readEnvString("REGISTRY_PATH", cfg.RegistryPath)
 	cfg.UploadDirs = readEnvStringSlice("UPLOAD_DIRS", cfg.UploadDirs)
 	cfg.AllowedOrigins = readEnvStringSlice("ALLOWED_ORIGINS", cfg.AllowedOrigins)
+	cfg.RateLimit = readEnvInt("RATE_LIMIT", cfg.RateLimit)
+	cfg.TrustProxy = readEnvBool("TRUST_PROXY", cfg.TrustProxy)
+	cfg.MaxBurnerCredentials = readEnvInt("MAX_BURNER_CREDENTIALS", cfg.MaxBurnerCredentials)
+
+	// upload limits are looked up by dir without slashes
+	limits := make(map[string]*UploadLimits, len(cfg.UploadLimits))
+	for dir, l := range cfg.UploadLimits {
+		limits[strings.Trim(dir, "/")] = l
+	}
+	cfg.UploadLimits = limits
+	quotas := make(map[string]*Quota, len(cfg.DirQuotas))
+	for dir, q := range cfg.DirQuotas {
+		quotas[strings.Trim(dir, "/")] = q
+	}
+	cfg.DirQuotas = quotas
+	// assumed roles can't last as long as federation tokens
+	maxDuration := maxBurnerDuration
+	if cfg.BurnerRoleArn != "" {
+		maxDuration = maxRoleBurnerDuration
+	}
+	scopes := make(map[string]*BurnerScope, len(cfg.BurnerScopes))
+	for dir, sc := range cfg.BurnerScopes {
+		if sc == nil {
+			err = fmt.Errorf("invalid BURNER_SCOPES for '%s': scope must be an object", dir)
+			return
+		}
+		if err = sc.validate(maxDuration); err != nil {
+			err = fmt.Errorf("invalid BURNER_SCOPES for '%s': %s", dir, err)
+			return
+		}
+		scopes[strings.Trim(dir, "/")] = sc
+	}
+	cfg.BurnerScopes = scopes
 
 	// Make sure TemplateData is set
 	if cfg.TemplateData == nil {
@@ -102,19 +286,76 @@ func initConfig() (cfg *config, err error) {
 
 	// add upload_dirs to template data
 	cfg.TemplateData["upload_dirs"] = cfg.UploadDirs
+	// offer signing in with the identity provider
+	cfg.TemplateData["oidc_login"] = cfg.OidcIssuer != ""
 
 	// make sure port is set
 	if cfg.Port == "" {
 		cfg.Port = "8080"
 	}
 
-	// all aws settings are required
-	err = requireConfigStrings(map[string]string{
-		"AWS_REGION":            cfg.AwsRegion,
-		"AWS_S3_BUCKET_NAME":    cfg.AwsS3BucketName,
-		"AWS_ACCESS_KEY_ID":     cfg.AwsAccessKeyId,
-		"AWS_SECRET_ACCESS_KEY": cfg.AwsSecretAccessKey,
-	})
+	if cfg.RegistryPath == "" {
+		cfg.RegistryPath = "registry.db"
+	}
+
+	if cfg.OidcIssuer != "" {
+		if err = requireConfigStrings(map[string]string{
+			"OIDC_CLIENT_ID":     cfg.OidcClientId,
+			"OIDC_CLIENT_SECRET": cfg.OidcClientSecret,
+		}); err != nil {
+			return
+		}
+	}
+
+	// default to storing uploads on S3
+	if cfg.StorageBackend == "" {
+		cfg.StorageBackend = "s3"
+	}
+
+	// default to presigned PUTs, which every backend supports
+	if cfg.UploadMethod == "" {
+		cfg.UploadMethod = "put"
+	}
+
+	switch cfg.UploadMethod {
+	case "put":
+	case "post":
+		if cfg.StorageBackend == "local" {
+			err = fmt.Errorf("UPLOAD_METHOD 'post' isn't supported with local storage")
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown UPLOAD_METHOD: '%s', must be one of 'put' or 'post'", cfg.UploadMethod)
+		return
+	}
+
+	switch cfg.StorageBackend {
+	case "local":
+		err = requireConfigStrings(map[string]string{
+			"LOCAL_STORAGE_DIR": cfg.LocalStorageDir,
+		})
+		return
+	case "s3":
+	default:
+		err = fmt.Errorf("unknown STORAGE_BACKEND: '%s', must be one of 's3' or 'local'", cfg.StorageBackend)
+		return
+	}
+
+	// the region & bucket are required for s3 storage
+	if err = requireConfigStrings(map[string]string{
+		"AWS_REGION":         cfg.AwsRegion,
+		"AWS_S3_BUCKET_NAME": cfg.AwsS3BucketName,
+	}); err != nil {
+		return
+	}
+
+	// access keys are optional, but must be given as a pair
+	if cfg.AwsAccessKeyId != "" || cfg.AwsSecretAccessKey != "" {
+		err = requireConfigStrings(map[string]string{
+			"AWS_ACCESS_KEY_ID":     cfg.AwsAccessKeyId,
+			"AWS_SECRET_ACCESS_KEY": cfg.AwsSecretAccessKey,
+		})
+	}
 
 	return
 }
@@ -135,6 +376,28 @@ func readEnvStringSlice(key string, def []string) []string {
 	return def
 }
 
+// readEnvInt reads an integer from key environment var, returns def if empty
+// or not a valid integer
+func readEnvInt(key string, def int) int {
+	if env := os.Getenv(key); env != "" {
+		if i, err := strconv.Atoi(env); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+// readEnvBool reads a boolean from key environment var, returns def if empty
+// or not a valid boolean
+func readEnvBool(key string, def bool) bool {
+	if env := os.Getenv(key); env != "" {
+		if b, err := strconv.ParseBool(env); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
 // requireConfigStrings panics if any of the passed in values aren't set
 func requireConfigStrings(values map[string]string) error {
 	for key, value := range values {
@@ -149,14 +412,49 @@ func requireConfigStrings(values map[string]string) error {
 // outputs any notable settings to stdout
 func printConfigInfo() {
 	fmt.Println("\nupload server config:")
+	fmt.Println("\tstorage backend:", cfg.StorageBackend)
+	if cfg.StorageBackend == "local" {
+		fmt.Println("\tstoring uploads in:", cfg.LocalStorageDir)
+	}
+	if cfg.AwsS3Endpoint != "" {
+		fmt.Println("\tusing S3-compatible endpoint:", cfg.AwsS3Endpoint)
+	}
+	if cfg.AwsStsEndpoint != "" {
+		fmt.Println("\tusing STS-compatible endpoint:", cfg.AwsStsEndpoint)
+	}
+	if cfg.StorageBackend == "s3" && cfg.AwsAccessKeyId == "" {
+		fmt.Println("\tusing aws credentials from the environment")
+	}
+	if cfg.AwsS3ForcePathStyle {
+		fmt.Println("\tusing path-style bucket addressing")
+	}
+	if cfg.PublicUrlBase != "" {
+		fmt.Println("\tpublic url base:", cfg.PublicUrlBase)
+	}
+	if cfg.UploadMethod == "post" {
+		fmt.Println("\tuploading with presigned POST policies")
+	}
 	if cfg.HttpAuthUsername != "" && cfg.HttpAuthPassword != "" {
 		fmt.Println("\thttp authorization enabled", cfg.Port)
 	}
+	if cfg.OidcIssuer != "" {
+		fmt.Println("\tsigning in with identity provider:", cfg.OidcIssuer)
+	}
+	if cfg.UsersFile != "" {
+		fmt.Println("\tadding users from:", cfg.UsersFile)
+	}
+	fmt.Println("\trecording uploads in:", cfg.RegistryPath)
+	if cfg.AdminUsername != "" && cfg.AdminPassword != "" {
+		fmt.Println("\tadmin api enabled")
+	}
 	if cfg.Deadline != nil {
 		fmt.Println("\tdeadline for uploading set:", cfg.Deadline.String())
 	}
 	if cfg.EnableBurnerCredentials {
 		fmt.Println("\tburner credentials enabled")
+		if cfg.BurnerRoleArn != "" {
+			fmt.Println("\tissuing burner credentials from role:", cfg.BurnerRoleArn)
+		}
 	}
 	if len(cfg.UploadDirs) > 0 {
 		fmt.Println("\tlimiting uploading to the following paths:")
@@ -164,6 +462,21 @@ func printConfigInfo() {
 			fmt.Println("\t\t", d)
 		}
 	}
+	if len(cfg.UploadLimits) > 0 {
+		fmt.Println("\tlimiting the files uploaded to:")
+		for d := range cfg.UploadLimits {
+			fmt.Println("\t\t", d)
+		}
+	}
+	if cfg.RateLimit > 0 {
+		fmt.Println("\tuploads requested per minute limited to:", cfg.RateLimit)
+	}
+	if len(cfg.UserQuotas) > 0 || len(cfg.DirQuotas) > 0 {
+		fmt.Println("\tdaily upload quotas enabled")
+	}
+	if cfg.MaxBurnerCredentials > 0 {
+		fmt.Println("\tburner credentials held at once limited to:", cfg.MaxBurnerCredentials)
+	}
 	if len(cfg.AllowedOrigins) > 0 {
 		fmt.Println("\taccepting requests from the following origins:")
 		for _, o := range cfg.AllowedOrigins {
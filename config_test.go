@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInitConfigBurnerScopes(t *testing.T) {
+	cases := []struct {
+		description string
+		scopes      string
+		err         string
+	}{
+		{"valid", `{"/docs/" : {"max_files" : 5}}`, ""},
+		{"null scope", `{"docs" : null}`, "scope must be an object"},
+		{"short duration", `{"docs" : {"duration_seconds" : 60}}`, "duration_seconds"},
+	}
+
+	for _, c := range cases {
+		t.Chdir(t.TempDir())
+		if err := os.WriteFile("config.json", []byte(`{"AWS_REGION" : "us-east-1", "AWS_S3_BUCKET_NAME" : "bucket", "BURNER_SCOPES" : `+c.scopes+`}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := initConfig()
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", c.description, err)
+			} else if cfg.BurnerScopes["docs"] == nil {
+				t.Errorf("%s: expected the scope to be keyed by dir without slashes", c.description)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error containing '%s', got %v", c.description, c.err, err)
+		}
+	}
+}
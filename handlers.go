@@ -4,6 +4,8 @@ import (
 	"crypto/subtle"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"text/template"
 	"time"
 
@@ -11,13 +13,17 @@ import (
 )
 
 // templates is a collection of views for rendering with the renderTemplate function
-// see homeHandler for an example
-var templates = template.Must(template.ParseFiles(
+// see homeHandler for an example. values are escaped with html, and shquote
+// quotes them for commands shown on a page
+var templates = template.Must(template.New("views").Funcs(template.FuncMap{
+	"shquote": shellQuote,
+}).ParseFiles(
 	"views/index.html",
 	"views/expired.html",
 	"views/accessDenied.html",
 	"views/notFound.html",
 	"views/burner.html",
+	"views/browse.html",
 ))
 
 // CORSHandler is an empty 200 response for OPTIONS requests that responds with
@@ -27,9 +33,21 @@ func CORSHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// HomeHandler renders the home page
+// HomeHandler renders the home page, offering the directories the signed
+// in user can upload to & a way to sign out of sessions
 func HomeHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	renderTemplate(w, "index.html")
+	data := make(map[string]interface{}, len(cfg.TemplateData)+1)
+	for k, v := range cfg.TemplateData {
+		data[k] = v
+	}
+	data["upload_dirs"] = allowedUploadDirs(r)
+	data["username"] = requestUsername(r)
+	data["logout"] = oidc != nil && hasSession(r)
+
+	if err := templates.ExecuteTemplate(w, "index.html", data); err != nil {
+		fmt.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 // renderTemplate renders a template with the values of cfg.TemplateData
@@ -41,39 +59,47 @@ func renderTemplate(w http.ResponseWriter, tmpl string) {
 	}
 }
 
-// middleware handles request logging, expiry & authentication if set
-func middleware(handler httprouter.Handle) httprouter.Handle {
-	// return auth middleware if configuration settings are present
-	if cfg.HttpAuthUsername != "" && cfg.HttpAuthPassword != "" {
-		return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-			// poor man's logging:
-			fmt.Println(r.Method, r.URL.Path, time.Now())
-
-			user, pass, ok := r.BasicAuth()
-			if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(cfg.HttpAuthUsername)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.HttpAuthPassword)) != 1 {
-				w.Header().Set("WWW-Authenticate", `Basic realm="Please enter your username and password for this site"`)
-				w.WriteHeader(http.StatusUnauthorized)
-				renderTemplate(w, "accessDenied.html")
+// middleware handles request logging, expiry & authentication if set.
+// Authentication is required if a shared HTTP_AUTH_USERNAME & password are
+// configured, if any user accounts exist, or if users sign in with an
+// identity provider. Requests carrying an invite instead of basic auth
+// credentials are limited to the invite's dir. Requests with an api key
+// are only let through if the key has one of scopes.
+// The signed in user is attached to the request, see requestUser
+func middleware(handler httprouter.Handle, scopes ...string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		// poor man's logging:
+		fmt.Println(r.Method, r.URL.Path, time.Now())
+
+		if requestAPIKey(r) != "" {
+			user, ok := authenticateAPIKey(w, r, scopes)
+			if !ok {
 				return
 			}
-
-			if cfg.Deadline != nil {
-				if time.Now().After(*cfg.Deadline) {
-					w.WriteHeader(http.StatusForbidden)
-					renderTemplate(w, "expired.html")
+			r = withUser(r, user)
+		} else if _, _, ok := r.BasicAuth(); !ok && requestInviteToken(r) != "" {
+			inv, err := authenticateInvite(w, r)
+			if err != nil {
+				denyAccess(w, err)
+				return
+			}
+			r = withInvite(r, inv)
+		} else if authRequired() {
+			user, err := authenticate(r)
+			if err != nil {
+				// send people browsing the site to sign in
+				if _, _, ok := r.BasicAuth(); oidc != nil && !ok && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+					if hasSession(r) {
+						endSession(w)
+					}
+					http.Redirect(w, r, "/login?return="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
 					return
 				}
+				denyAccess(w, err)
+				return
 			}
-
-			addCorsHeaders(w, r)
-			handler(w, r, p)
+			r = withUser(r, user)
 		}
-	}
-
-	// no-auth middware func
-	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		// poor man's logging:
-		fmt.Println(r.Method, r.URL.Path, time.Now())
 
 		if cfg.Deadline != nil {
 			if time.Now().After(*cfg.Deadline) {
@@ -88,13 +114,72 @@ func middleware(handler httprouter.Handle) httprouter.Handle {
 	}
 }
 
+// denyAccess responds to a request that couldn't be authenticated
+func denyAccess(w http.ResponseWriter, err error) {
+	fmt.Println("authentication failed:", err)
+	if basicAuthEnabled() {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Please enter your username and password for this site"`)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	renderTemplate(w, "accessDenied.html")
+}
+
+// authRequired reports whether requests must be signed in
+func authRequired() bool {
+	return basicAuthEnabled() || oidc != nil
+}
+
+// basicAuthEnabled reports whether users can sign in with basic auth
+func basicAuthEnabled() bool {
+	return (cfg.HttpAuthUsername != "" && cfg.HttpAuthPassword != "") || users.Any()
+}
+
+// authenticate checks a request's basic auth credentials against the shared
+// username & password, then against user accounts. Requests without basic
+// auth credentials are checked for a session
+func authenticate(r *http.Request) (*User, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		if hasSession(r) {
+			return authenticateSession(r)
+		}
+		return nil, fmt.Errorf("no credentials provided")
+	}
+
+	if cfg.HttpAuthUsername != "" && cfg.HttpAuthPassword != "" &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(cfg.HttpAuthUsername)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(cfg.HttpAuthPassword)) == 1 {
+		return &User{Username: username}, nil
+	}
+
+	return users.Authenticate(username, password)
+}
+
+// requestBaseURL gives the scheme & host r was sent to, eg.
+// "https://example.org", trusting X-Forwarded-Proto set by proxies such as
+// heroku's router
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if requestSecure(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// requestSecure checks if r arrived over https, either directly or through
+// a proxy like heroku's router that handles https itself
+func requestSecure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
 func addCorsHeaders(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
 	for _, o := range cfg.AllowedOrigins {
 		if origin == o {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,x-amz-acl,If-None-Match")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			return
 		}
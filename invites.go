@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// invitesBucket is the bolt bucket invites are kept in, keyed by invite id
+var invitesBucket = []byte("invites")
+
+// inviteCookie remembers an invite token in the browser once an invite
+// link has been opened, so the upload page's requests carry it
+const inviteCookie = "invite"
+
+// invites is the shared invite store, opened at startup
+var invites *InviteStore
+
+// Invite lets a specific contributor upload without a password. Invites
+// are limited to a single dir, a number of files & an expiry time
+type Invite struct {
+	ID  string `json:"id"`
+	Dir string `json:"dir"`
+	// MaxFiles is the number of uploads the invite can be used for, 0 for
+	// no limit
+	MaxFiles int `json:"maxFiles"`
+	// Used counts the upload paths handed out with this invite
+	Used    int       `json:"used"`
+	Expires time.Time `json:"expires"`
+	Created time.Time `json:"created"`
+	// Note says who or what the invite is for
+	Note    string `json:"note,omitempty"`
+	Revoked bool   `json:"revoked,omitempty"`
+}
+
+// Username is the name uploads made with the invite are recorded under.
+// usernames can't contain ':', so this never matches a user account
+func (inv *Invite) Username() string {
+	return "invite:" + inv.ID
+}
+
+// inviteClaims are the invite details signed into a token
+type inviteClaims struct {
+	ID       string `json:"id"`
+	Dir      string `json:"dir"`
+	MaxFiles int    `json:"max"`
+	Expires  int64  `json:"exp"`
+}
+
+// InviteStore keeps invites in the registry database & issues tokens for
+// them, signed with an HMAC
+type InviteStore struct {
+	db     *bolt.DB
+	secret []byte
+}
+
+// newInviteStore creates an invite store in db, signing tokens with secret
+func newInviteStore(db *bolt.DB, secret []byte) (*InviteStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(invitesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &InviteStore{db: db, secret: secret}, nil
+}
+
+// Create stores a new invite to upload up to maxFiles files to dir, valid
+// for the expires duration
+func (s *InviteStore) Create(dir string, maxFiles int, expires time.Duration, note string) (*Invite, error) {
+	dir = strings.Trim(dir, "/")
+	if dir == "" || strings.Contains(dir, "..") {
+		return nil, fmt.Errorf("invites must be for a directory")
+	}
+	if maxFiles < 0 {
+		return nil, fmt.Errorf("max_files can't be negative")
+	}
+	if expires <= 0 {
+		return nil, fmt.Errorf("invites must expire in the future")
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	inv := &Invite{
+		ID:       hex.EncodeToString(id),
+		Dir:      dir,
+		MaxFiles: maxFiles,
+		Expires:  now.Add(expires).Truncate(time.Second),
+		Created:  now,
+		Note:     note,
+	}
+	return inv, s.put(inv)
+}
+
+// Token gives the token that grants inv
+func (s *InviteStore) Token(inv *Invite) (string, error) {
+	data, err := json.Marshal(&inviteClaims{
+		ID:       inv.ID,
+		Dir:      inv.Dir,
+		MaxFiles: inv.MaxFiles,
+		Expires:  inv.Expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.signature(payload), nil
+}
+
+// Verify checks a token's signature & returns its invite if it hasn't
+// expired or been revoked. Used up invites still verify, so uploads already
+// started with them can be finished
+func (s *InviteStore) Verify(token string) (*Invite, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(s.signature(token[:i]))) {
+		return nil, fmt.Errorf("invalid invite")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite")
+	}
+	claims := &inviteClaims{}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, fmt.Errorf("invalid invite")
+	}
+
+	inv, err := s.Get(claims.ID)
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("invalid invite")
+	} else if err != nil {
+		return nil, err
+	}
+	return inv, inv.active()
+}
+
+// active checks an invite hasn't expired or been revoked
+func (inv *Invite) active() error {
+	if inv.Revoked {
+		return fmt.Errorf("invite %s has been revoked", inv.ID)
+	}
+	if time.Now().After(inv.Expires) {
+		return fmt.Errorf("invite %s expired at %s", inv.ID, inv.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// usable checks an invite is active & hasn't been used up
+func (inv *Invite) usable() error {
+	if err := inv.active(); err != nil {
+		return err
+	}
+	if inv.MaxFiles > 0 && inv.Used >= inv.MaxFiles {
+		return fmt.Errorf("invite %s has already been used for %d files", inv.ID, inv.MaxFiles)
+	}
+	return nil
+}
+
+// Use counts files uploads against an invite, refusing if the invite can't
+// be used for that many more
+func (s *InviteStore) Use(id string, files int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(invitesBucket)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		inv := &Invite{}
+		if err := json.Unmarshal(data, inv); err != nil {
+			return err
+		}
+		if err := inv.usable(); err != nil {
+			return err
+		}
+		if inv.MaxFiles > 0 && inv.Used+files > inv.MaxFiles {
+			return fmt.Errorf("invite %s can only be used for %d more files", inv.ID, inv.MaxFiles-inv.Used)
+		}
+
+		inv.Used += files
+		data, err := json.Marshal(inv)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+// Release gives back files counted against an invite by Use for uploads
+// that were never issued
+func (s *InviteStore) Release(id string, files int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(invitesBucket)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		inv := &Invite{}
+		if err := json.Unmarshal(data, inv); err != nil {
+			return err
+		}
+		if inv.Used -= files; inv.Used < 0 {
+			inv.Used = 0
+		}
+		data, err := json.Marshal(inv)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+// Get returns the invite with id, or ErrNotFound
+func (s *InviteStore) Get(id string) (*Invite, error) {
+	inv := &Invite{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(invitesBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, inv)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// List returns all invites, sorted by id
+func (s *InviteStore) List() ([]*Invite, error) {
+	list := make([]*Invite, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(invitesBucket).ForEach(func(k, v []byte) error {
+			inv := &Invite{}
+			if err := json.Unmarshal(v, inv); err != nil {
+				return err
+			}
+			list = append(list, inv)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// Revoke stops an invite from being used
+func (s *InviteStore) Revoke(id string) (*Invite, error) {
+	inv, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	inv.Revoked = true
+	return inv, s.put(inv)
+}
+
+// put adds or replaces an invite
+func (s *InviteStore) put(inv *Invite) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(invitesBucket).Put([]byte(inv.ID), data)
+	})
+}
+
+// signature calculates an HMAC of a token's payload
+func (s *InviteStore) signature(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "invite\n%s", payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestInviteToken gives the invite token presented with a request, from
+// an "invite" query param or cookie
+func requestInviteToken(r *http.Request) string {
+	if token := r.URL.Query().Get("invite"); token != "" {
+		return token
+	}
+	if c, err := r.Cookie(inviteCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// authenticateInvite checks the invite presented with r. Invites given as a
+// query param are stored in a cookie, so the rest of the upload page's
+// requests carry the invite too
+func authenticateInvite(w http.ResponseWriter, r *http.Request) (*Invite, error) {
+	token := requestInviteToken(r)
+	inv, err := invites.Verify(token)
+	if err != nil {
+		// clear a stale invite cookie, so the browser can sign in instead
+		http.SetCookie(w, &http.Cookie{Name: inviteCookie, Path: "/", MaxAge: -1})
+		return nil, err
+	}
+
+	if r.URL.Query().Get("invite") != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     inviteCookie,
+			Value:    token,
+			Path:     "/",
+			Expires:  inv.Expires,
+			HttpOnly: true,
+			Secure:   requestSecure(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return inv, nil
+}
+
+// inviteContextKey is the request context key for the invite a request
+// was made with
+type inviteContextKey struct{}
+
+// withInvite attaches an invite to a request's context, signing the request
+// in as a user limited to the invite's dir
+func withInvite(r *http.Request, inv *Invite) *http.Request {
+	r = withUser(r, &User{Username: inv.Username(), UploadDirs: []string{inv.Dir}})
+	return r.WithContext(context.WithValue(r.Context(), inviteContextKey{}, inv))
+}
+
+// requestInvite returns the invite a request was made with, if any
+func requestInvite(r *http.Request) *Invite {
+	inv, _ := r.Context().Value(inviteContextKey{}).(*Invite)
+	return inv
+}
+
+// useInvite counts files uploads against the invite r was made with, if
+// any. Handlers call it once the upload has been signed, so requests that
+// fail don't use up the invite, or for burner credentials just before
+// they're created, giving it back with releaseInvite if they aren't issued
+func useInvite(r *http.Request, files int) error {
+	if inv := requestInvite(r); inv != nil {
+		return invites.Use(inv.ID, files)
+	}
+	return nil
+}
+
+// releaseInvite gives back files counted by useInvite for uploads that
+// couldn't be issued after all
+func releaseInvite(r *http.Request, files int) {
+	if inv := requestInvite(r); inv != nil {
+		if err := invites.Release(inv.ID, files); err != nil {
+			fmt.Println("error releasing invite", err)
+		}
+	}
+}
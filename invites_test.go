@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInviteUse(t *testing.T) {
+	setupTest(t)
+	inv, err := invites.Create("docs", 3, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := invites.Use(inv.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := invites.Use(inv.ID, 2); err == nil {
+		t.Error("expected using more files than are left to be refused")
+	}
+	if err := invites.Use(inv.ID, 1); err != nil {
+		t.Errorf("unexpected error using the last file: %s", err)
+	}
+	if inv, _ = invites.Get(inv.ID); inv.Used != 3 {
+		t.Errorf("expected 3 files used, got %d", inv.Used)
+	}
+}
+
+func TestSignS3HandlerInviteUses(t *testing.T) {
+	ls := setupTest(t)
+	inv, err := invites.Create("docs", 1, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := invites.Token(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := middleware(SignS3Handler, ScopeSign)
+
+	sign := func(params url.Values) (int, map[string]interface{}) {
+		params.Set("invite", token)
+		params.Set("dir", "docs")
+		params.Set("object_name", "a.txt")
+		params.Set("object_size", "5")
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/token?"+params.Encode(), nil), nil)
+		res := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+	used := func() int {
+		inv, err := invites.Get(inv.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inv.Used
+	}
+
+	if status, _ := sign(url.Values{"md5": {"not a checksum"}}); status != http.StatusBadRequest {
+		t.Errorf("expected a bad checksum to be refused, got status %d", status)
+	}
+	if used() != 0 {
+		t.Errorf("expected a refused request not to use the invite, %d used", used())
+	}
+
+	status, res := sign(url.Values{})
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", status, res)
+	}
+	if used() != 1 {
+		t.Errorf("expected a signed upload to use the invite, %d used", used())
+	}
+	key, _ := res["key"].(string)
+
+	// someone else's file arrives at the signed path first
+	if err := ls.PutObject(key, strings.NewReader("another file"), nil); err != nil {
+		t.Fatal(err)
+	}
+	status, res = sign(url.Values{"replaces": {key}})
+	if status != http.StatusOK {
+		t.Fatalf("expected a replacement path, got status %d: %v", status, res)
+	}
+	if res["key"] == key {
+		t.Errorf("expected a new path, got %s again", key)
+	}
+	if used() != 1 {
+		t.Errorf("expected a replacement not to use the invite, %d used", used())
+	}
+	if rec, _ := registry.Get(key); rec.Status != ManifestReplaced {
+		t.Errorf("expected the earlier upload to be %s, got %s", ManifestReplaced, rec.Status)
+	}
+
+	if status, _ := sign(url.Values{"replaces": {key}}); status != http.StatusForbidden {
+		t.Errorf("expected an upload to only be replaced once, got status %d", status)
+	}
+}
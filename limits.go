@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// UploadLimits restricts the files that can be uploaded to a directory.
+// Limits are set per upload dir with the UPLOAD_LIMITS config key. Zero
+// values aren't limited
+type UploadLimits struct {
+	// MaxSize is the largest file allowed, in bytes
+	MaxSize int64 `json:"max_size,omitempty"`
+	// MimeTypes lists the allowed content types. types ending in "/*" allow
+	// every subtype, eg. "image/*"
+	MimeTypes []string `json:"mime_types,omitempty"`
+	// Extensions lists the allowed file name endings, eg. ".zip" or ".tar.gz"
+	Extensions []string `json:"extensions,omitempty"`
+}
+
+// dirUploadLimits gives the limits for uploads to dir, falling back to the
+// limits for "*". returns nil if uploads to dir aren't limited
+func dirUploadLimits(dir string) *UploadLimits {
+	if l, ok := cfg.UploadLimits[strings.Trim(dir, "/")]; ok {
+		return l
+	}
+	return cfg.UploadLimits["*"]
+}
+
+// keyUploadLimits gives the limits for an object at key, from the closest
+// dir above it with limits of its own. object names can have their own
+// subdirectories, so the key's dir isn't always the upload dir
+func keyUploadLimits(key string) *UploadLimits {
+	for dir := filepath.Dir(key); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if l, ok := cfg.UploadLimits[dir]; ok {
+			return l
+		}
+	}
+	return cfg.UploadLimits["*"]
+}
+
+// RequestUploadLimits checks the file described by the object_name,
+// object_size & mime_type request params is allowed in the dir it's being
+// uploaded to, returning the dir's limits. object_size & mime_type are
+// required when the dir limits them. returns nil limits if the dir
+// doesn't have any
+func RequestUploadLimits(r *http.Request) (*UploadLimits, error) {
+	limits := dirUploadLimits(r.FormValue("dir"))
+	if limits == nil {
+		return nil, nil
+	}
+
+	if limits.MaxSize > 0 {
+		size, err := strconv.ParseInt(r.FormValue("object_size"), 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("object_size must be given as the file's size in bytes")
+		}
+		if size > limits.MaxSize {
+			return nil, fmt.Errorf("files can be at most %s, this file is %s", humanBytes(limits.MaxSize), humanBytes(size))
+		}
+	}
+
+	if len(limits.MimeTypes) > 0 {
+		mimeType := r.FormValue("mime_type")
+		if mimeType == "" {
+			return nil, fmt.Errorf("mime_type must be given as the file's content type")
+		}
+		if !limits.allowsType(mimeType) {
+			return nil, fmt.Errorf("files of type '%s' aren't allowed, must be one of: %s", mimeType, strings.Join(limits.MimeTypes, ", "))
+		}
+	}
+
+	if len(limits.Extensions) > 0 {
+		// burner requests can name several files
+		names := r.Form["object_name"]
+		if len(names) == 0 {
+			names = []string{""}
+		}
+		for _, name := range names {
+			if !limits.allowsName(name) {
+				return nil, fmt.Errorf("file names must end in one of: %s", strings.Join(limits.Extensions, ", "))
+			}
+		}
+	}
+
+	return limits, nil
+}
+
+// allowsType checks a content type is one of the allowed types, ignoring
+// any parameters like charset
+func (l *UploadLimits) allowsType(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range l.MimeTypes {
+		allowed = strings.ToLower(allowed)
+		if t == allowed || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(t, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsName checks a file name ends in one of the allowed extensions
+func (l *UploadLimits) allowsName(name string) bool {
+	name = strings.ToLower(filepath.Base(name))
+	for _, ext := range l.Extensions {
+		if strings.HasSuffix(name, strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// localMetaDir holds a json sidecar of details for each stored object
+	localMetaDir = ".meta"
+	// localMultipartDir holds parts of in-progress multipart uploads
+	localMultipartDir = ".multipart"
+	// localTmpDir holds files while they're being written
+	localTmpDir = ".tmp"
+	// localMaxPutSize is the largest body a single PUT accepts, S3's limit
+	// for both whole objects & multipart upload parts
+	localMaxPutSize = 5 * 1024 * 1024 * 1024
+)
+
+// localInternalDirs are the dirs localStorage keeps to itself at the top of
+// its directory, which no key can be inside
+var localInternalDirs = []string{localMetaDir, localMultipartDir, localTmpDir}
+
+// localStorage is a Storage that writes uploads to a directory on disk.
+// Instead of presigned S3 urls it issues urls that point back at this server,
+// signed with an HMAC of the request details & an expiry. Those urls are
+// handled by LocalUploadHandler, so clients can't tell the difference.
+type localStorage struct {
+	dir    string
+	secret []byte
+	// publicUrlBase overrides the url objects are linked to
+	publicUrlBase string
+}
+
+// localObjectMeta is the sidecar file kept for each object
+type localObjectMeta struct {
+	ETag        string            `json:"etag"`
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// Private objects aren't served by LocalFileHandler
+	Private bool `json:"private,omitempty"`
+}
+
+// newLocalObjectMeta creates object details from put options
+func newLocalObjectMeta(opts *PutOptions) *localObjectMeta {
+	meta := &localObjectMeta{}
+	if opts != nil {
+		meta.ContentType = opts.ContentType
+		meta.Metadata = opts.Metadata
+		meta.Private = opts.Private
+	}
+	return meta
+}
+
+// newLocalStorage creates a localStorage rooted at dir, creating the directory
+// if necessary. If secret is empty a random one is generated, which means
+// any issued urls stop working when the server restarts
+func newLocalStorage(dir, secret, publicUrlBase string) (*localStorage, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("LOCAL_STORAGE_DIR env variable or config key must be set")
+	}
+
+	for _, d := range append([]string{""}, localInternalDirs...) {
+		if err := os.MkdirAll(filepath.Join(dir, d), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &localStorage{dir: dir, secret: []byte(secret), publicUrlBase: publicUrlBase}
+	if secret == "" {
+		s.secret = make([]byte, 32)
+		if _, err := rand.Read(s.secret); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// PresignPut signs object details into the url itself, so clients don't
+// need to send any extra headers
+func (s *localStorage) PresignPut(key string, opts *PutOptions, expires time.Duration) (string, http.Header, error) {
+	params := url.Values{}
+	if opts != nil {
+		if opts.NoOverwrite {
+			params.Set("ifNoneMatch", "*")
+		}
+		if opts.ContentType != "" {
+			params.Set("contentType", opts.ContentType)
+		}
+		if opts.ContentMD5 != "" {
+			params.Set("contentMD5", opts.ContentMD5)
+		}
+		if opts.ContentLength > 0 {
+			params.Set("contentLength", strconv.FormatInt(opts.ContentLength, 10))
+		}
+		for k, v := range opts.Metadata {
+			params.Set("meta-"+k, v)
+		}
+	}
+	return s.signURL(key, params, expires), http.Header{}, nil
+}
+
+func (s *localStorage) PresignPost(key string, opts *PutOptions, expires time.Duration) (*PostForm, error) {
+	return nil, fmt.Errorf("POST uploads are not supported with local storage")
+}
+
+func (s *localStorage) PutObject(key string, body io.ReadSeeker, opts *PutOptions) error {
+	_, err := s.Put(key, body, opts)
+	return err
+}
+
+func (s *localStorage) List(prefix string) ([]*Object, error) {
+	objects := make([]*Object, 0)
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		key, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+
+		// skip internal directories
+		if info.IsDir() {
+			if reservedKey(key) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		obj, err := s.object(key, info)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, obj)
+		return nil
+	})
+
+	return objects, err
+}
+
+// ListDir reads a single directory, continuing pages after the last key
+// listed, the same as the registry does
+func (s *localStorage) ListDir(prefix, after string, limit int) (*Listing, error) {
+	l := &Listing{Objects: make([]*Object, 0), Dirs: make([]string, 0)}
+	dir := s.dir
+	if prefix != "" {
+		path, err := s.path(strings.TrimSuffix(prefix, "/"))
+		if err != nil {
+			return nil, err
+		}
+		dir = path
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// subdirectories sort as their prefix, like they do on S3
+	keys := make(map[string]os.FileInfo, len(infos))
+	sorted := make([]string, 0, len(infos))
+	for _, info := range infos {
+		key := prefix + info.Name()
+		if info.IsDir() {
+			if reservedKey(key) {
+				continue
+			}
+			key += "/"
+		}
+		keys[key] = info
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	listed := ""
+	for _, key := range sorted {
+		if key <= after {
+			continue
+		}
+		if len(l.Objects)+len(l.Dirs) == limit {
+			l.Next = listed
+			break
+		}
+
+		if info := keys[key]; info.IsDir() {
+			l.Dirs = append(l.Dirs, key)
+		} else {
+			obj, err := s.object(key, info)
+			if err != nil {
+				return nil, err
+			}
+			l.Objects = append(l.Objects, obj)
+		}
+		listed = key
+	}
+	return l, nil
+}
+
+func (s *localStorage) Head(key string) (*Object, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return s.object(key, info)
+}
+
+func (s *localStorage) Get(key string) (io.ReadCloser, error) {
+	f, _, err := s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *localStorage) TempCredentials(name string, scope *CredentialScope, duration time.Duration) (*Credentials, error) {
+	return nil, fmt.Errorf("burner credentials are not supported with local storage")
+}
+
+func (s *localStorage) DenyCredentials(names []string) error {
+	return fmt.Errorf("burner credentials are not supported with local storage")
+}
+
+func (s *localStorage) ObjectURL(key string) string {
+	if s.publicUrlBase != "" {
+		return fmt.Sprintf("%s/%s", strings.TrimRight(s.publicUrlBase, "/"), escapeKey(key))
+	}
+	return "/files/" + escapeKey(key)
+}
+
+func (s *localStorage) CreateMultipartUpload(key string, opts *PutOptions) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadId := hex.EncodeToString(id)
+
+	dir := filepath.Join(s.dir, localMultipartDir, uploadId)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	meta := newLocalObjectMeta(opts)
+
+	// record the key & details this upload is for
+	data, err := json.Marshal(map[string]interface{}{
+		"key":  key,
+		"meta": meta,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return uploadId, ioutil.WriteFile(filepath.Join(dir, "upload.json"), data, 0644)
+}
+
+func (s *localStorage) PresignUploadPart(key, uploadId string, partNumber int64, contentMD5 string, expires time.Duration) (string, http.Header, error) {
+	params := url.Values{
+		"uploadId":   {uploadId},
+		"partNumber": {strconv.FormatInt(partNumber, 10)},
+	}
+	if contentMD5 != "" {
+		params.Set("contentMD5", contentMD5)
+	}
+	return s.signURL(key, params, expires), http.Header{}, nil
+}
+
+func (s *localStorage) ListParts(key, uploadId string) ([]*Part, error) {
+	dir, _, err := s.multipartUpload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]*Part, 0)
+	for _, info := range infos {
+		if filepath.Ext(info.Name()) != ".part" {
+			continue
+		}
+		num, err := strconv.ParseInt(strings.TrimSuffix(info.Name(), ".part"), 10, 64)
+		if err != nil {
+			continue
+		}
+		etag, err := fileETag(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &Part{PartNumber: num, ETag: etag, Size: info.Size()})
+	}
+
+	sort.Sort(partsByNumber(parts))
+	return parts, nil
+}
+
+func (s *localStorage) CompleteMultipartUpload(key, uploadId string, parts []*Part) error {
+	dir, meta, err := s.multipartUpload(key, uploadId)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, localTmpDir), "upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	w := io.MultiWriter(tmp, h)
+	for _, p := range parts {
+		partPath := filepath.Join(dir, fmt.Sprintf("%d.part", p.PartNumber))
+		etag, err := fileETag(partPath)
+		if err != nil {
+			tmp.Close()
+			if os.IsNotExist(err) {
+				return fmt.Errorf("part %d has not been uploaded", p.PartNumber)
+			}
+			return err
+		}
+		// like S3, accept etags with or without surrounding quotes
+		if strings.Trim(etag, `"`) != strings.Trim(p.ETag, `"`) {
+			tmp.Close()
+			return fmt.Errorf("part %d etag mismatch", p.PartNumber)
+		}
+
+		f, err := os.Open(partPath)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// completing an upload never replaces an existing object
+	meta.ETag = fmt.Sprintf(`"%x"`, h.Sum(nil))
+	if err := s.commit(key, tmp.Name(), meta, true); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func (s *localStorage) AbortMultipartUpload(key, uploadId string) error {
+	dir, _, err := s.multipartUpload(key, uploadId)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Put writes the contents of r to key, returning the object's ETag. it's
+// called by LocalUploadHandler once a signed url has been checked. If
+// opts.NoOverwrite is set & an object already exists at key Put returns
+// ErrExists. If opts.ContentMD5 is set & doesn't match the contents of r
+// Put returns ErrBadDigest
+func (s *localStorage) Put(key string, r io.Reader, opts *PutOptions) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+
+	tmpPath, etag, err := s.writeTmp(r)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+
+	if opts != nil && !digestMatches(etag, opts.ContentMD5) {
+		return "", ErrBadDigest
+	}
+
+	meta := newLocalObjectMeta(opts)
+	meta.ETag = etag
+	return etag, s.commit(key, tmpPath, meta, opts != nil && opts.NoOverwrite)
+}
+
+// PutPart writes the contents of r as a single part of a multipart upload,
+// returning the part ETag. If contentMD5 is set & doesn't match the contents
+// of r PutPart returns ErrBadDigest
+func (s *localStorage) PutPart(key, uploadId string, partNumber int64, r io.Reader, contentMD5 string) (string, error) {
+	dir, _, err := s.multipartUpload(key, uploadId)
+	if err != nil {
+		return "", err
+	}
+
+	tmpPath, etag, err := s.writeTmp(r)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+
+	if !digestMatches(etag, contentMD5) {
+		return "", ErrBadDigest
+	}
+
+	return etag, os.Rename(tmpPath, filepath.Join(dir, fmt.Sprintf("%d.part", partNumber)))
+}
+
+// Open opens the file stored at key for reading
+func (s *localStorage) Open(key string) (*os.File, *Object, error) {
+	obj, err := s.Head(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path, _ := s.path(key)
+	f, err := os.Open(path)
+	return f, obj, err
+}
+
+// CheckSignature confirms a url issued by signURL is valid & unexpired,
+// returning the signed parameters
+func (s *localStorage) CheckSignature(key string, query url.Values) (url.Values, error) {
+	params := url.Values{}
+	for k, v := range query {
+		if k != "signature" {
+			params[k] = v
+		}
+	}
+
+	expires, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expires")
+	}
+	if time.Now().Unix() > expires {
+		return nil, fmt.Errorf("request has expired")
+	}
+
+	expected := s.signature(key, params)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		return nil, fmt.Errorf("signature does not match")
+	}
+
+	return params, nil
+}
+
+// signURL creates a url to PUT to key that carries params, expiring after
+// the expires duration
+func (s *localStorage) signURL(key string, params url.Values, expires time.Duration) string {
+	q := url.Values{}
+	for k, v := range params {
+		q[k] = v
+	}
+	q.Set("expires", strconv.FormatInt(time.Now().Add(expires).Unix(), 10))
+	q.Set("signature", s.signature(key, q))
+
+	return "/files/" + escapeKey(key) + "?" + q.Encode()
+}
+
+// escapeKey escapes each segment of key for use in a url path, so keys with
+// characters like '#', '?' or '%' in them still link to the right file
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// signature calculates an HMAC of key & params. params are encoded sorted
+// by name, so the same params always give the same signature
+func (s *localStorage) signature(key string, params url.Values) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "PUT\n%s\n%s", key, params.Encode())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// path converts a key to a path on disk, refusing any key that would
+// escape the storage directory or touch internal files. Keys are checked
+// with checkKey, the same as when they're signed
+func (s *localStorage) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// multipartUpload checks an upload exists for key, returning the directory
+// parts are kept in & the object details recorded when the upload started
+func (s *localStorage) multipartUpload(key, uploadId string) (string, *localObjectMeta, error) {
+	if _, err := hex.DecodeString(uploadId); err != nil || uploadId == "" {
+		return "", nil, ErrNotFound
+	}
+
+	dir := filepath.Join(s.dir, localMultipartDir, uploadId)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "upload.json"))
+	if os.IsNotExist(err) {
+		return "", nil, ErrNotFound
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	upload := struct {
+		Key  string           `json:"key"`
+		Meta *localObjectMeta `json:"meta"`
+	}{}
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return "", nil, err
+	}
+	if upload.Key != key {
+		return "", nil, ErrNotFound
+	}
+
+	return dir, upload.Meta, nil
+}
+
+// writeTmp copies r to a temp file, returning the temp file path & ETag
+func (s *localStorage) writeTmp(r io.Reader) (string, string, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, localTmpDir), "upload")
+	if err != nil {
+		return "", "", err
+	}
+
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+
+	return tmp.Name(), fmt.Sprintf(`"%x"`, h.Sum(nil)), nil
+}
+
+// digestMatches checks a base64 Content-MD5 digest against an ETag from
+// writeTmp. An empty digest always matches
+func digestMatches(etag, contentMD5 string) bool {
+	if contentMD5 == "" {
+		return true
+	}
+	hex, err := md5Hex(contentMD5)
+	return err == nil && etag == `"`+hex+`"`
+}
+
+// commit moves a fully-written temp file into place at key, along with
+// its metadata sidecar. With noOverwrite set, commit returns ErrExists
+// instead of replacing an existing file
+func (s *localStorage) commit(key, tmpPath string, meta *localObjectMeta, noOverwrite bool) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	metaPath := filepath.Join(s.dir, localMetaDir, filepath.FromSlash(key)+".json")
+	for _, p := range []string{path, metaPath} {
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	if noOverwrite {
+		// linking fails if the file exists, unlike renaming
+		if err := os.Link(tmpPath, path); err != nil {
+			if os.IsExist(err) {
+				return ErrExists
+			}
+			return err
+		}
+	} else if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metaPath, data, 0644)
+}
+
+// object builds an Object from file info & the object's sidecar, if any
+func (s *localStorage) object(key string, info os.FileInfo) (*Object, error) {
+	meta, err := s.meta(key)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &Object{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ETag:         meta.ETag,
+		ContentType:  meta.ContentType,
+		Metadata:     meta.Metadata,
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = mime.TypeByExtension(filepath.Ext(key))
+	}
+
+	return obj, nil
+}
+
+// meta reads the sidecar for key. objects without a sidecar (ones that were
+// copied into the storage directory by hand) get empty details
+func (s *localStorage) meta(key string) (*localObjectMeta, error) {
+	meta := &localObjectMeta{}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, localMetaDir, filepath.FromSlash(key)+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, nil
+		}
+		return nil, err
+	}
+
+	return meta, json.Unmarshal(data, meta)
+}
+
+// fileETag calculates the quoted md5 hex digest of a file, same as S3
+// would for a single-part upload
+func fileETag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)), nil
+}
+
+// partsByNumber sorts parts by part number
+type partsByNumber []*Part
+
+func (p partsByNumber) Len() int           { return len(p) }
+func (p partsByNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p partsByNumber) Less(i, j int) bool { return p[i].PartNumber < p[j].PartNumber }
+
+// LocalUploadHandler accepts PUT requests to urls issued by localStorage,
+// writing either a whole object or a single multipart upload part
+func LocalUploadHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	addCorsHeaders(w, r)
+
+	ls, ok := store.(*localStorage)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := strings.TrimPrefix(p.ByName("key"), "/")
+	params, err := ls.CheckSignature(key, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if r.ContentLength > localMaxPutSize {
+		http.Error(w, "upload is larger than a single request can send", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, localMaxPutSize)
+
+	var etag string
+	if uploadId := params.Get("uploadId"); uploadId != "" {
+		partNumber, perr := strconv.ParseInt(params.Get("partNumber"), 10, 64)
+		if perr != nil {
+			http.Error(w, "invalid partNumber", http.StatusBadRequest)
+			return
+		}
+		contentMD5 := params.Get("contentMD5")
+		if contentMD5 == "" {
+			contentMD5 = r.Header.Get("Content-MD5")
+		}
+		etag, err = ls.PutPart(key, uploadId, partNumber, r.Body, contentMD5)
+	} else {
+		if length := params.Get("contentLength"); length != "" && strconv.FormatInt(r.ContentLength, 10) != length {
+			http.Error(w, fmt.Sprintf("upload must be exactly %s bytes", length), http.StatusBadRequest)
+			return
+		}
+
+		opts := &PutOptions{
+			ContentType: params.Get("contentType"),
+			NoOverwrite: params.Get("ifNoneMatch") == "*",
+			Metadata:    map[string]string{},
+			ContentMD5:  params.Get("contentMD5"),
+		}
+		if opts.ContentMD5 == "" {
+			opts.ContentMD5 = r.Header.Get("Content-MD5")
+		}
+		if opts.ContentType == "" {
+			opts.ContentType = r.Header.Get("Content-Type")
+		}
+		for k := range params {
+			if strings.HasPrefix(k, "meta-") {
+				opts.Metadata[strings.TrimPrefix(k, "meta-")] = params.Get(k)
+			}
+		}
+		etag, err = ls.Put(key, r.Body, opts)
+	}
+
+	if err != nil {
+		fmt.Println("error writing upload", err)
+		if err == ErrNotFound {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		} else if err == ErrExists {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		} else if err == ErrBadDigest {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if _, ok := err.(*http.MaxBytesError); ok {
+			http.Error(w, "upload is larger than a single request can send", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// LocalFileHandler serves files stored by localStorage, other than
+// private ones
+func LocalFileHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	ls, ok := store.(*localStorage)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := strings.TrimPrefix(p.ByName("key"), "/")
+	f, obj, err := ls.Open(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	if meta, err := ls.meta(key); err != nil || meta.Private {
+		http.NotFound(w, r)
+		return
+	}
+
+	// files are served from the server's own origin, where an uploaded html
+	// page could run scripts with the visitor's session. they're always
+	// downloaded, never rendered
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(obj.Key)}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if obj.ContentType != "" {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+	if obj.ETag != "" {
+		w.Header().Set("ETag", obj.ETag)
+	}
+	http.ServeContent(w, r, filepath.Base(obj.Key), obj.LastModified, f)
+}
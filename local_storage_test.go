@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func newTestLocalStorage(t *testing.T) *localStorage {
+	ls, err := newLocalStorage(t.TempDir(), "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ls
+}
+
+func base64MD5(body string) string {
+	sum := md5.Sum([]byte(body))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestLocalPutPartChecksDigest(t *testing.T) {
+	ls := newTestLocalStorage(t)
+	uploadId, err := ls.CreateMultipartUpload("docs/a.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ls.PutPart("docs/a.bin", uploadId, 1, strings.NewReader("part one"), base64MD5("something else")); err != ErrBadDigest {
+		t.Errorf("expected ErrBadDigest for a mismatched part, got %v", err)
+	}
+	if _, err := ls.PutPart("docs/a.bin", uploadId, 1, strings.NewReader("part one"), base64MD5("part one")); err != nil {
+		t.Errorf("unexpected error for a matching part: %s", err)
+	}
+	if _, err := ls.PutPart("docs/a.bin", uploadId, 2, strings.NewReader("part two"), ""); err != nil {
+		t.Errorf("unexpected error for a part without a digest: %s", err)
+	}
+
+	parts, err := ls.ListParts("docs/a.bin", uploadId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 {
+		t.Errorf("expected the rejected part not to be stored, got %d parts", len(parts))
+	}
+}
+
+func TestLocalUploadHandlerParts(t *testing.T) {
+	ls := newTestLocalStorage(t)
+	cfg = &config{}
+	store = ls
+	uploadId, err := ls.CreateMultipartUpload("docs/a.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, _, err := ls.PresignUploadPart("docs/a.bin", uploadId, 1, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a part signed with its checksum is checked without the header
+	signedMD5, _, err := ls.PresignUploadPart("docs/a.bin", uploadId, 1, base64MD5("part one"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		description   string
+		signed        string
+		body          string
+		contentMD5    string
+		contentLength int64
+		status        int
+	}{
+		{"matching checksum", signed, "part one", base64MD5("part one"), 0, http.StatusOK},
+		{"mismatched checksum", signed, "part one", base64MD5("part two"), 0, http.StatusBadRequest},
+		{"declared too large", signed, "part one", "", localMaxPutSize + 1, http.StatusRequestEntityTooLarge},
+		{"matching signed checksum", signedMD5, "part one", "", 0, http.StatusOK},
+		{"mismatched signed checksum", signedMD5, "part two", "", 0, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("PUT", c.signed, strings.NewReader(c.body))
+		if c.contentMD5 != "" {
+			req.Header.Set("Content-MD5", c.contentMD5)
+		}
+		if c.contentLength != 0 {
+			req.ContentLength = c.contentLength
+		}
+		w := httptest.NewRecorder()
+		LocalUploadHandler(w, req, httprouter.Params{{Key: "key", Value: "/docs/a.bin"}})
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d: %s", c.description, c.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+// localFilesRouter routes to the local storage handlers the way the server does
+func localFilesRouter() *httprouter.Router {
+	r := httprouter.New()
+	r.PUT("/files/*key", LocalUploadHandler)
+	r.GET("/files/*key", LocalFileHandler)
+	return r
+}
+
+func TestLocalUploadEscapesKeys(t *testing.T) {
+	ls := newTestLocalStorage(t)
+	cfg = &config{}
+	store = ls
+	router := localFilesRouter()
+
+	for _, key := range []string{"docs/a b.txt", "docs/#1?.txt", "docs/100%.txt", "docs/..data"} {
+		signed, _, err := ls.PresignPut(key, nil, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("PUT", signed, strings.NewReader("hello")))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected the signed url to be accepted, got %d: %s", key, w.Code, w.Body.String())
+			continue
+		}
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", ls.ObjectURL(key), nil))
+		if w.Code != http.StatusOK || w.Body.String() != "hello" {
+			t.Errorf("%s: expected the object url to serve the file, got %d: %s", key, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestLocalFileHandlerHeaders(t *testing.T) {
+	ls := newTestLocalStorage(t)
+	cfg = &config{}
+	store = ls
+	if err := ls.PutObject("docs/page.html", strings.NewReader("<script>alert(1)</script>"), &PutOptions{ContentType: "text/html"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	localFilesRouter().ServeHTTP(w, httptest.NewRequest("GET", "/files/docs/page.html", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	expect := map[string]string{
+		"Content-Disposition":     `attachment; filename=page.html`,
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+	}
+	for k, v := range expect {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("expected %s: %s, got %q", k, v, got)
+		}
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	cases := []struct {
+		key string
+		ok  bool
+	}{
+		{"docs/a.txt", true},
+		{"docs/.hidden/a.txt", true},
+		{".env", true},
+		{"", false},
+		{"/docs/a.txt", false},
+		{"docs//a.txt", false},
+		{"docs/../a.txt", false},
+		{".meta/docs/a.txt.json", false},
+		{".tmp", false},
+	}
+	for _, c := range cases {
+		if err := checkKey(c.key); (err == nil) != c.ok {
+			t.Errorf("%q: expected ok %t, got %v", c.key, c.ok, err)
+		}
+	}
+
+	// paths are refused when they're signed, not when they're uploaded
+	ls := newTestLocalStorage(t)
+	cfg = &config{}
+	store = ls
+	for _, c := range cases {
+		if c.key == "" {
+			continue
+		}
+		_, signErr := requestPath(httptest.NewRequest("GET", "/token", nil), c.key)
+		_, storeErr := ls.path(filepath.ToSlash(filepath.Clean(c.key)))
+		if signErr == nil && storeErr != nil {
+			t.Errorf("%q: signed, but storage refuses it: %s", c.key, storeErr)
+		}
+	}
+}
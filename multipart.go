@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxUploadParts is the largest number of parts S3 will accept for a single
+// multipart upload
+const maxUploadParts = 10000
+
+// MultipartStartHandler begins a multipart upload at an empty path, returning
+// the upload id & key the client should use for all subsequent multipart requests.
+// The request should provide object_name (the filename) & optionally dir,
+// mime_type, provenance fields & the whole file's md5 & sha256 checksums as
+// query parameters, same as SignS3Handler. Checksums are recorded in the
+// upload's metadata & manifest
+func MultipartStartHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// response will be json, allocate an encoder that operates
+	// on the http writer
+	enc := json.NewEncoder(w)
+
+	if !limitRate(w, r) {
+		return
+	}
+
+	// check the file is allowed before using up any of an invite
+	if _, err := RequestUploadLimits(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	if _, err := requestQuotaSize(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Generate the path for this request
+	path, err := RequestPath(r)
+	if err != nil {
+		writePathError(w, enc, err)
+		return
+	}
+
+	provenance, err := RequestProvenance(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	contentMD5, err := RequestContentMD5(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	sha256, err := RequestSHA256(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Get an empty path, reserving it for long enough to upload a very large file
+	path, err = GetEmptyPath(store, path, 24*time.Hour)
+	if err != nil {
+		fmt.Println("error generating filepath", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// storage can only check each part's checksum, so the whole file's are
+	// recorded, for checking once it's assembled where storage allows
+	manifest := NewManifest(r, path, "multipart", provenance)
+	opts := &PutOptions{
+		ContentType: r.FormValue("mime_type"),
+		Metadata:    provenance.Metadata(),
+	}
+	if contentMD5 != "" {
+		manifest.MD5, _ = md5Hex(contentMD5)
+		opts.Metadata["md5"] = manifest.MD5
+	}
+	if sha256 != "" {
+		manifest.SHA256 = sha256
+		opts.Metadata["sha256"] = sha256
+	}
+
+	uploadId, err := store.CreateMultipartUpload(path, opts)
+	if err != nil {
+		fmt.Println("error creating multipart upload", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// only uploads that were started count against daily quotas & an invite
+	if !chargeQuotas(w, r) {
+		if err := store.AbortMultipartUpload(path, uploadId); err != nil {
+			fmt.Println("error aborting multipart upload", err)
+		}
+		return
+	}
+	if err := useInvite(r, 1); err != nil {
+		if aerr := store.AbortMultipartUpload(path, uploadId); aerr != nil {
+			fmt.Println("error aborting multipart upload", aerr)
+		}
+		w.WriteHeader(http.StatusForbidden)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := RecordUpload(NewRecord(r, manifest)); err != nil {
+		fmt.Println("error recording upload", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	enc.Encode(map[string]string{
+		"uploadId": uploadId,
+		"key":      path,
+		"url":      store.ObjectURL(path),
+	})
+}
+
+// MultipartSignPartHandler presigns a single UploadPart request. The request
+// must provide key, uploadId & partNumber query params. An md5 param with the
+// part's base64 md5 digest is signed in as a Content-MD5 header, so a
+// corrupted part will be rejected. Clients must send every header listed in
+// the response's "headers" field
+func MultipartSignPartHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	key, uploadId, err := multipartRequestUpload(r, r.FormValue("key"), r.FormValue("uploadId"))
+	if err != nil {
+		writePathError(w, enc, err)
+		return
+	}
+
+	partNumber, err := strconv.ParseInt(r.FormValue("partNumber"), 10, 64)
+	if err != nil || partNumber < 1 || partNumber > maxUploadParts {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("partNumber must be a number between 1 and %d", maxUploadParts),
+		})
+		return
+	}
+
+	contentMD5, err := RequestContentMD5(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// The part must be submitted within 15 minutes of being issued. clients
+	// ask for each part as they go, so this only has to cover a single part
+	url, headers, err := store.PresignUploadPart(key, uploadId, partNumber, contentMD5, 15*time.Minute)
+	if err != nil {
+		fmt.Println("error presigning part request", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	sendHeaders := map[string]string{}
+	for k := range headers {
+		sendHeaders[k] = headers.Get(k)
+	}
+	enc.Encode(map[string]interface{}{
+		"signedRequest": url,
+		"headers":       sendHeaders,
+	})
+}
+
+// MultipartListPartsHandler lists the parts S3 has already received for an
+// upload, so clients can resume an interrupted upload by skipping them.
+// The request must provide key & uploadId params. Uploads that have been
+// completed, aborted, or never existed respond with a 404.
+func MultipartListPartsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	key, uploadId, err := multipartRequestUpload(r, r.FormValue("key"), r.FormValue("uploadId"))
+	if err != nil {
+		writePathError(w, enc, err)
+		return
+	}
+
+	parts, err := store.ListParts(key, uploadId)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf("upload %s not found", uploadId),
+			})
+			return
+		}
+		fmt.Println("error listing multipart upload parts", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := enc.Encode(parts); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// multipartCompleteRequest is the JSON body accepted by MultipartCompleteHandler
+type multipartCompleteRequest struct {
+	Key      string  `json:"key"`
+	UploadId string  `json:"uploadId"`
+	Parts    []*Part `json:"parts"`
+}
+
+// MultipartCompleteHandler assembles uploaded parts into the final object.
+// The request body should be JSON of the form:
+// {"key" : "dir/file.zip", "uploadId" : "...", "parts" : [{ "partNumber" : 1, "etag" : "..." }]}
+func MultipartCompleteHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	body := &multipartCompleteRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("error parsing request body: %s", err.Error()),
+		})
+		return
+	}
+
+	key, uploadId, err := multipartRequestUpload(r, body.Key, body.UploadId)
+	if err != nil {
+		writePathError(w, enc, err)
+		return
+	}
+
+	if len(body.Parts) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": "at least one part is required to complete an upload",
+		})
+		return
+	}
+
+	// parts are uploaded straight to storage, so the declared size checked
+	// at the start is all that's known about them until now. an upload can't
+	// be bigger than its dir's max_size, or than the size it declared, which
+	// is what was charged against quotas
+	maxSize, tooBig := int64(0), ""
+	if limits := keyUploadLimits(key); limits != nil && limits.MaxSize > 0 {
+		maxSize, tooBig = limits.MaxSize, "files can be at most %s, this file is %s"
+	}
+	if rec, err := registry.Get(key); err == nil && rec.Manifest != nil && rec.Size > 0 && (maxSize == 0 || rec.Size < maxSize) {
+		maxSize, tooBig = rec.Size, "this file was declared as %s, but its parts add up to %s"
+	}
+	if maxSize > 0 {
+		size, err := multipartUploadSize(key, uploadId, body.Parts)
+		if err != nil {
+			if err == ErrNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				enc.Encode(map[string]string{
+					"error": fmt.Sprintf("upload %s not found", uploadId),
+				})
+				return
+			}
+			fmt.Println("error listing multipart upload parts", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+		if size > maxSize {
+			if err := store.AbortMultipartUpload(key, uploadId); err != nil {
+				fmt.Println("error aborting multipart upload", err)
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf(tooBig, humanBytes(maxSize), humanBytes(size)),
+			})
+			return
+		}
+	}
+
+	if err := store.CompleteMultipartUpload(key, uploadId, body.Parts); err != nil {
+		if err == ErrExists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			enc.Encode(map[string]string{
+				"error": fmt.Sprintf("a file already exists at %s", key),
+			})
+			return
+		}
+		fmt.Println("error completing multipart upload", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// the upload is assembled server-side, so it can be confirmed right away.
+	// uploads started before manifests were written have nothing to check
+	if m, err := ConfirmUpload(store, key); err != nil && err != ErrNotFound {
+		fmt.Println("error confirming upload", err)
+	} else if m != nil && m.Status == ManifestMismatch {
+		writeUploadMismatch(w, enc, m)
+		return
+	}
+
+	enc.Encode(map[string]string{
+		"url": store.ObjectURL(key),
+	})
+}
+
+// multipartUploadSize adds up the sizes storage has for the parts that will
+// make up a completed upload
+func multipartUploadSize(key, uploadId string, parts []*Part) (int64, error) {
+	uploaded, err := store.ListParts(key, uploadId)
+	if err != nil {
+		return 0, err
+	}
+
+	sizes := make(map[int64]int64, len(uploaded))
+	for _, p := range uploaded {
+		sizes[p.PartNumber] = p.Size
+	}
+	var size int64
+	for _, p := range parts {
+		size += sizes[p.PartNumber]
+	}
+	return size, nil
+}
+
+// MultipartAbortHandler cancels a multipart upload, discarding any uploaded parts.
+// The request must provide key & uploadId params.
+func MultipartAbortHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enc := json.NewEncoder(w)
+
+	key, uploadId, err := multipartRequestUpload(r, r.FormValue("key"), r.FormValue("uploadId"))
+	if err != nil {
+		writePathError(w, enc, err)
+		return
+	}
+
+	if err := store.AbortMultipartUpload(key, uploadId); err != nil {
+		fmt.Println("error aborting multipart upload", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	enc.Encode(map[string]string{
+		"status": "aborted",
+	})
+}
+
+// multipartRequestUpload checks a client-supplied key & upload id, making sure
+// the key falls within a directory RequestPath would have allowed for r, and
+// that the upload was started by r's user, so no one else can finish or
+// abort it
+func multipartRequestUpload(r *http.Request, key, uploadId string) (string, string, error) {
+	if key == "" || uploadId == "" {
+		return "", "", &PathError{http.StatusBadRequest, "key and uploadId are required"}
+	}
+
+	key, err := requestKey(r, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	rec, err := registry.Get(key)
+	if err == ErrNotFound {
+		return "", "", &PathError{http.StatusNotFound, fmt.Sprintf("upload %s not found", uploadId)}
+	} else if err != nil {
+		return "", "", err
+	}
+	if !requestedBy(rec, r) {
+		return "", "", &PathError{http.StatusForbidden, fmt.Sprintf("upload %s was started by someone else", uploadId)}
+	}
+	return key, uploadId, nil
+}
+
+// requestKey checks a client-supplied object key falls within a directory
+// RequestPath would have allowed for r, refusing it with a *PathError if not
+func requestKey(r *http.Request, key string) (string, error) {
+	if key == "" {
+		return "", &PathError{http.StatusBadRequest, "key is required"}
+	}
+
+	// names like "..data" are fine, only a ".." segment climbs out
+	if key != filepath.Clean(key) || strings.HasPrefix(key, "/") || key == ".." || strings.HasPrefix(key, "../") {
+		return "", &PathError{http.StatusBadRequest, fmt.Sprintf("invalid key: '%s'", key)}
+	}
+
+	// without upload dirs RequestPath allows keys anywhere
+	dirs := allowedUploadDirs(r)
+	if len(dirs) == 0 {
+		return key, nil
+	}
+
+	// object names can have their own subdirectories, like files uploaded
+	// from a directory tree, so any dir above the key can be the upload dir
+	for dir := filepath.Dir(key); ; dir = filepath.Dir(dir) {
+		if dir == "." {
+			dir = ""
+		}
+		if isAllowedDir(dirs, dir) {
+			return key, nil
+		}
+		if dir == "" {
+			break
+		}
+	}
+	return "", &PathError{http.StatusForbidden, fmt.Sprintf("invalid directory for uploading: '%s'", filepath.Dir(key))}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMultipartCompleteChecksMaxSize(t *testing.T) {
+	cases := []struct {
+		description string
+		parts       []string
+		status      int
+	}{
+		{"within max_size", []string{"0123456789", "01234"}, http.StatusOK},
+		{"over max_size", []string{"0123456789", "0123456789"}, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		ls := setupTest(t)
+		cfg.UploadLimits = map[string]*UploadLimits{"*": {MaxSize: 16}}
+
+		uploadId, err := ls.CreateMultipartUpload("docs/a.bin", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/multipart/start?object_name=a.bin", nil)
+		if err := RecordUpload(NewRecord(r, NewManifest(r, "docs/a.bin", "multipart", nil))); err != nil {
+			t.Fatal(err)
+		}
+		parts := make([]*Part, len(c.parts))
+		for i, body := range c.parts {
+			etag, err := ls.PutPart("docs/a.bin", uploadId, int64(i+1), strings.NewReader(body), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts[i] = &Part{PartNumber: int64(i + 1), ETag: etag}
+		}
+
+		data, _ := json.Marshal(&multipartCompleteRequest{Key: "docs/a.bin", UploadId: uploadId, Parts: parts})
+		w := httptest.NewRecorder()
+		MultipartCompleteHandler(w, httptest.NewRequest("POST", "/multipart/complete", strings.NewReader(string(data))), nil)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d: %s", c.description, c.status, w.Code, w.Body.String())
+		}
+
+		_, err = ls.Head("docs/a.bin")
+		if c.status == http.StatusOK && err != nil {
+			t.Errorf("%s: expected the upload to be completed, got %v", c.description, err)
+		} else if c.status != http.StatusOK {
+			if err != ErrNotFound {
+				t.Errorf("%s: expected no file to be completed, got %v", c.description, err)
+			}
+			if _, err := ls.ListParts("docs/a.bin", uploadId); err != ErrNotFound {
+				t.Errorf("%s: expected the upload to be aborted, got %v", c.description, err)
+			}
+		}
+	}
+}
+
+func TestMultipartCompleteChecksDeclaredSize(t *testing.T) {
+	ls := setupTest(t)
+	uploadId, err := ls.CreateMultipartUpload("docs/a.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/multipart/start?object_name=a.bin&object_size=10", nil)
+	if err := RecordUpload(NewRecord(r, NewManifest(r, "docs/a.bin", "multipart", nil))); err != nil {
+		t.Fatal(err)
+	}
+	etag, err := ls.PutPart("docs/a.bin", uploadId, 1, strings.NewReader("more than ten bytes"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := json.Marshal(&multipartCompleteRequest{Key: "docs/a.bin", UploadId: uploadId, Parts: []*Part{{PartNumber: 1, ETag: etag}}})
+	w := httptest.NewRecorder()
+	MultipartCompleteHandler(w, httptest.NewRequest("POST", "/multipart/complete", strings.NewReader(string(data))), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an upload bigger than declared to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := ls.Head("docs/a.bin"); err != ErrNotFound {
+		t.Errorf("expected no file to be completed, got %v", err)
+	}
+}
+
+func TestMultipartRequestUploadChecksRequester(t *testing.T) {
+	setupTest(t)
+	start := httptest.NewRequest("GET", "/multipart/start?object_name=a.bin", nil)
+	start.RemoteAddr = "192.0.2.1:1234"
+	if err := RecordUpload(NewRecord(start, NewManifest(start, "docs/a.bin", "multipart", nil))); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		description string
+		key, addr   string
+		status      int
+	}{
+		{"same requester", "docs/a.bin", "192.0.2.1:5678", 0},
+		{"someone else", "docs/a.bin", "192.0.2.2:1234", http.StatusForbidden},
+		{"no upload", "docs/b.bin", "192.0.2.1:1234", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/multipart/abort", nil)
+		r.RemoteAddr = c.addr
+		_, _, err := multipartRequestUpload(r, c.key, "upload-1")
+		if e, ok := err.(*PathError); (c.status == 0 && err != nil) || (c.status != 0 && (!ok || e.Status != c.status)) {
+			t.Errorf("%s: expected status %d, got %v", c.description, c.status, err)
+		}
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	setupTest(t)
+	cfg.UploadDirs = []string{"docs"}
+
+	cases := []struct {
+		key    string
+		status int
+	}{
+		{"docs/a.bin", 0},
+		{"docs/..data", 0},
+		{"docs/2017/a.bin", 0},
+		{"", http.StatusBadRequest},
+		{"/docs/a.bin", http.StatusBadRequest},
+		{"../docs/a.bin", http.StatusBadRequest},
+		{"docs/../other/a.bin", http.StatusBadRequest},
+		{"other/a.bin", http.StatusForbidden},
+		{"..data/a.bin", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		_, err := requestKey(httptest.NewRequest("GET", "/complete", nil), c.key)
+		if e, ok := err.(*PathError); (c.status == 0 && err != nil) || (c.status != 0 && (!ok || e.Status != c.status)) {
+			t.Errorf("%q: expected status %d, got %v", c.key, c.status, err)
+		}
+	}
+}
+
+func TestMultipartChecksums(t *testing.T) {
+	ls := setupTest(t)
+	whole := sha256.Sum256([]byte("part one"))
+
+	cases := []struct {
+		description string
+		md5         string
+		status      int
+	}{
+		{"matching checksum", base64MD5("part one"), http.StatusOK},
+		{"mismatched checksum", base64MD5("something else"), http.StatusConflict},
+	}
+	for i, c := range cases {
+		name := fmt.Sprintf("a%d.bin", i)
+		params := url.Values{"object_name": {name}, "md5": {c.md5}, "sha256": {hex.EncodeToString(whole[:])}}
+		w := httptest.NewRecorder()
+		MultipartStartHandler(w, httptest.NewRequest("GET", "/multipart/start?"+params.Encode(), nil), nil)
+		started := map[string]string{}
+		json.Unmarshal(w.Body.Bytes(), &started)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200 starting, got %d: %s", c.description, w.Code, w.Body.String())
+		}
+		rec, err := registry.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md5, _ := md5Hex(c.md5); rec.MD5 != md5 || rec.SHA256 != hex.EncodeToString(whole[:]) {
+			t.Errorf("%s: expected the whole file's checksums to be recorded, got md5 %s & sha256 %s", c.description, rec.MD5, rec.SHA256)
+		}
+
+		// each part's checksum is signed into its upload
+		params = url.Values{"key": {name}, "uploadId": {started["uploadId"]}, "partNumber": {"1"}, "md5": {base64MD5("part one")}}
+		w = httptest.NewRecorder()
+		MultipartSignPartHandler(w, httptest.NewRequest("GET", "/multipart/sign?"+params.Encode(), nil), nil)
+		signed := struct {
+			SignedRequest string `json:"signedRequest"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &signed)
+		if !strings.Contains(signed.SignedRequest, "contentMD5=") {
+			t.Errorf("%s: expected the part's checksum to be signed in, got %s", c.description, signed.SignedRequest)
+		}
+
+		etag, err := ls.PutPart(name, started["uploadId"], 1, strings.NewReader("part one"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(&multipartCompleteRequest{Key: name, UploadId: started["uploadId"], Parts: []*Part{{PartNumber: 1, ETag: etag}}})
+		w = httptest.NewRecorder()
+		MultipartCompleteHandler(w, httptest.NewRequest("POST", "/multipart/complete", strings.NewReader(string(data))), nil)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d completing, got %d: %s", c.description, c.status, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	MultipartSignPartHandler(w, httptest.NewRequest("GET", "/multipart/sign?key=a0.bin&uploadId=x&partNumber=1&md5=nope", nil), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad part checksum to be refused, got status %d", w.Code)
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// oidcStateCookie holds the details of a login in progress
+const oidcStateCookie = "oidc_state"
+
+// oidcUserPrefix starts the name of every user signed in with the identity
+// provider, keeping them apart from user accounts & api keys
+const oidcUserPrefix = "oidc:"
+
+// oidcLoginTimeout is how long a user has to sign in with the identity
+// provider once a login has started
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidc is the identity provider users sign in with, nil unless OIDC_ISSUER
+// is configured
+var oidc *oidcProvider
+
+// OIDCRule decides which users signing in with the identity provider are
+// allowed in, and where they can upload. A rule matches users with an
+// email address at EmailDomain, or whose Claim is Value (or is a list
+// containing Value). Set one of EmailDomain or Claim
+type OIDCRule struct {
+	EmailDomain string `json:"email_domain,omitempty"`
+	Claim       string `json:"claim,omitempty"`
+	Value       string `json:"value,omitempty"`
+	// UploadDirs are the dirs matching users can upload to. If no matching
+	// rule lists any the server's UPLOAD_DIRS apply
+	UploadDirs []string `json:"upload_dirs,omitempty"`
+}
+
+// match checks if a user's id token claims satisfy the rule
+func (rule *OIDCRule) match(claims map[string]interface{}) bool {
+	if rule.EmailDomain != "" {
+		email := claimString(claims, "email")
+		if email == "" || !emailVerified(claims) {
+			return false
+		}
+		i := strings.LastIndex(email, "@")
+		return i >= 0 && strings.EqualFold(email[i+1:], strings.TrimPrefix(rule.EmailDomain, "@"))
+	}
+
+	if rule.Claim == "" {
+		return false
+	}
+	switch v := claims[rule.Claim].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if fmt.Sprint(item) == rule.Value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(v) == rule.Value
+	}
+}
+
+// oidcDiscovery is the part of an identity provider's discovery document
+// the login flow needs
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is a login in progress, kept in a signed cookie between
+// sending the user to the identity provider & them coming back
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+// oidcProvider signs users in with an OpenID Connect identity provider
+// using the authorization code flow. The provider's endpoints & keys are
+// discovered from the issuer the first time they're needed
+type oidcProvider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectUrl  string
+	scopes       []string
+	rules        []*OIDCRule
+	client       *http.Client
+
+	sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// newOIDCProvider creates a provider from cfg, returning nil if OIDC
+// isn't configured
+func newOIDCProvider(cfg *config) *oidcProvider {
+	if cfg.OidcIssuer == "" {
+		return nil
+	}
+
+	scopes := cfg.OidcScopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(cfg.OidcIssuer, "/"),
+		clientId:     cfg.OidcClientId,
+		clientSecret: cfg.OidcClientSecret,
+		redirectUrl:  cfg.OidcRedirectUrl,
+		scopes:       scopes,
+		rules:        cfg.OidcRules,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// LoginHandler starts signing in with the identity provider. An optional
+// "return" param gives the path to go back to once signed in
+func LoginHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// poor man's logging:
+	fmt.Println(r.Method, r.URL.Path, time.Now())
+
+	if oidc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		renderTemplate(w, "notFound.html")
+		return
+	}
+
+	d, err := oidc.discover()
+	if err != nil {
+		fmt.Println("oidc discovery error:", err)
+		http.Error(w, "error contacting identity provider", http.StatusBadGateway)
+		return
+	}
+
+	login := &oidcLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Return:   safeReturnPath(r.FormValue("return")),
+		Expires:  time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+	value, err := sessions.Encode(oidcStateCookie, login)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   requestSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.clientId},
+		"redirect_uri":          {oidc.redirectURL(r)},
+		"scope":                 {strings.Join(oidc.scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// OIDCCallbackHandler finishes signing in, exchanging the code the identity
+// provider sent the user back with for an id token & starting a session
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// poor man's logging:
+	fmt.Println(r.Method, r.URL.Path, time.Now())
+
+	if oidc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		renderTemplate(w, "notFound.html")
+		return
+	}
+
+	user, login, err := oidc.finishLogin(r)
+	// the login cookie is single-use, whatever happened
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+	if err != nil {
+		denyAccess(w, err)
+		return
+	}
+
+	if err := startSession(w, r, user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Println("signed in with identity provider:", user.Username)
+	http.Redirect(w, r, login.Return, http.StatusFound)
+}
+
+// LogoutHandler ends the user's session
+func LogoutHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	endSession(w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// finishLogin checks the identity provider's response to a login, returning
+// the signed in user
+func (p *oidcProvider) finishLogin(r *http.Request) (*User, *oidcLogin, error) {
+	if e := r.FormValue("error"); e != "" {
+		return nil, nil, fmt.Errorf("identity provider refused login: %s %s", e, r.FormValue("error_description"))
+	}
+
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no login in progress")
+	}
+	login := &oidcLogin{}
+	if err := sessions.Decode(oidcStateCookie, c.Value, login); err != nil {
+		return nil, nil, err
+	}
+	if time.Now().Unix() > login.Expires {
+		return nil, nil, fmt.Errorf("login timed out")
+	}
+	if !hmac.Equal([]byte(r.FormValue("state")), []byte(login.State)) {
+		return nil, nil, fmt.Errorf("login state doesn't match")
+	}
+
+	idToken, err := p.exchange(r, r.FormValue("code"), login.Verifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	claims, err := p.verify(idToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hmac.Equal([]byte(claimString(claims, "nonce")), []byte(login.Nonce)) {
+		return nil, nil, fmt.Errorf("id token nonce doesn't match")
+	}
+
+	u, err := p.user(claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, login, nil
+}
+
+// user maps id token claims to a user. Users are named "oidc:" followed by
+// their email address, or by their subject if the provider doesn't give a
+// verified email, so they never share a name with a user account.
+// If any rules are configured a user must match at least one to sign in
+func (p *oidcProvider) user(claims map[string]interface{}) (*User, error) {
+	name := claimString(claims, "email")
+	if name == "" || !emailVerified(claims) {
+		name = claimString(claims, "sub")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("id token doesn't identify a user")
+	}
+	u := &User{Username: oidcUserPrefix + name}
+
+	if len(p.rules) == 0 {
+		return u, nil
+	}
+
+	matched := false
+	for _, rule := range p.rules {
+		if rule.match(claims) {
+			matched = true
+			for _, d := range rule.UploadDirs {
+				if d = strings.Trim(d, "/"); d != "" && !isAllowedDir(u.UploadDirs, d) {
+					u.UploadDirs = append(u.UploadDirs, d)
+				}
+			}
+		}
+	}
+	if !matched {
+		return nil, fmt.Errorf("%s isn't allowed to sign in to this server", u.Username)
+	}
+	return u, nil
+}
+
+// exchange trades an authorization code for an id token
+func (p *oidcProvider) exchange(r *http.Request, code, verifier string) (string, error) {
+	if code == "" {
+		return "", fmt.Errorf("no authorization code provided")
+	}
+
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL(r)},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting token: %s", err)
+	}
+	defer res.Body.Close()
+
+	body := struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("error reading token response: %s", err)
+	}
+	if res.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token request failed: %d %s %s", res.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IdToken == "" {
+		return "", fmt.Errorf("token response has no id_token")
+	}
+	return body.IdToken, nil
+}
+
+// verify checks an id token was signed by the provider for this client &
+// hasn't expired, returning its claims. Only RS256 signed tokens are accepted
+func (p *oidcProvider) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id token algorithm: '%s'", header.Alg)
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+		return nil, fmt.Errorf("invalid id token signature")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if iss := strings.TrimSuffix(claimString(claims, "iss"), "/"); iss != p.issuer {
+		return nil, fmt.Errorf("id token issued by '%s', expected '%s'", iss, p.issuer)
+	}
+
+	audOk := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOk = aud == p.clientId
+	case []interface{}:
+		for _, a := range aud {
+			audOk = audOk || a == p.clientId
+		}
+	}
+	if !audOk {
+		return nil, fmt.Errorf("id token isn't for this client")
+	}
+
+	// allow a little clock skew between us & the provider
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Add(-time.Minute).After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("id token has expired")
+	}
+
+	return claims, nil
+}
+
+// discover fetches the provider's discovery document, caching it once
+// fetched
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := &oidcDiscovery{}
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery document is for issuer '%s', expected '%s'", d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, fmt.Errorf("discovery document is missing endpoints")
+	}
+
+	p.discovery = d
+	return d, nil
+}
+
+// key gives the provider's signing key with id kid. Keys are refetched if
+// kid isn't known, so keys the provider rotates in are picked up
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err := p.getJSON(d.JwksURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("no signing key found with id '%s'", kid)
+}
+
+// getJSON fetches url, decoding the response into v
+func (p *oidcProvider) getJSON(url string, v interface{}) error {
+	res, err := p.client.Get(url)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %s", url, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching %s: %s", url, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("error reading %s: %s", url, err)
+	}
+	return nil
+}
+
+// redirectURL is where the identity provider sends users back to. If
+// OIDC_REDIRECT_URL isn't set it's worked out from the request
+func (p *oidcProvider) redirectURL(r *http.Request) string {
+	if p.redirectUrl != "" {
+		return p.redirectUrl
+	}
+	return requestBaseURL(r) + "/auth/callback"
+}
+
+// decodeJWTPart decodes a base64 encoded JSON section of a JWT into v
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed id token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("malformed id token")
+	}
+	return nil
+}
+
+// claimString reads a string claim, returning "" if it's missing or not
+// a string
+func claimString(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// emailVerified checks the provider says the email claim has been verified.
+// Providers that leave email_verified out aren't trusted, some send it as
+// the string "true"
+func emailVerified(claims map[string]interface{}) bool {
+	return claims["email_verified"] == true || claims["email_verified"] == "true"
+}
+
+// randomToken generates a random url-safe string
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// safeReturnPath only allows redirecting to paths on this server
+func safeReturnPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP is a stand-in OpenID Connect identity provider. It signs users
+// in without asking, issuing id tokens carrying its claims
+type testIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	sync.Mutex
+	// claims are added to every id token issued
+	claims map[string]interface{}
+	// codes are the authorization codes issued & not yet exchanged
+	codes map[string]url.Values
+	// issuer overrides the issuer in the discovery document
+	issuer string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key, codes: map[string]url.Values{}, claims: map[string]interface{}{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := idp.URL
+		if idp.issuer != "" {
+			issuer = idp.issuer
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		code := randomToken()
+		idp.Lock()
+		idp.codes[code] = r.URL.Query()
+		idp.Unlock()
+
+		q := url.Values{"code": {code}, "state": {r.FormValue("state")}}
+		http.Redirect(w, r, r.FormValue("redirect_uri")+"?"+q.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.Lock()
+		login, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		idp.Unlock()
+
+		// client credentials are form encoded before basic auth
+		id, secret, _ := r.BasicAuth()
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		switch {
+		case !ok || r.FormValue("redirect_uri") != login.Get("redirect_uri"):
+			idp.tokenError(w, "invalid_grant")
+		case base64.RawURLEncoding.EncodeToString(challenge[:]) != login.Get("code_challenge"):
+			idp.tokenError(w, "invalid_grant")
+		case id != "client" || secret != "client secret":
+			idp.tokenError(w, "invalid_client")
+		default:
+			claims := idp.tokenClaims()
+			claims["nonce"] = login.Get("nonce")
+			idp.Lock()
+			for k, v := range idp.claims {
+				claims[k] = v
+			}
+			idp.Unlock()
+			json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, idp.key, "test-key", claims)})
+		}
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIdP) tokenError(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// tokenClaims gives the claims of a valid id token for the test client
+func (idp *testIdP) tokenClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss": idp.URL,
+		"aud": "client",
+		"sub": "subject-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// sign creates an RS256 id token carrying claims
+func (idp *testIdP) sign(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(map[string]string{"alg": "RS256", "kid": kid}) + "." + encode(claims)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func setupTestOIDC(t *testing.T, rules ...*OIDCRule) *testIdP {
+	setupTest(t)
+	idp := newTestIdP(t)
+	oidc = newOIDCProvider(&config{
+		OidcIssuer:       idp.URL,
+		OidcClientId:     "client",
+		OidcClientSecret: "client secret",
+		OidcRedirectUrl:  "http://uploader.test/auth/callback",
+		OidcRules:        rules,
+	})
+	return idp
+}
+
+// startTestLogin begins a login, returning the login cookie & the callback
+// url the identity provider sends the user back to
+func startTestLogin(t *testing.T) (*http.Cookie, *url.URL) {
+	w := httptest.NewRecorder()
+	LoginHandler(w, httptest.NewRequest("GET", "/login?return=/browse/", nil), nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected login to redirect to the identity provider, got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie {
+		t.Fatalf("expected a login cookie, got %v", cookies)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cookies[0], callback
+}
+
+// finishTestLogin sends the user back to the callback, returning the
+// response
+func finishTestLogin(cookie *http.Cookie, callback *url.URL) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", callback.RequestURI(), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	OIDCCallbackHandler(w, r, nil)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := setupTestOIDC(t,
+		&OIDCRule{EmailDomain: "example.org", UploadDirs: []string{"staff"}},
+		&OIDCRule{Claim: "groups", Value: "rescue", UploadDirs: []string{"rescue"}},
+	)
+	idp.claims = map[string]interface{}{
+		"email":          "volunteer@example.org",
+		"email_verified": true,
+		"groups":         []string{"rescue", "other"},
+	}
+
+	w := finishTestLogin(startTestLogin(t))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/browse/" {
+		t.Fatalf("expected a redirect back to /browse/, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("expected a session cookie")
+	}
+	if session.SameSite != http.SameSiteLaxMode || session.Secure {
+		t.Errorf("expected a lax, insecure session cookie over http, got %+v", session)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(session)
+	u, err := authenticateSession(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "oidc:volunteer@example.org" {
+		t.Errorf("expected to be signed in as oidc:volunteer@example.org, got %s", u.Username)
+	}
+	if strings.Join(u.UploadDirs, ",") != "staff,rescue" {
+		t.Errorf("expected upload dirs staff,rescue, got %v", u.UploadDirs)
+	}
+}
+
+func TestLoginCookieBehindProxy(t *testing.T) {
+	setupTestOIDC(t)
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	LoginHandler(w, r, nil)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].Secure || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Errorf("expected a secure, lax login cookie behind an https proxy, got %v", cookies)
+	}
+}
+
+func TestOIDCLoginMismatches(t *testing.T) {
+	cases := []struct {
+		description string
+		// change alters the login before the user is sent back
+		change func(idp *testIdP, cookie *http.Cookie, callback *url.URL) *http.Cookie
+	}{
+		{"state", func(idp *testIdP, cookie *http.Cookie, callback *url.URL) *http.Cookie {
+			q := callback.Query()
+			q.Set("state", "forged")
+			callback.RawQuery = q.Encode()
+			return cookie
+		}},
+		{"nonce", func(idp *testIdP, cookie *http.Cookie, callback *url.URL) *http.Cookie {
+			idp.claims["nonce"] = "replayed"
+			return cookie
+		}},
+		{"pkce verifier", func(idp *testIdP, cookie *http.Cookie, callback *url.URL) *http.Cookie {
+			login := &oidcLogin{}
+			if err := sessions.Decode(oidcStateCookie, cookie.Value, login); err != nil {
+				t.Fatal(err)
+			}
+			login.Verifier = randomToken()
+			value, err := sessions.Encode(oidcStateCookie, login)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &http.Cookie{Name: oidcStateCookie, Value: value}
+		}},
+		{"login cookie", func(idp *testIdP, cookie *http.Cookie, callback *url.URL) *http.Cookie {
+			return &http.Cookie{Name: oidcStateCookie, Value: cookie.Value + "x"}
+		}},
+	}
+
+	for _, c := range cases {
+		idp := setupTestOIDC(t)
+		idp.claims["email"] = "volunteer@example.org"
+		cookie, callback := startTestLogin(t)
+		cookie = c.change(idp, cookie, callback)
+
+		w := finishTestLogin(cookie, callback)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected a mismatch to be refused, got status %d", c.description, w.Code)
+		}
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == sessionCookie && cookie.MaxAge >= 0 {
+				t.Errorf("%s: expected no session to be started", c.description)
+			}
+		}
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	idp := setupTestOIDC(t)
+	d, err := oidc.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.TokenEndpoint != idp.URL+"/token" {
+		t.Errorf("expected token endpoint %s/token, got %s", idp.URL, d.TokenEndpoint)
+	}
+
+	idp = setupTestOIDC(t)
+	idp.issuer = "https://someone-else.example.org"
+	if _, err := oidc.discover(); err == nil {
+		t.Error("expected a discovery document for another issuer to be refused")
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	idp := setupTestOIDC(t)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(k string, v interface{}) map[string]interface{} {
+		c := idp.tokenClaims()
+		c[k] = v
+		return c
+	}
+	cases := []struct {
+		description string
+		token       string
+		valid       bool
+	}{
+		{"valid", idp.sign(t, idp.key, "test-key", idp.tokenClaims()), true},
+		{"audience list", idp.sign(t, idp.key, "test-key", claims("aud", []string{"another", "client"})), true},
+		{"signed by another key", idp.sign(t, other, "test-key", idp.tokenClaims()), false},
+		{"unknown key id", idp.sign(t, idp.key, "rotated-out", idp.tokenClaims()), false},
+		{"another issuer", idp.sign(t, idp.key, "test-key", claims("iss", "https://someone-else.example.org")), false},
+		{"another client", idp.sign(t, idp.key, "test-key", claims("aud", "another")), false},
+		{"expired", idp.sign(t, idp.key, "test-key", claims("exp", time.Now().Add(-time.Hour).Unix())), false},
+		{"unsigned", strings.Join(strings.Split(idp.sign(t, idp.key, "test-key", idp.tokenClaims()), ".")[:2], ".") + ".", false},
+		{"malformed", "not a token", false},
+	}
+
+	for _, c := range cases {
+		_, err := oidc.verify(c.token)
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", c.description, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: expected the token to be refused", c.description)
+		}
+	}
+
+	// tokens with any algorithm other than RS256 are refused outright
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	body := base64.RawURLEncoding.EncodeToString([]byte(`{}`))
+	if _, err := oidc.verify(none + "." + body + "."); err == nil {
+		t.Error("expected an alg none token to be refused")
+	}
+}
+
+func TestOIDCRuleMatch(t *testing.T) {
+	cases := []struct {
+		description string
+		rule        *OIDCRule
+		claims      map[string]interface{}
+		match       bool
+	}{
+		{"verified email", &OIDCRule{EmailDomain: "example.org"}, map[string]interface{}{"email": "a@example.org", "email_verified": true}, true},
+		{"verified email as a string", &OIDCRule{EmailDomain: "@Example.org"}, map[string]interface{}{"email": "a@EXAMPLE.org", "email_verified": "true"}, true},
+		{"unverified email", &OIDCRule{EmailDomain: "example.org"}, map[string]interface{}{"email": "a@example.org", "email_verified": false}, false},
+		{"email without email_verified", &OIDCRule{EmailDomain: "example.org"}, map[string]interface{}{"email": "a@example.org"}, false},
+		{"another domain", &OIDCRule{EmailDomain: "example.org"}, map[string]interface{}{"email": "a@example.org.evil.com", "email_verified": true}, false},
+		{"claim value", &OIDCRule{Claim: "team", Value: "rescue"}, map[string]interface{}{"team": "rescue"}, true},
+		{"claim list", &OIDCRule{Claim: "groups", Value: "rescue"}, map[string]interface{}{"groups": []interface{}{"staff", "rescue"}}, true},
+		{"claim missing", &OIDCRule{Claim: "groups", Value: "rescue"}, map[string]interface{}{}, false},
+		{"claim other value", &OIDCRule{Claim: "groups", Value: "rescue"}, map[string]interface{}{"groups": []interface{}{"staff"}}, false},
+	}
+
+	for _, c := range cases {
+		if got := c.rule.match(c.claims); got != c.match {
+			t.Errorf("%s: expected match to be %t, got %t", c.description, c.match, got)
+		}
+	}
+}
+
+func TestOIDCUserRequiresVerifiedEmail(t *testing.T) {
+	p := &oidcProvider{}
+	u, err := p.user(map[string]interface{}{"sub": "subject-1", "email": "a@example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "oidc:subject-1" {
+		t.Errorf("expected a user without a verified email to be named by subject, got %s", u.Username)
+	}
+
+	u, err = p.user(map[string]interface{}{"sub": "subject-1", "email": "a@example.org", "email_verified": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "oidc:a@example.org" {
+		t.Errorf("expected a user with a verified email to be named by email, got %s", u.Username)
+	}
+}
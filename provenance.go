@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// manifestSuffix is appended to an object's key to get the key of its manifest
+const manifestSuffix = ".manifest.json"
+
+// Provenance records where an upload came from. Data rescue relies on being
+// able to trace every file back to its source, so these details are
+// collected by the upload form & stored both as object metadata and in the
+// upload's manifest
+type Provenance struct {
+	// Uploader is the name or email of the person uploading
+	Uploader string `json:"uploader,omitempty"`
+	// SourceURL is where the data was downloaded from
+	SourceURL string `json:"sourceUrl,omitempty"`
+	// Agency is the agency that published the data
+	Agency string `json:"agency,omitempty"`
+	// Notes is freeform text about the upload
+	Notes string `json:"notes,omitempty"`
+	// Account is the username the upload was requested with. Unlike the
+	// other fields it's set by the server, not the uploader
+	Account string `json:"account,omitempty"`
+}
+
+// provenance field limits, keeping metadata well clear of S3's 2KB cap
+// on user-defined metadata
+const (
+	maxUploaderLength  = 128
+	maxAgencyLength    = 128
+	maxSourceURLLength = 1024
+	maxNotesLength     = 512
+)
+
+// RequestProvenance reads & validates the uploader, source_url, agency &
+// notes request params. All fields are optional, but must be valid if present.
+// The signed in user's name is recorded as the account
+func RequestProvenance(r *http.Request) (*Provenance, error) {
+	p := &Provenance{
+		Uploader:  strings.TrimSpace(r.FormValue("uploader")),
+		SourceURL: strings.TrimSpace(r.FormValue("source_url")),
+		Agency:    strings.TrimSpace(r.FormValue("agency")),
+		Notes:     strings.TrimSpace(r.FormValue("notes")),
+		Account:   requestUsername(r),
+	}
+
+	fields := []struct {
+		name, value string
+		max         int
+	}{
+		{"uploader", p.Uploader, maxUploaderLength},
+		{"source_url", p.SourceURL, maxSourceURLLength},
+		{"agency", p.Agency, maxAgencyLength},
+		{"notes", p.Notes, maxNotesLength},
+	}
+	for _, f := range fields {
+		if len(f.value) > f.max {
+			return nil, fmt.Errorf("%s must be %d characters or less", f.name, f.max)
+		}
+		if strings.IndexFunc(f.value, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("%s cannot contain control characters", f.name)
+		}
+	}
+
+	if p.SourceURL != "" {
+		u, err := url.Parse(p.SourceURL)
+		if err != nil || u.Host == "" || !(u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "ftp") {
+			return nil, fmt.Errorf("source_url must be a full http, https or ftp url")
+		}
+	}
+
+	return p, nil
+}
+
+// Metadata gives provenance as object metadata, leaving out empty fields.
+// Metadata travels as http headers, so any non-ascii values are
+// encoded as RFC 2047 words
+func (p *Provenance) Metadata() map[string]string {
+	md := map[string]string{}
+	for k, v := range map[string]string{
+		"uploader":   p.Uploader,
+		"source-url": p.SourceURL,
+		"agency":     p.Agency,
+		"notes":      p.Notes,
+		"account":    p.Account,
+	} {
+		if v != "" {
+			md[k] = mime.QEncoding.Encode("utf-8", v)
+		}
+	}
+	return md
+}
+
+// manifest statuses. uploads start out requested, and are confirmed once the
+// uploaded file has been checked against the manifest. An upload is replaced
+// if another file took its path first & a new path was issued in its place
+const (
+	ManifestRequested = "requested"
+	ManifestConfirmed = "confirmed"
+	ManifestMismatch  = "mismatch"
+	ManifestReplaced  = "replaced"
+)
+
+// Manifest describes a single upload, written alongside the uploaded file
+// as <key>.manifest.json. Size is the file size the client reported when
+// the upload was requested, MD5 the hex md5 digest the upload was signed with
+// & SHA256 the hex sha256 digest the client reported, which is only recorded.
+// Confirmed, ETag & Problems are filled in by ConfirmUpload
+type Manifest struct {
+	Key         string      `json:"key"`
+	URL         string      `json:"url"`
+	ContentType string      `json:"contentType,omitempty"`
+	Size        int64       `json:"size,omitempty"`
+	MD5         string      `json:"md5,omitempty"`
+	SHA256      string      `json:"sha256,omitempty"`
+	Requested   time.Time   `json:"requested"`
+	Method      string      `json:"method"`
+	Provenance  *Provenance `json:"provenance"`
+	Status      string      `json:"status"`
+	Confirmed   *time.Time  `json:"confirmed,omitempty"`
+	ETag        string      `json:"etag,omitempty"`
+	Problems    []string    `json:"problems,omitempty"`
+}
+
+// NewManifest creates the manifest for an upload to key requested by r.
+// method is the way the file is being uploaded, eg. "signed_put"
+func NewManifest(r *http.Request, key, method string, p *Provenance) *Manifest {
+	size, _ := strconv.ParseInt(r.FormValue("object_size"), 10, 64)
+	return &Manifest{
+		Key:         key,
+		URL:         store.ObjectURL(key),
+		ContentType: r.FormValue("mime_type"),
+		Size:        size,
+		Requested:   time.Now().UTC(),
+		Method:      method,
+		Provenance:  p,
+		Status:      ManifestRequested,
+	}
+}
+
+// ReadManifest fetches the manifest for the object at key, returning
+// ErrNotFound if there isn't one
+func ReadManifest(svc Storage, key string) (*Manifest, error) {
+	r, err := svc.Get(ManifestKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	m := &Manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("error reading manifest for %s: %s", key, err)
+	}
+	return m, nil
+}
+
+// WriteManifest stores m next to the file it describes. manifests are
+// written once an upload is confirmed, and are private as they record the
+// account & address the upload came from
+func WriteManifest(svc Storage, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return svc.PutObject(ManifestKey(m.Key), bytes.NewReader(data), &PutOptions{ContentType: "application/json", Private: true})
+}
+
+// ManifestKey gives the key of the manifest for the object at key. The
+// manifest for a prefix ending in "/" sits beside it rather than within it,
+// out of reach of credentials scoped to the prefix
+func ManifestKey(key string) string {
+	return strings.TrimSuffix(key, "/") + manifestSuffix
+}
+
+// isManifest checks if key is an upload manifest
+func isManifest(key string) bool {
+	return strings.HasSuffix(key, manifestSuffix)
+}
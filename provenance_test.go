@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestProvenance(t *testing.T) {
+	cases := []struct {
+		description string
+		params      url.Values
+		user        *User
+		expect      Provenance
+		err         string
+	}{
+		{"empty", url.Values{}, nil, Provenance{}, ""},
+		{"all fields", url.Values{
+			"uploader":   {"  jo@example.com "},
+			"source_url": {"https://www.epa.gov/data?id=1"},
+			"agency":     {"EPA"},
+			"notes":      {"from the archive"},
+		}, &User{Username: "jo"}, Provenance{
+			Uploader:  "jo@example.com",
+			SourceURL: "https://www.epa.gov/data?id=1",
+			Agency:    "EPA",
+			Notes:     "from the archive",
+			Account:   "jo",
+		}, ""},
+		{"ftp source", url.Values{"source_url": {"ftp://ftp.ncdc.noaa.gov/pub"}}, nil, Provenance{SourceURL: "ftp://ftp.ncdc.noaa.gov/pub"}, ""},
+		{"account isn't a param", url.Values{"account": {"admin"}}, nil, Provenance{}, ""},
+		{"longest uploader", url.Values{"uploader": {strings.Repeat("a", maxUploaderLength)}}, nil, Provenance{Uploader: strings.Repeat("a", maxUploaderLength)}, ""},
+		{"uploader too long", url.Values{"uploader": {strings.Repeat("a", maxUploaderLength+1)}}, nil, Provenance{}, "uploader must be 128 characters or less"},
+		{"agency too long", url.Values{"agency": {strings.Repeat("a", maxAgencyLength+1)}}, nil, Provenance{}, "agency must be 128 characters or less"},
+		{"notes too long", url.Values{"notes": {strings.Repeat("a", maxNotesLength+1)}}, nil, Provenance{}, "notes must be 512 characters or less"},
+		{"source url too long", url.Values{"source_url": {"https://example.com/" + strings.Repeat("a", maxSourceURLLength)}}, nil, Provenance{}, "source_url must be 1024 characters or less"},
+		{"control character", url.Values{"notes": {"line one\nline two"}}, nil, Provenance{}, "notes cannot contain control characters"},
+		{"relative source url", url.Values{"source_url": {"/data.csv"}}, nil, Provenance{}, "source_url must be a full"},
+		{"source url scheme", url.Values{"source_url": {"javascript://example.com/alert(1)"}}, nil, Provenance{}, "source_url must be a full"},
+		{"source url without a host", url.Values{"source_url": {"http:data.csv"}}, nil, Provenance{}, "source_url must be a full"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/token?"+c.params.Encode(), nil)
+		if c.user != nil {
+			r = withUser(r, c.user)
+		}
+		p, err := RequestProvenance(r)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error %q, got %v", c.description, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.description, err)
+		} else if *p != c.expect {
+			t.Errorf("%s: expected %+v, got %+v", c.description, c.expect, *p)
+		}
+	}
+}
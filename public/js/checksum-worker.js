@@ -0,0 +1,293 @@
+// checksum-worker.js calculates the checksums of a file off the page's
+// thread, reading it a chunk at a time so the whole file never has to be in
+// memory. Post it { file : File or Blob, partSize : bytes }, it replies with
+// { progress : 0-1 } as it goes, then either
+// { md5 : "<base64 digest>", sha256 : "<hex digest>", parts : [...] } or
+// { error : "<message>" }. parts holds the base64 md5 of each partSize chunk
+// of the file, for multipart uploads, & is empty without a partSize
+
+var CHUNK_SIZE = 4 * 1024 * 1024;
+
+self.onmessage = function(e) {
+  var file = e.data.file
+    , partSize = e.data.partSize
+    , reader = new FileReaderSync()
+    , md5 = new MD5()
+    , sha256 = new SHA256()
+    , parts = []
+    , part = null
+    , offset, end, bytes;
+
+  try {
+    for (offset = 0; offset < file.size; offset = end) {
+      end = Math.min(offset + CHUNK_SIZE, file.size);
+      // chunks never straddle two parts, so each part's digest can be
+      // finished as soon as its last chunk has been read
+      if (partSize) {
+        end = Math.min(end, (Math.floor(offset / partSize) + 1) * partSize);
+        part = part || new MD5();
+      }
+
+      bytes = new Uint8Array(reader.readAsArrayBuffer(file.slice(offset, end)));
+      md5.update(bytes);
+      sha256.update(bytes);
+      if (part) {
+        part.update(bytes);
+        if (end % partSize === 0 || end === file.size) {
+          parts.push(part.digest());
+          part = null;
+        }
+      }
+      self.postMessage({ progress : end / file.size });
+    }
+    self.postMessage({ md5 : md5.digest(), sha256 : sha256.digest(), parts : parts });
+  } catch (err) {
+    self.postMessage({ error : err.message || String(err) });
+  }
+};
+
+// MD5 is an incremental md5 hash. call update with each chunk of bytes in
+// order, then digest once for the base64 result
+function MD5() {
+  this.state = [0x67452301, 0xefcdab89 | 0, 0x98badcfe | 0, 0x10325476];
+  this.words = new Int32Array(16);
+  this.tail = new Uint8Array(64);
+  this.tailLength = 0;
+  this.length = 0;
+}
+
+MD5.prototype.update = function(bytes) {
+  var i = 0, n;
+  this.length += bytes.length;
+
+  // top up a partial block left over from the last update
+  if (this.tailLength > 0) {
+    n = Math.min(64 - this.tailLength, bytes.length);
+    this.tail.set(bytes.subarray(0, n), this.tailLength);
+    this.tailLength += n;
+    i = n;
+    if (this.tailLength < 64) {
+      return;
+    }
+    this.block(this.tail, 0);
+    this.tailLength = 0;
+  }
+
+  for (; i + 64 <= bytes.length; i += 64) {
+    this.block(bytes, i);
+  }
+
+  this.tail.set(bytes.subarray(i), 0);
+  this.tailLength = bytes.length - i;
+};
+
+// block mixes the 64 bytes of buf starting at offset into the hash state,
+// running the four rounds of RFC 1321 unrolled
+MD5.prototype.block = function(buf, offset) {
+  var m = this.words
+    , s = this.state
+    , a = s[0], b = s[1], c = s[2], d = s[3]
+    , i, j;
+
+  for (j = 0; j < 16; j++) {
+    i = offset + j * 4;
+    m[j] = buf[i] | (buf[i + 1] << 8) | (buf[i + 2] << 16) | (buf[i + 3] << 24);
+  }
+
+  a = ff(a, b, c, d, m[0], 7, -680876936);
+  d = ff(d, a, b, c, m[1], 12, -389564586);
+  c = ff(c, d, a, b, m[2], 17, 606105819);
+  b = ff(b, c, d, a, m[3], 22, -1044525330);
+  a = ff(a, b, c, d, m[4], 7, -176418897);
+  d = ff(d, a, b, c, m[5], 12, 1200080426);
+  c = ff(c, d, a, b, m[6], 17, -1473231341);
+  b = ff(b, c, d, a, m[7], 22, -45705983);
+  a = ff(a, b, c, d, m[8], 7, 1770035416);
+  d = ff(d, a, b, c, m[9], 12, -1958414417);
+  c = ff(c, d, a, b, m[10], 17, -42063);
+  b = ff(b, c, d, a, m[11], 22, -1990404162);
+  a = ff(a, b, c, d, m[12], 7, 1804603682);
+  d = ff(d, a, b, c, m[13], 12, -40341101);
+  c = ff(c, d, a, b, m[14], 17, -1502002290);
+  b = ff(b, c, d, a, m[15], 22, 1236535329);
+
+  a = gg(a, b, c, d, m[1], 5, -165796510);
+  d = gg(d, a, b, c, m[6], 9, -1069501632);
+  c = gg(c, d, a, b, m[11], 14, 643717713);
+  b = gg(b, c, d, a, m[0], 20, -373897302);
+  a = gg(a, b, c, d, m[5], 5, -701558691);
+  d = gg(d, a, b, c, m[10], 9, 38016083);
+  c = gg(c, d, a, b, m[15], 14, -660478335);
+  b = gg(b, c, d, a, m[4], 20, -405537848);
+  a = gg(a, b, c, d, m[9], 5, 568446438);
+  d = gg(d, a, b, c, m[14], 9, -1019803690);
+  c = gg(c, d, a, b, m[3], 14, -187363961);
+  b = gg(b, c, d, a, m[8], 20, 1163531501);
+  a = gg(a, b, c, d, m[13], 5, -1444681467);
+  d = gg(d, a, b, c, m[2], 9, -51403784);
+  c = gg(c, d, a, b, m[7], 14, 1735328473);
+  b = gg(b, c, d, a, m[12], 20, -1926607734);
+
+  a = hh(a, b, c, d, m[5], 4, -378558);
+  d = hh(d, a, b, c, m[8], 11, -2022574463);
+  c = hh(c, d, a, b, m[11], 16, 1839030562);
+  b = hh(b, c, d, a, m[14], 23, -35309556);
+  a = hh(a, b, c, d, m[1], 4, -1530992060);
+  d = hh(d, a, b, c, m[4], 11, 1272893353);
+  c = hh(c, d, a, b, m[7], 16, -155497632);
+  b = hh(b, c, d, a, m[10], 23, -1094730640);
+  a = hh(a, b, c, d, m[13], 4, 681279174);
+  d = hh(d, a, b, c, m[0], 11, -358537222);
+  c = hh(c, d, a, b, m[3], 16, -722521979);
+  b = hh(b, c, d, a, m[6], 23, 76029189);
+  a = hh(a, b, c, d, m[9], 4, -640364487);
+  d = hh(d, a, b, c, m[12], 11, -421815835);
+  c = hh(c, d, a, b, m[15], 16, 530742520);
+  b = hh(b, c, d, a, m[2], 23, -995338651);
+
+  a = ii(a, b, c, d, m[0], 6, -198630844);
+  d = ii(d, a, b, c, m[7], 10, 1126891415);
+  c = ii(c, d, a, b, m[14], 15, -1416354905);
+  b = ii(b, c, d, a, m[5], 21, -57434055);
+  a = ii(a, b, c, d, m[12], 6, 1700485571);
+  d = ii(d, a, b, c, m[3], 10, -1894986606);
+  c = ii(c, d, a, b, m[10], 15, -1051523);
+  b = ii(b, c, d, a, m[1], 21, -2054922799);
+  a = ii(a, b, c, d, m[8], 6, 1873313359);
+  d = ii(d, a, b, c, m[15], 10, -30611744);
+  c = ii(c, d, a, b, m[6], 15, -1560198380);
+  b = ii(b, c, d, a, m[13], 21, 1309151649);
+  a = ii(a, b, c, d, m[4], 6, -145523070);
+  d = ii(d, a, b, c, m[11], 10, -1120210379);
+  c = ii(c, d, a, b, m[2], 15, 718787259);
+  b = ii(b, c, d, a, m[9], 21, -343485551);
+
+  s[0] = (s[0] + a) | 0;
+  s[1] = (s[1] + b) | 0;
+  s[2] = (s[2] + c) | 0;
+  s[3] = (s[3] + d) | 0;
+};
+
+function cmn(q, a, b, x, s, t) {
+  a = (a + q + x + t) | 0;
+  return (((a << s) | (a >>> (32 - s))) + b) | 0;
+}
+
+function ff(a, b, c, d, x, s, t) { return cmn((b & c) | (~b & d), a, b, x, s, t); }
+function gg(a, b, c, d, x, s, t) { return cmn((b & d) | (c & ~d), a, b, x, s, t); }
+function hh(a, b, c, d, x, s, t) { return cmn(b ^ c ^ d, a, b, x, s, t); }
+function ii(a, b, c, d, x, s, t) { return cmn(c ^ (b | ~d), a, b, x, s, t); }
+
+// digest pads the final block with the message length & returns the
+// base64 digest, the format used by the Content-MD5 header
+MD5.prototype.digest = function() {
+  var bits = this.length * 8
+    , padLength = (this.tailLength < 56 ? 56 : 120) - this.tailLength
+    , pad = new Uint8Array(padLength + 8)
+    , out = ''
+    , i;
+
+  pad[0] = 0x80;
+  // message length in bits as a little-endian 64 bit number
+  for (i = 0; i < 8; i++) {
+    pad[padLength + i] = Math.floor(bits / Math.pow(2, 8 * i)) & 0xff;
+  }
+  this.update(pad);
+
+  for (i = 0; i < 16; i++) {
+    out += String.fromCharCode((this.state[i >> 2] >>> ((i % 4) * 8)) & 0xff);
+  }
+  return btoa(out);
+};
+
+// SHA256 is an incremental sha-256 hash, fed the same way as MD5. it's
+// recorded alongside the md5 as a stronger checksum for archived files
+function SHA256() {
+  this.state = new Int32Array([
+    0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+    0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19
+  ]);
+  this.words = new Int32Array(64);
+  this.tail = new Uint8Array(64);
+  this.tailLength = 0;
+  this.length = 0;
+}
+
+// both hashes work on 64 byte blocks, so they buffer input the same way
+SHA256.prototype.update = MD5.prototype.update;
+
+var SHA256_K = new Int32Array([
+  0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+  0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+  0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+  0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+  0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+  0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+  0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+  0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+]);
+
+function rotr(x, n) { return (x >>> n) | (x << (32 - n)); }
+
+// block mixes the 64 bytes of buf starting at offset into the hash state,
+// following FIPS 180-4
+SHA256.prototype.block = function(buf, offset) {
+  var w = this.words
+    , s = this.state
+    , a = s[0], b = s[1], c = s[2], d = s[3], e = s[4], f = s[5], g = s[6], h = s[7]
+    , i, j, t1, t2;
+
+  for (j = 0; j < 16; j++) {
+    i = offset + j * 4;
+    w[j] = (buf[i] << 24) | (buf[i + 1] << 16) | (buf[i + 2] << 8) | buf[i + 3];
+  }
+  for (j = 16; j < 64; j++) {
+    t1 = rotr(w[j - 15], 7) ^ rotr(w[j - 15], 18) ^ (w[j - 15] >>> 3);
+    t2 = rotr(w[j - 2], 17) ^ rotr(w[j - 2], 19) ^ (w[j - 2] >>> 10);
+    w[j] = (w[j - 16] + t1 + w[j - 7] + t2) | 0;
+  }
+
+  for (j = 0; j < 64; j++) {
+    t1 = (h + (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) + ((e & f) ^ (~e & g)) + SHA256_K[j] + w[j]) | 0;
+    t2 = ((rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)) + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+    h = g;
+    g = f;
+    f = e;
+    e = (d + t1) | 0;
+    d = c;
+    c = b;
+    b = a;
+    a = (t1 + t2) | 0;
+  }
+
+  s[0] = (s[0] + a) | 0;
+  s[1] = (s[1] + b) | 0;
+  s[2] = (s[2] + c) | 0;
+  s[3] = (s[3] + d) | 0;
+  s[4] = (s[4] + e) | 0;
+  s[5] = (s[5] + f) | 0;
+  s[6] = (s[6] + g) | 0;
+  s[7] = (s[7] + h) | 0;
+};
+
+// digest pads the final block with the message length & returns the hex
+// digest, the format sha256sum prints
+SHA256.prototype.digest = function() {
+  var bits = this.length * 8
+    , padLength = (this.tailLength < 56 ? 56 : 120) - this.tailLength
+    , pad = new Uint8Array(padLength + 8)
+    , out = ''
+    , i;
+
+  pad[0] = 0x80;
+  // message length in bits as a big-endian 64 bit number
+  for (i = 0; i < 8; i++) {
+    pad[padLength + 7 - i] = Math.floor(bits / Math.pow(2, 8 * i)) & 0xff;
+  }
+  this.update(pad);
+
+  for (i = 0; i < 8; i++) {
+    out += ('00000000' + (this.state[i] >>> 0).toString(16)).slice(-8);
+  }
+  return out;
+};
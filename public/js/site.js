@@ -41,6 +41,12 @@ $(function(){
 		var ul = new S3Upload(file, {
 			s3_sign_put_url: "/token",
 			dir : dirPicker.length ? dirPicker.val() : "",
+			provenance : {
+				uploader : $("#uploader").val(),
+				source_url : $("#source_url").val(),
+				agency : $("#agency").val(),
+				notes : $("#notes").val()
+			},
 			onProgress: progress,
 			onFinishS3Put: done,
 			onError: error,
@@ -67,6 +73,7 @@ function queryParam(name, url) {
 
 function S3Upload(el, options) {
   options || (options = {});
+  this.checksums = {};
   for (var option in options) {
     this[option] = options[option];
   }
@@ -76,6 +83,20 @@ function S3Upload(el, options) {
 S3Upload.prototype.s3ObjectName = 'default_name';
 S3Upload.prototype.s3_sign_put_url = '/token';
 S3Upload.prototype.file_dom_selector = 'file_upload';
+S3Upload.prototype.multipart_url = '/multipart';
+// number of times to ask for a new path if the signed one is taken
+S3Upload.prototype.overwrite_retries = 3;
+// files larger than multipart_threshold are sent in multipart_part_size chunks
+S3Upload.prototype.multipart_threshold = 100 * 1024 * 1024;
+S3Upload.prototype.multipart_part_size = 50 * 1024 * 1024;
+S3Upload.prototype.multipart_concurrency = 4;
+S3Upload.prototype.multipart_retries = 3;
+// provenance fields (uploader, source_url, agency & notes) sent when requesting an upload
+S3Upload.prototype.provenance = {};
+// endpoint that confirms an upload arrived intact
+S3Upload.prototype.complete_url = '/complete';
+// worker that calculates checksums, set to null to upload without checksums
+S3Upload.prototype.checksum_worker_url = '/js/checksum-worker.js';
 
 S3Upload.prototype.onFinishS3Put = function(public_url) {
   return console.log('base.onFinishS3Put()', public_url);
@@ -116,11 +137,17 @@ S3Upload.prototype.createCORSRequest = function(method, url) {
   return xhr;
 };
 
-S3Upload.prototype.executeOnSignedUrl = function(file, callback) {
-  var this_s3upload, xhr;
+// executeOnSignedUrl asks the server to sign an upload of file. replaces is
+// the key of an earlier upload whose path was taken before it arrived
+S3Upload.prototype.executeOnSignedUrl = function(file, callback, replaces) {
+  var this_s3upload, xhr, query;
   this_s3upload = this;
+  query = this.uploadParams(file);
+  if (replaces) {
+    query += '&replaces=' + encodeURIComponent(replaces);
+  }
   xhr = new XMLHttpRequest();
-  xhr.open('GET', this.s3_sign_put_url + '?mime_type=' + file.type + '&dir=' + this.dir + '&object_name=' + file.name + '&object_size=' + file.size , true);
+  xhr.open('GET', this.s3_sign_put_url + '?' + query, true);
   xhr.overrideMimeType('text/plain; charset=x-user-defined');
   xhr.onreadystatechange = function(e) {
     var result;
@@ -132,7 +159,8 @@ S3Upload.prototype.executeOnSignedUrl = function(file, callback) {
         return false;
       }
 
-      return callback(result.signedRequest, result.url);
+      // servers signing POST uploads send form fields in place of headers
+      return callback(result.signedRequest, result.url, result.headers, result.key, result.method === 'POST' ? result.fields : null);
     } else if (this.readyState === 4 && this.status !== 200) {
     	try {
         result = JSON.parse(this.responseText);
@@ -149,17 +177,54 @@ S3Upload.prototype.executeOnSignedUrl = function(file, callback) {
   return xhr.send();
 };
 
-S3Upload.prototype.uploadToS3 = function(file, url, public_url) {
-  var this_s3upload, xhr;
+// uploadParams builds the query string describing file & its provenance
+// for signing requests
+S3Upload.prototype.uploadParams = function(file) {
+  var params = {
+    mime_type : file.type,
+    dir : this.dir,
+    object_name : file.name,
+    object_size : file.size
+  }, query = [], key;
+
+  for (key in this.provenance) {
+    if (this.provenance[key]) {
+      params[key] = this.provenance[key];
+    }
+  }
+  if (this.checksums[this.uploadFingerprint(file)]) {
+    params.md5 = this.checksums[this.uploadFingerprint(file)].md5;
+    params.sha256 = this.checksums[this.uploadFingerprint(file)].sha256;
+  }
+  for (key in params) {
+    query.push(encodeURIComponent(key) + '=' + encodeURIComponent(params[key]));
+  }
+  return query.join('&');
+};
+
+// uploadToS3 PUTs file to a signed url. headers are the signed headers the
+// server returned, which must be sent exactly as given. Once uploaded the
+// server is asked to confirm key arrived intact
+S3Upload.prototype.uploadToS3 = function(file, url, public_url, headers, key, attempt) {
+  var this_s3upload, xhr, name, send;
   this_s3upload = this;
+  attempt = attempt || 1;
   xhr = this.createCORSRequest('PUT', url);
   if (!xhr) {
     this.onError('CORS not supported');
   } else {
     xhr.onload = function() {
       if (xhr.status === 200) {
-        this_s3upload.onProgress(100, 'Upload completed.');
-        return this_s3upload.onFinishS3Put(public_url);
+        return this_s3upload.confirmUpload(key, public_url);
+      } else if (xhr.status === 412 && attempt < this_s3upload.overwrite_retries) {
+        // someone else uploaded to this path after it was signed, ask for a
+        // new one in its place
+        return this_s3upload.executeOnSignedUrl(file, function(signedURL, publicURL, signedHeaders, signedKey) {
+          return this_s3upload.uploadToS3(file, signedURL, publicURL, signedHeaders, signedKey, attempt + 1);
+        }, key);
+      } else if (xhr.status === 400 && /BadDigest|checksum/.test(xhr.responseText)) {
+        // the checksum the upload was signed with didn't match what arrived
+        return this_s3upload.onError('Upload error: the file was corrupted while uploading, please try again.');
       } else {
         return this_s3upload.onError('Upload error: ' + xhr.status);
       }
@@ -175,15 +240,391 @@ S3Upload.prototype.uploadToS3 = function(file, url, public_url) {
       }
     };
   }
-  xhr.setRequestHeader('Content-Type', file.type);
-  xhr.setRequestHeader('x-amz-acl', 'public-read');
+  // signed uploads refuse to overwrite existing files
+  send = {
+    'Content-Type' : file.type,
+    'x-amz-acl' : 'public-read',
+    'If-None-Match' : '*'
+  };
+  // signed headers replace the defaults, header names are case-insensitive
+  for (name in headers || {}) {
+    for (var d in send) {
+      if (d.toLowerCase() === name.toLowerCase()) {
+        delete send[d];
+      }
+    }
+    send[name] = headers[name];
+  }
+  for (name in send) {
+    xhr.setRequestHeader(name, send[name]);
+  }
   return xhr.send(file);
 };
 
+// postToS3 submits file as multipart/form-data to a url signed with a POST
+// policy. fields are the form fields the server returned, which must come
+// before the file. Once uploaded the server is asked to confirm key arrived
+// intact
+S3Upload.prototype.postToS3 = function(file, url, public_url, fields, key) {
+  var this_s3upload, xhr, form, name;
+  this_s3upload = this;
+  xhr = this.createCORSRequest('POST', url);
+  if (!xhr) {
+    return this.onError('CORS not supported');
+  }
+  xhr.onload = function() {
+    if (xhr.status >= 200 && xhr.status < 300) {
+      return this_s3upload.confirmUpload(key, public_url);
+    } else if (xhr.status === 400 && /EntityTooLarge|EntityTooSmall/.test(xhr.responseText)) {
+      // the policy only accepts files of the size that was signed for
+      return this_s3upload.onError('Upload error: the file is not the size it was signed for.');
+    } else {
+      return this_s3upload.onError('Upload error: ' + xhr.status);
+    }
+  };
+  xhr.onerror = function() {
+    return this_s3upload.onError('XHR error.');
+  };
+  xhr.upload.onprogress = function(e) {
+    var percentLoaded;
+    if (e.lengthComputable) {
+      percentLoaded = Math.round((e.loaded / e.total) * 100);
+      return this_s3upload.onProgress(percentLoaded, percentLoaded === 100 ? 'Finalizing.' : 'Uploading.');
+    }
+  };
+
+  form = new FormData();
+  for (name in fields) {
+    form.append(name, fields[name]);
+  }
+  // S3 ignores any fields after the file
+  form.append('file', file);
+  return xhr.send(form);
+};
+
+// confirmUpload asks the server to check the file at key against what was
+// declared when it was signed, only reporting success once it has
+S3Upload.prototype.confirmUpload = function(key, public_url) {
+  var this_s3upload = this;
+  this.onProgress(100, 'Confirming upload.');
+  this.serverRequest('POST', this.complete_url + '?key=' + encodeURIComponent(key), null, function(result) {
+    this_s3upload.onProgress(100, 'Upload completed.');
+    return this_s3upload.onFinishS3Put(public_url);
+  });
+};
+
 S3Upload.prototype.uploadFile = function(file) {
   var this_s3upload;
   this_s3upload = this;
-  return this.executeOnSignedUrl(file, function(signedURL, publicURL) {
-    return this_s3upload.uploadToS3(file, signedURL, publicURL);
+  if (file.size > this.multipart_threshold) {
+    return this.uploadMultipart(file);
+  }
+  return this.checksumFile(file, 0, function(sums) {
+    this_s3upload.checksums[this_s3upload.uploadFingerprint(file)] = sums;
+    return this_s3upload.executeOnSignedUrl(file, function(signedURL, publicURL, signedHeaders, key, fields) {
+      if (fields) {
+        return this_s3upload.postToS3(file, signedURL, publicURL, fields, key);
+      }
+      return this_s3upload.uploadToS3(file, signedURL, publicURL, signedHeaders, key);
+    });
+  });
+};
+
+// checksumFile calculates the base64 md5 & hex sha256 digests of file in a
+// web worker, along with the md5 of each partSize chunk for multipart
+// uploads. The server signs the md5s into the upload, so S3 rejects the file
+// or part if it's corrupted on the way, and records both digests. Browsers
+// without worker support upload without checksums, calling back with null
+S3Upload.prototype.checksumFile = function(file, partSize, callback) {
+  var this_s3upload = this, worker;
+  if (!this.checksum_worker_url || typeof Worker === "undefined") {
+    return callback(null);
+  }
+
+  try {
+    worker = new Worker(this.checksum_worker_url);
+  } catch (error) {
+    console.log('unable to start checksum worker', error);
+    return callback(null);
+  }
+
+  worker.onmessage = function(e) {
+    if (e.data.progress !== undefined) {
+      return this_s3upload.onProgress(Math.round(e.data.progress * 100), 'Calculating checksum.');
+    }
+    worker.terminate();
+    if (e.data.error) {
+      console.log('checksum error', e.data.error);
+      return callback(null);
+    }
+    this_s3upload.onProgress(0, 'Checksum calculated.');
+    return callback(e.data);
+  };
+  worker.onerror = function(e) {
+    console.log('checksum worker error', e.message);
+    worker.terminate();
+    return callback(null);
+  };
+  worker.postMessage({ file : file, partSize : partSize });
+};
+
+// serverRequest issues a request to the upload server, calling back with the
+// parsed JSON response, or reporting any error to errback (onError by default)
+S3Upload.prototype.serverRequest = function(method, url, body, callback, errback) {
+  var this_s3upload, xhr;
+  this_s3upload = this;
+  errback || (errback = function(message) { return this_s3upload.onError(message); });
+  xhr = new XMLHttpRequest();
+  xhr.open(method, url, true);
+  xhr.onreadystatechange = function(e) {
+    var result;
+    if (this.readyState !== 4) {
+      return;
+    }
+    try {
+      result = JSON.parse(this.responseText);
+    } catch (error) {
+      return errback('Signing server returned some ugly/empty JSON: "' + this.responseText + '"');
+    }
+    if (this.status !== 200) {
+      return errback(result.error || ('Could not contact request signing server. Status = ' + this.status));
+    }
+    return callback(result);
+  };
+  if (body) {
+    xhr.setRequestHeader('Content-Type', 'application/json');
+    return xhr.send(JSON.stringify(body));
+  }
+  return xhr.send();
+};
+
+// partSize picks a chunk size that keeps the upload under S3's 10,000 part limit
+S3Upload.prototype.partSize = function(file) {
+  return Math.max(this.multipart_part_size, Math.ceil(file.size / 10000));
+};
+
+// uploadMultipart sends the file in chunks using a multipart upload. If an
+// earlier upload of the same file was interrupted it's resumed, otherwise a new
+// upload is started
+S3Upload.prototype.uploadMultipart = function(file) {
+  var this_s3upload = this
+    , saved = this.loadUpload(file)
+    , partSize = saved ? saved.partSize : this.partSize(file)
+    , sums;
+
+  function start () {
+    var url = this_s3upload.multipart_url + '/start?' + this_s3upload.uploadParams(file);
+    this_s3upload.serverRequest('GET', url, null, function(upload) {
+      upload.partSize = partSize;
+      this_s3upload.saveUpload(file, upload);
+      this_s3upload.sendParts(file, upload, [], sums);
+    });
+  }
+
+  // every part is checksummed up front, resumed uploads included, since the
+  // md5 of each part is signed into its upload
+  return this.checksumFile(file, partSize, function(result) {
+    sums = result;
+    this_s3upload.checksums[this_s3upload.uploadFingerprint(file)] = sums;
+    if (!saved) {
+      return start();
+    }
+    this_s3upload.resumeMultipart(file, saved, sums, start);
   });
+};
+
+// resumeMultipart carries on with a saved upload of file, or calls start if
+// it can't be resumed
+S3Upload.prototype.resumeMultipart = function(file, saved, sums, start) {
+  var this_s3upload = this;
+
+  // ask the server which parts already made it. if the upload is gone
+  // (completed, aborted or expired) forget it & start over
+  this.serverRequest('GET', this.multipart_url + '/parts?key=' + encodeURIComponent(saved.key) + '&uploadId=' + encodeURIComponent(saved.uploadId), null, function(uploaded) {
+    this_s3upload.onProgress(0, 'Resuming upload.');
+    this_s3upload.sendParts(file, saved, uploaded, sums);
+  }, function() {
+    this_s3upload.clearUpload(file);
+    start();
+  });
+};
+
+// sendParts uploads every part of file that isn't in uploaded, running up to
+// multipart_concurrency part uploads at a time, and completes the upload.
+// sums are the file's checksums from checksumFile, or null
+S3Upload.prototype.sendParts = function(file, upload, uploaded, sums) {
+  var this_s3upload = this
+    , partSize = upload.partSize
+    , total = Math.ceil(file.size / partSize)
+    , queue = []
+    , parts = []
+    , loaded = {}
+    , done = {}
+    , running = 0
+    , failed = false
+    , i;
+
+  function size (partNumber) {
+    return Math.min(partNumber * partSize, file.size) - (partNumber - 1) * partSize;
+  }
+
+  // only skip parts that are the size we expect, anything else gets re-sent
+  for (i = 0; i < uploaded.length; i++) {
+    if (uploaded[i].size === size(uploaded[i].partNumber)) {
+      done[uploaded[i].partNumber] = uploaded[i].etag;
+    }
+  }
+
+  for (i = 1; i <= total; i++) {
+    if (done[i]) {
+      parts.push({ partNumber : i, etag : done[i] });
+      loaded[i] = size(i);
+    } else {
+      queue.push(i);
+    }
+  }
+
+  function progress () {
+    var sum = 0, n;
+    for (n in loaded) {
+      sum += loaded[n];
+    }
+    var percent = Math.round((sum / file.size) * 100);
+    this_s3upload.onProgress(percent, percent === 100 ? 'Finalizing.' : 'Uploading.');
+  }
+
+  // failed uploads are left in place so they can be resumed later
+  function fail (message) {
+    if (failed) {
+      return;
+    }
+    failed = true;
+    this_s3upload.onError(message + ' Select the same file again to resume uploading.');
+  }
+
+  function next () {
+    if (failed) {
+      return;
+    }
+    if (queue.length === 0 && running === 0) {
+      return this_s3upload.completeMultipart(file, upload, parts);
+    }
+    while (running < this_s3upload.multipart_concurrency && queue.length) {
+      send(queue.shift());
+    }
+  }
+
+  function send (partNumber) {
+    var blob = file.slice((partNumber - 1) * partSize, Math.min(partNumber * partSize, file.size));
+    running++;
+    this_s3upload.uploadPart(upload, partNumber, blob, sums && sums.parts[partNumber - 1], function(loadedBytes) {
+      loaded[partNumber] = loadedBytes;
+      progress();
+    }, function(err, etag) {
+      running--;
+      if (err) {
+        return fail(err);
+      }
+      parts.push({ partNumber : partNumber, etag : etag });
+      next();
+    });
+  }
+
+  progress();
+  next();
+};
+
+// uploadFingerprint identifies a file across page reloads. browsers don't
+// expose a path, so the name, size & modification time have to do
+S3Upload.prototype.uploadFingerprint = function(file) {
+  return 'S3Upload:' + [this.dir, file.name, file.size, file.lastModified].join(':');
+};
+
+// loadUpload returns the saved multipart upload for file, if any
+S3Upload.prototype.loadUpload = function(file) {
+  try {
+    return JSON.parse(window.localStorage.getItem(this.uploadFingerprint(file)));
+  } catch (error) {
+    return null;
+  }
+};
+
+// saveUpload records an in-progress multipart upload so it can be resumed
+S3Upload.prototype.saveUpload = function(file, upload) {
+  try {
+    window.localStorage.setItem(this.uploadFingerprint(file), JSON.stringify(upload));
+  } catch (error) {
+    console.log('unable to save upload for resuming', error);
+  }
+};
+
+S3Upload.prototype.clearUpload = function(file) {
+  try {
+    window.localStorage.removeItem(this.uploadFingerprint(file));
+  } catch (error) {}
+};
+
+// uploadPart signs & uploads a single chunk of a multipart upload, retrying a
+// few times before giving up. md5 is the chunk's base64 md5 digest, signed
+// into the upload so S3 refuses a corrupted part
+S3Upload.prototype.uploadPart = function(upload, partNumber, blob, md5, onProgress, callback, attempt) {
+  var this_s3upload = this;
+  attempt = attempt || 1;
+  var url = this.multipart_url + '/sign?key=' + encodeURIComponent(upload.key) + '&uploadId=' + encodeURIComponent(upload.uploadId) + '&partNumber=' + partNumber;
+  if (md5) {
+    url += '&md5=' + encodeURIComponent(md5);
+  }
+
+  function retry (message) {
+    onProgress(0);
+    if (attempt < this_s3upload.multipart_retries) {
+      return this_s3upload.uploadPart(upload, partNumber, blob, md5, onProgress, callback, attempt + 1);
+    }
+    return callback(message);
+  }
+
+  this.serverRequest('GET', url, null, function(result) {
+    var xhr = this_s3upload.createCORSRequest('PUT', result.signedRequest), name;
+    if (!xhr) {
+      return callback('CORS not supported');
+    }
+    // signed headers like Content-MD5 must be sent exactly as given
+    for (name in result.headers || {}) {
+      xhr.setRequestHeader(name, result.headers[name]);
+    }
+    xhr.onload = function() {
+      if (xhr.status === 200) {
+        onProgress(blob.size);
+        return callback(null, xhr.getResponseHeader('ETag'));
+      }
+      return retry('Upload error: ' + xhr.status);
+    };
+    xhr.onerror = function() {
+      return retry('XHR error.');
+    };
+    xhr.upload.onprogress = function(e) {
+      if (e.lengthComputable) {
+        onProgress(e.loaded);
+      }
+    };
+    return xhr.send(blob);
+  }, retry);
+};
+
+S3Upload.prototype.completeMultipart = function(file, upload, parts) {
+  var this_s3upload = this;
+  parts.sort(function(a, b) { return a.partNumber - b.partNumber; });
+  this.serverRequest('POST', this.multipart_url + '/complete', { key : upload.key, uploadId : upload.uploadId, parts : parts }, function(result) {
+    this_s3upload.clearUpload(file);
+    this_s3upload.onProgress(100, 'Upload completed.');
+    return this_s3upload.onFinishS3Put(result.url);
+  });
+};
+
+// abortMultipart discards a saved upload for file, both locally & on the server
+S3Upload.prototype.abortMultipart = function(file, upload) {
+  this.clearUpload(file);
+  var xhr = new XMLHttpRequest();
+  xhr.open('POST', this.multipart_url + '/abort?key=' + encodeURIComponent(upload.key) + '&uploadId=' + encodeURIComponent(upload.uploadId), true);
+  return xhr.send();
 };
\ No newline at end of file
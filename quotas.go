@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// usageBucket is the bolt bucket rate limit & quota counters are kept in,
+// so they survive a restart
+var usageBucket = []byte("usage")
+
+// usage is the shared usage store, opened at startup
+var usage *UsageStore
+
+// Quota caps what can be uploaded in a day, counted from midnight UTC.
+// Quotas are set per user with USER_QUOTAS & per upload dir with
+// DIR_QUOTAS. Zero values aren't limited
+type Quota struct {
+	// DailyFiles is the number of uploads that can be requested each day
+	DailyFiles int `json:"daily_files,omitempty"`
+	// DailyBytes is the total declared size of the uploads that can be
+	// requested each day
+	DailyBytes int64 `json:"daily_bytes,omitempty"`
+}
+
+// QuotaError is returned when a request would go over a rate limit or
+// quota, responded to with a 429
+type QuotaError struct {
+	Message string
+	// RetryAfter is how long until the request would be allowed
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return e.Message
+}
+
+// usageCounter counts what a user, ip or dir has requested in a period,
+// either a minute or a day. counts from an earlier period are ignored
+type usageCounter struct {
+	Period   string `json:"period"`
+	Requests int    `json:"requests,omitempty"`
+	Files    int    `json:"files,omitempty"`
+	Bytes    int64  `json:"bytes,omitempty"`
+}
+
+// counter formats for the periods usage is counted over
+const (
+	minutePeriod = "2006-01-02T15:04"
+	dayPeriod    = "2006-01-02"
+)
+
+// UsageStore keeps rate limit & quota counters in the registry database
+type UsageStore struct {
+	db *bolt.DB
+}
+
+// newUsageStore creates a usage store in db, clearing out counters that
+// have run out
+func newUsageStore(db *bolt.DB) (*UsageStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usageBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &UsageStore{db: db}
+	return s, s.prune(time.Now().UTC())
+}
+
+// CountRequest counts a request to upload by subject, refusing with a
+// QuotaError if it goes over rateLimit requests in the current minute.
+// Every request is counted, including ones that are refused later on, so the
+// limit caps the work a requester can make the server do
+func (s *UsageStore) CountRequest(subject string, rateLimit int) error {
+	now := time.Now().UTC()
+	minute := now.Format(minutePeriod)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+
+		rate, err := getCounter(b, "rate:"+subject, minute)
+		if err != nil {
+			return err
+		}
+		rate.Requests++
+		if rateLimit > 0 && rate.Requests > rateLimit {
+			return &QuotaError{
+				Message:    fmt.Sprintf("too many requests, at most %d uploads can be requested per minute", rateLimit),
+				RetryAfter: now.Truncate(time.Minute).Add(time.Minute).Sub(now),
+			}
+		}
+		return putJSON(b, "rate:"+subject, rate)
+	})
+}
+
+// Charge counts files totalling size bytes uploaded to dir by subject,
+// refusing with a QuotaError if it goes over any daily quota. Nothing is
+// counted for refused uploads
+func (s *UsageStore) Charge(subject, dir string, files int, size int64, userQuota, dirQuota *Quota) error {
+	now := time.Now().UTC()
+	day := now.Format(dayPeriod)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+
+		tomorrow := now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+		charges := []struct {
+			key, name string
+			quota     *Quota
+		}{
+			{"user:" + subject, subject, userQuota},
+			{"dir:" + dir, fmt.Sprintf("the '%s' directory", dir), dirQuota},
+		}
+		for _, c := range charges {
+			if c.quota == nil {
+				continue
+			}
+
+			counter, err := getCounter(b, c.key, day)
+			if err != nil {
+				return err
+			}
+			counter.Files += files
+			counter.Bytes += size
+
+			if c.quota.DailyFiles > 0 && counter.Files > c.quota.DailyFiles {
+				return &QuotaError{
+					Message:    fmt.Sprintf("daily quota reached, %s can upload at most %d files per day", c.name, c.quota.DailyFiles),
+					RetryAfter: tomorrow,
+				}
+			}
+			if c.quota.DailyBytes > 0 && counter.Bytes > c.quota.DailyBytes {
+				return &QuotaError{
+					Message: fmt.Sprintf("daily quota reached, %s can upload at most %s per day, with %s left today",
+						c.name, humanBytes(c.quota.DailyBytes), humanBytes(c.quota.DailyBytes-counter.Bytes+size)),
+					RetryAfter: tomorrow,
+				}
+			}
+			if err := putJSON(b, c.key, counter); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// HoldBurner counts the burner credentials named name issued to subject
+// until they expire, refusing with a QuotaError if subject already holds
+// max unexpired credentials. max of 0 allows any number
+func (s *UsageStore) HoldBurner(subject, name string, expires time.Time, max int) error {
+	return s.updateBurners(subject, func(held map[string]time.Time) error {
+		if max > 0 && len(held) >= max {
+			retry := time.Duration(0)
+			for _, t := range held {
+				if d := t.Sub(time.Now()); retry == 0 || d < retry {
+					retry = d
+				}
+			}
+			return &QuotaError{
+				Message:    fmt.Sprintf("too many burner credentials, at most %d can be used at once", max),
+				RetryAfter: retry,
+			}
+		}
+		held[name] = expires
+		return nil
+	})
+}
+
+// ReleaseBurner stops counting burner credentials that were never issued,
+// or have been revoked
+func (s *UsageStore) ReleaseBurner(subject, name string) error {
+	return s.updateBurners(subject, func(held map[string]time.Time) error {
+		delete(held, name)
+		return nil
+	})
+}
+
+// updateBurners passes the unexpired burner credentials held by subject,
+// keyed by name, to fn to change & saves the result
+func (s *UsageStore) updateBurners(subject string, fn func(map[string]time.Time) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		key := "burners:" + subject
+
+		held := map[string]time.Time{}
+		if data := b.Get([]byte(key)); data != nil {
+			if err := json.Unmarshal(data, &held); err != nil {
+				return err
+			}
+		}
+		held = unexpired(held, time.Now())
+
+		if err := fn(held); err != nil {
+			return err
+		}
+		if len(held) == 0 {
+			return b.Delete([]byte(key))
+		}
+		return putJSON(b, key, held)
+	})
+}
+
+// prune deletes counters from before now's period & burner credentials
+// that have expired
+func (s *UsageStore) prune(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var stale [][]byte
+		err := tx.Bucket(usageBucket).ForEach(func(k, v []byte) error {
+			if strings.HasPrefix(string(k), "burners:") {
+				held := map[string]time.Time{}
+				if err := json.Unmarshal(v, &held); err != nil {
+					return err
+				}
+				if len(unexpired(held, now)) == 0 {
+					stale = append(stale, k)
+				}
+				return nil
+			}
+
+			c := &usageCounter{}
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			if c.Period != now.Format(minutePeriod) && c.Period != now.Format(dayPeriod) {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := tx.Bucket(usageBucket).Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// getCounter reads the counter stored at key, giving an empty counter if
+// there isn't one for period
+func getCounter(b *bolt.Bucket, key, period string) (*usageCounter, error) {
+	c := &usageCounter{}
+	if data := b.Get([]byte(key)); data != nil {
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, err
+		}
+	}
+	if c.Period != period {
+		c = &usageCounter{Period: period}
+	}
+	return c, nil
+}
+
+// putJSON stores v as JSON at key
+func putJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// unexpired filters out times before now
+func unexpired(times map[string]time.Time, now time.Time) map[string]time.Time {
+	kept := make(map[string]time.Time, len(times))
+	for name, t := range times {
+		if t.After(now) {
+			kept[name] = t
+		}
+	}
+	return kept
+}
+
+// userQuota gives the quota for username, falling back to the quota for
+// "*". returns nil if username isn't limited
+func userQuota(username string) *Quota {
+	if q, ok := cfg.UserQuotas[username]; ok && username != "" {
+		return q
+	}
+	return cfg.UserQuotas["*"]
+}
+
+// dirQuota gives the quota for dir, falling back to the quota for "*".
+// returns nil if dir isn't limited
+func dirQuota(dir string) *Quota {
+	if q, ok := cfg.DirQuotas[strings.Trim(dir, "/")]; ok {
+		return q
+	}
+	return cfg.DirQuotas["*"]
+}
+
+// requestSubject names who usage is counted against: the signed in user,
+// or the client's ip address for requests without one
+func requestSubject(r *http.Request) string {
+	if username := requestUsername(r); username != "" {
+		return username
+	}
+	return "ip:" + requestIP(r)
+}
+
+// requestIP gives the address of the client that made r. With TRUST_PROXY
+// set, for servers behind a proxy like heroku's router, this is the last
+// address in X-Forwarded-For, the one added by the proxy. Otherwise clients
+// can set the header to anything, so it's ignored
+func requestIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && cfg.TrustProxy {
+		addrs := strings.Split(fwd, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// requestQuotas gives the quotas for r's user & dir, either of which can
+// be nil
+func requestQuotas(r *http.Request) (*Quota, *Quota) {
+	return userQuota(requestUsername(r)), dirQuota(r.FormValue("dir"))
+}
+
+// requestQuotaSize gives the declared object_size of r's files if a byte
+// quota applies to it, or 0 if none does. The size is charged against the
+// quota, so handlers have storage hold the upload to it
+func requestQuotaSize(r *http.Request) (int64, error) {
+	uq, dq := requestQuotas(r)
+	if (uq == nil || uq.DailyBytes == 0) && (dq == nil || dq.DailyBytes == 0) {
+		return 0, nil
+	}
+
+	size, err := strconv.ParseInt(r.FormValue("object_size"), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("object_size must be given as the file's size in bytes")
+	}
+	return size, nil
+}
+
+// limitRate counts an upload request against its requester's rate limit,
+// responding with an error if it's refused. Handlers check it before doing
+// anything else, so refused requests cost as little as possible
+func limitRate(w http.ResponseWriter, r *http.Request) bool {
+	subject := requestSubject(r)
+	if err := usage.CountRequest(subject, cfg.RateLimit); err != nil {
+		denyQuota(w, subject, err)
+		return false
+	}
+	return true
+}
+
+// chargeQuotas counts an upload request against the daily quotas for its
+// user & dir, responding with an error if it's refused.
+// Each "object_name" given counts as a file, with object_size as their
+// total size. Handlers charge once they've issued a way to upload, having
+// checked object_size with requestQuotaSize
+func chargeQuotas(w http.ResponseWriter, r *http.Request) bool {
+	subject, dir := requestSubject(r), strings.Trim(r.FormValue("dir"), "/")
+	uq, dq := requestQuotas(r)
+	files := len(r.Form["object_name"])
+	if files == 0 {
+		files = 1
+	}
+
+	size, err := requestQuotaSize(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return false
+	}
+
+	if err := usage.Charge(subject, dir, files, size, uq, dq); err != nil {
+		denyQuota(w, subject, err)
+		return false
+	}
+	return true
+}
+
+// holdBurnerCredentials counts burner credentials named name expiring at
+// expires against the requester's limit, responding with an error if
+// they're over
+func holdBurnerCredentials(w http.ResponseWriter, r *http.Request, name string, expires time.Time) bool {
+	subject := requestSubject(r)
+	if err := usage.HoldBurner(subject, name, expires, cfg.MaxBurnerCredentials); err != nil {
+		denyQuota(w, subject, err)
+		return false
+	}
+	return true
+}
+
+// releaseBurnerCredentials gives back subject's hold on burner credentials
+// that couldn't be issued or have been revoked
+func releaseBurnerCredentials(subject, name string) {
+	if err := usage.ReleaseBurner(subject, name); err != nil {
+		fmt.Println("error releasing burner credentials", err)
+	}
+}
+
+// denyQuota responds to a request refused by CountRequest, Charge or
+// HoldBurner
+func denyQuota(w http.ResponseWriter, subject string, err error) {
+	qerr, ok := err.(*QuotaError)
+	if !ok {
+		fmt.Println("error counting usage", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	fmt.Printf("%s refused: %s\n", subject, qerr)
+	if qerr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(qerr.RetryAfter/time.Second)+1))
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": qerr.Error(),
+	})
+}
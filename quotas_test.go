@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRequestIP(t *testing.T) {
+	cases := []struct {
+		description  string
+		trustProxy   bool
+		forwardedFor string
+		ip           string
+	}{
+		{"no proxy", false, "", "192.0.2.1"},
+		{"forged header", false, "203.0.113.9", "192.0.2.1"},
+		{"trusted proxy", true, "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"trusted proxy without header", true, "", "192.0.2.1"},
+	}
+
+	for _, c := range cases {
+		cfg = &config{TrustProxy: c.trustProxy}
+		r := httptest.NewRequest("GET", "/token", nil)
+		if c.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		if ip := requestIP(r); ip != c.ip {
+			t.Errorf("%s: expected ip %s, got %s", c.description, c.ip, ip)
+		}
+	}
+}
+
+func TestSignS3HandlerChargesQuotas(t *testing.T) {
+	setupTest(t)
+	cfg.UserQuotas = map[string]*Quota{"*": {DailyFiles: 1, DailyBytes: 100}}
+
+	sign := func(params url.Values) (int, map[string]interface{}) {
+		params.Set("object_name", "a.txt")
+		w := httptest.NewRecorder()
+		SignS3Handler(w, httptest.NewRequest("GET", "/token?"+params.Encode(), nil), nil)
+		res := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	if status, _ := sign(url.Values{}); status != http.StatusBadRequest {
+		t.Errorf("expected a request without object_size to be refused, got status %d", status)
+	}
+	if status, _ := sign(url.Values{"object_size": {"5"}, "md5": {"not a checksum"}}); status != http.StatusBadRequest {
+		t.Errorf("expected a bad checksum to be refused, got status %d", status)
+	}
+
+	// refused requests aren't counted, so there's still a file left today
+	status, res := sign(url.Values{"object_size": {"5"}})
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", status, res)
+	}
+	signed, _ := res["signedRequest"].(string)
+	if !strings.Contains(signed, "contentLength=5") {
+		t.Errorf("expected the declared size to be signed into the upload, got %s", signed)
+	}
+
+	if status, _ := sign(url.Values{"object_size": {"5"}}); status != http.StatusTooManyRequests {
+		t.Errorf("expected a request over the daily quota to be refused, got status %d", status)
+	}
+}
+
+func TestRateLimitCountsEveryRequest(t *testing.T) {
+	setupTest(t)
+	cfg.RateLimit = 2
+
+	handlers := []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request, httprouter.Params)
+	}{
+		{"/token", SignS3Handler},
+		{"/multipart/start", MultipartStartHandler},
+	}
+	for _, h := range handlers {
+		usage.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(usageBucket).Delete([]byte("rate:ip:192.0.2.1"))
+		})
+
+		// refused requests count too, before the path is even checked
+		expect := []int{http.StatusBadRequest, http.StatusOK, http.StatusTooManyRequests}
+		for i, name := range []string{"../a.txt", "a.txt", "b.txt"} {
+			w := httptest.NewRecorder()
+			h.handler(w, httptest.NewRequest("GET", h.name+"?object_name="+name, nil), nil)
+			if w.Code != expect[i] {
+				t.Errorf("%s: expected request %d to give status %d, got %d: %s", h.name, i+1, expect[i], w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Errorf("%s: expected a Retry-After header once rate limited", h.name)
+			}
+		}
+	}
+}
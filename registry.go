@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// uploadsBucket is the bolt bucket upload records are kept in, keyed by
+// object key
+var uploadsBucket = []byte("uploads")
+
+// secretsBucket holds secrets generated by the server that need to outlive
+// a restart, keyed by name
+var secretsBucket = []byte("secrets")
+
+// registry is the shared upload registry, opened at startup
+var registry *Registry
+
+// Registry is a durable record of every upload the server has issued a
+// signed url or credentials for, and whether it was confirmed. It's kept
+// in an embedded bolt database on the server's disk, and is the audit trail
+// for who uploaded what
+type Registry struct {
+	db *bolt.DB
+}
+
+// Record is a single upload in the registry. It holds everything in the
+// upload's manifest, plus details about the request that we don't publish
+// alongside the file
+type Record struct {
+	*Manifest
+	// Requester is the username of whoever requested the upload
+	Requester string `json:"requester,omitempty"`
+	// IP is the address the upload was requested from
+	IP string `json:"ip"`
+	// ForwardedFor is the X-Forwarded-For header of the request, if any.
+	// It's set by proxies, but can also be set by clients
+	ForwardedFor string `json:"forwardedFor,omitempty"`
+	// CredentialsName & CredentialsExpire identify burner credentials
+	CredentialsName   string     `json:"credentialsName,omitempty"`
+	CredentialsExpire *time.Time `json:"credentialsExpire,omitempty"`
+}
+
+// openRegistry opens the registry database at path, creating it if
+// necessary
+func openRegistry(path string) (*Registry, error) {
+	// bolt locks the database file, time out rather than waiting forever if
+	// another server is already using it
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening registry %s: %s", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(uploadsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(secretsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Registry{db: db}, nil
+}
+
+// Secret gives the configured secret if it's set. Otherwise a random secret
+// called name is generated the first time it's needed & kept in the
+// database, so anything signed with it stays valid when the server restarts
+func (reg *Registry) Secret(name, configured string) ([]byte, error) {
+	if configured != "" {
+		return []byte(configured), nil
+	}
+
+	var secret []byte
+	err := reg.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(secretsBucket)
+		if stored := b.Get([]byte(name)); stored != nil {
+			secret = append([]byte{}, stored...)
+			return nil
+		}
+
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		return b.Put([]byte(name), secret)
+	})
+	return secret, err
+}
+
+// NewRecord creates the registry record for an upload described by m,
+// requested by r
+func NewRecord(r *http.Request, m *Manifest) *Record {
+	return &Record{
+		Manifest:     m,
+		Requester:    requestUsername(r),
+		IP:           requestIP(r),
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+	}
+}
+
+// requestedBy checks the upload rec records was requested by r's user, or
+// for requests without one from r's ip address
+func requestedBy(rec *Record, r *http.Request) bool {
+	req := NewRecord(r, nil)
+	return rec.Requester == req.Requester && (req.Requester != "" || rec.IP == req.IP)
+}
+
+// RecordUpload adds an upload's record to the registry. Handlers call this
+// whenever they hand out a way to upload. The manifest isn't written to
+// storage until the upload is confirmed, so there's never a manifest for a
+// file that doesn't exist
+func RecordUpload(rec *Record) error {
+	return registry.Put(rec)
+}
+
+// Put adds or replaces the record for an upload
+func (reg *Registry) Put(rec *Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return reg.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).Put([]byte(rec.Key), data)
+	})
+}
+
+// Get returns the record for the upload at key, or ErrNotFound
+func (reg *Registry) Get(key string) (*Record, error) {
+	rec := &Record{}
+	err := reg.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(uploadsBucket).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// UpdateManifest replaces the manifest details of a recorded upload, keeping
+// the request details. Uploads that aren't in the registry are added
+func (reg *Registry) UpdateManifest(m *Manifest) error {
+	rec, err := reg.Get(m.Key)
+	if err == ErrNotFound {
+		rec = &Record{}
+	} else if err != nil {
+		return err
+	}
+
+	rec.Manifest = m
+	return reg.Put(rec)
+}
+
+// MarkReplaced sets the status of a requested upload to ManifestReplaced,
+// reporting false if it isn't recorded or has already been confirmed or
+// replaced. An upload can only be replaced once
+func (reg *Registry) MarkReplaced(key string) (bool, error) {
+	replaced := false
+	err := reg.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(uploadsBucket)
+		data := b.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+
+		rec := &Record{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			return err
+		}
+		if rec.Manifest == nil || rec.Status != ManifestRequested {
+			return nil
+		}
+
+		rec.Status = ManifestReplaced
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		replaced = true
+		return b.Put([]byte(key), data)
+	})
+	return replaced, err
+}
+
+// RecordFilter narrows a registry listing. zero values are ignored
+type RecordFilter struct {
+	// Dir limits records to uploads within a directory
+	Dir       string
+	Status    string
+	Method    string
+	Requester string
+	// Since only includes uploads requested at or after this time
+	Since time.Time
+	// After is the key to start listing after, for paging through results
+	After string
+	// Limit caps the number of records returned
+	Limit int
+}
+
+// match reports weather rec should be included in a listing
+func (f *RecordFilter) match(rec *Record) bool {
+	return (f.Status == "" || rec.Status == f.Status) &&
+		(f.Method == "" || rec.Method == f.Method) &&
+		(f.Requester == "" || rec.Requester == f.Requester) &&
+		(f.Since.IsZero() || !rec.Requested.Before(f.Since))
+}
+
+// List returns records matching filter in key order, along with the key to
+// pass as filter.After to get the next page. next is empty on the last page
+func (reg *Registry) List(filter *RecordFilter) (records []*Record, next string, err error) {
+	prefix := []byte(dirPrefix(filter.Dir))
+	records = make([]*Record, 0)
+
+	err = reg.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(uploadsBucket).Cursor()
+
+		k, v := c.Seek(prefix)
+		if filter.After > string(prefix) {
+			k, v = c.Seek([]byte(filter.After))
+			if k != nil && string(k) == filter.After {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rec := &Record{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return fmt.Errorf("error reading registry record %s: %s", k, err)
+			}
+			if !filter.match(rec) {
+				continue
+			}
+			if filter.Limit > 0 && len(records) == filter.Limit {
+				next = records[len(records)-1].Key
+				return nil
+			}
+			records = append(records, rec)
+		}
+		return nil
+	})
+
+	return records, next, err
+}
+
+// StatusCounts totals the uploads within dir by status
+func (reg *Registry) StatusCounts(dir string) (map[string]int, error) {
+	prefix := []byte(dirPrefix(dir))
+	counts := map[string]int{}
+
+	err := reg.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(uploadsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rec := &Record{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return fmt.Errorf("error reading registry record %s: %s", k, err)
+			}
+			counts[rec.Status]++
+		}
+		return nil
+	})
+
+	return counts, err
+}
+
+// dirPrefix gives the key prefix for objects within dir. an empty dir
+// matches everything
+func dirPrefix(dir string) string {
+	dir = strings.Trim(dir, "/")
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
@@ -5,43 +5,91 @@ import (
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/julienschmidt/httprouter"
 )
 
 // SignS3Handler generates a presigned s3 url based on a given request, returning
 // a JSON output
-// The request should provide object_name (the filename) as a query parameter
+// The request should provide object_name (the filename) as a query parameter,
+// and can provide uploader, source_url, agency & notes to record the file's
+// provenance. Provenance is signed into the request as object metadata, so the
+// client must send every header listed in the response's "headers" field.
+// An md5 param with the file's base64 md5 digest is signed in as a
+// Content-MD5 header, so a corrupted upload will be rejected, and a sha256
+// param with its hex sha256 digest is recorded alongside it. Once the upload
+// has finished clients should confirm it with CompleteHandler, or if the
+// upload was refused with a 412 ask for a new path, passing the taken key
+// as "replaces".
+// Dirs with upload limits require object_size & mime_type, which are signed
+// in as Content-Length & Content-Type so storage enforces them too
 func SignS3Handler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	// response will be json, allocate an encoder that operates
 	// on the http writer
 	enc := json.NewEncoder(w)
 
+	if !limitRate(w, r) {
+		return
+	}
+
+	// check the file is allowed before using up any of an invite
+	limits, err := RequestUploadLimits(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	quotaSize, err := requestQuotaSize(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
 	// Generate the path for this request
 	path, err := RequestPath(r)
 	if err != nil {
-		fmt.Println("path error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writePathError(w, enc, err)
+		return
+	}
+
+	provenance, err := RequestProvenance(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		enc.Encode(map[string]string{
 			"error": err.Error(),
 		})
 		return
 	}
 
-	// intialize S3 service
-	svc := s3.New(session.New(&aws.Config{
-		Region:      aws.String(cfg.AwsRegion),
-		Credentials: credentials.NewStaticCredentials(cfg.AwsAccessKeyId, cfg.AwsSecretAccessKey, ""),
-	}))
+	contentMD5, err := RequestContentMD5(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	sha256, err := RequestSHA256(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
 
 	// Get an empty path
-	path, err = GetEmptyPath(svc, path)
+	path, err = GetEmptyPath(store, path, 15*time.Minute)
 	if err != nil {
 		fmt.Println("error generating filepath", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -51,19 +99,49 @@ func SignS3Handler(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		return
 	}
 
-	// Generate a put object request
-	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{
-		Bucket: aws.String(cfg.AwsS3BucketName),
-		Key:    aws.String(path),
-		ACL:    aws.String("public-read"),
-	})
-
-	// TODO - calculate md5 checksum client side?
-	// req.HTTPRequest.Header.Set("Content-MD5", checksum)
-
-	// presign the request
+	// presign an upload that will never overwrite an existing object, or
+	// with POST uploads a form for a path no one else has been given.
 	// The request must be submitted within 15 minutes of being issued.
-	url, err := req.Presign(15 * time.Minute)
+	opts := &PutOptions{
+		ContentType: r.FormValue("mime_type"),
+		NoOverwrite: true,
+		Metadata:    provenance.Metadata(),
+		ContentMD5:  contentMD5,
+	}
+	if limits != nil {
+		// have storage enforce the declared size too
+		opts.ContentLength, _ = strconv.ParseInt(r.FormValue("object_size"), 10, 64)
+		opts.MaxContentLength = limits.MaxSize
+	}
+	if quotaSize > 0 {
+		// the declared size is what's charged against a byte quota
+		opts.ContentLength = quotaSize
+	}
+	method := "signed_put"
+	if cfg.UploadMethod == "post" {
+		method = "signed_post"
+	}
+	manifest := NewManifest(r, path, method, provenance)
+	if contentMD5 != "" {
+		// record the checksum as hex, the format most tools use
+		manifest.MD5, _ = md5Hex(contentMD5)
+		opts.Metadata["md5"] = manifest.MD5
+	}
+	if sha256 != "" {
+		manifest.SHA256 = sha256
+		opts.Metadata["sha256"] = sha256
+	}
+
+	var (
+		url     string
+		headers http.Header
+		form    *PostForm
+	)
+	if cfg.UploadMethod == "post" {
+		form, err = store.PresignPost(path, opts, 15*time.Minute)
+	} else {
+		url, headers, err = store.PresignPut(path, opts, 15*time.Minute)
+	}
 	if err != nil {
 		fmt.Println("error presigning request", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -73,139 +151,227 @@ func SignS3Handler(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		return
 	}
 
-	// object url to link to post-upload (if public)
-	objectUrl := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", cfg.AwsS3BucketName, path)
-
-	// write json response
-	enc.Encode(map[string]string{
-		"signedRequest": url,
-		"url":           objectUrl,
-	})
-}
-
-func StatsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// response will be json, allocate an encoder that operates
-	// on the http writer
-	enc := json.NewEncoder(w)
+	// only uploads that were signed count against daily quotas & an invite
+	if !chargeQuotas(w, r) {
+		return
+	}
+	if !replacesUpload(r) {
+		if err := useInvite(r, 1); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			enc.Encode(map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
 
-	// trim off left & right slashes from the specified dir
-	dir := r.FormValue("dir")
-	if dir == "" {
+	if err := RecordUpload(NewRecord(r, manifest)); err != nil {
+		fmt.Println("error recording upload", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		enc.Encode(map[string]string{
-			"error": "please specifiy a 'dir' query param of the directory to list stats for",
+			"error": err.Error(),
 		})
 		return
 	}
 
-	// intialize S3 service
-	svc := s3.New(session.New(&aws.Config{
-		Region:      aws.String(cfg.AwsRegion),
-		Credentials: credentials.NewStaticCredentials(cfg.AwsAccessKeyId, cfg.AwsSecretAccessKey, ""),
-	}))
+	// object url to link to post-upload (if public)
+	objectUrl := store.ObjectURL(path)
+
+	// signed headers must be sent with the upload exactly as given
+	sendHeaders := map[string]string{}
+	for k := range headers {
+		sendHeaders[k] = headers.Get(k)
+	}
 
-	stats, err := PathStats(svc, dir)
-	if err != nil {
-		fmt.Println("error generating stats json", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		enc.Encode(map[string]string{
-			"error": err.Error(),
+	// POST uploads send the form's fields instead of headers
+	if form != nil {
+		enc.Encode(map[string]interface{}{
+			"method":        "POST",
+			"signedRequest": form.URL,
+			"url":           objectUrl,
+			"key":           path,
+			"fields":        form.Fields,
 		})
 		return
 	}
 
-	if err := enc.Encode(stats); err != nil {
-		fmt.Println("encode json error:", err.Error())
+	// write json response
+	enc.Encode(map[string]interface{}{
+		"method":        "PUT",
+		"signedRequest": url,
+		"url":           objectUrl,
+		"key":           path,
+		"headers":       sendHeaders,
+	})
+}
+
+// PathError is a request for a path the server refuses, responded to with
+// Status: a 400 for a name that can't be used, or a 403 for a dir or invite
+// the requester can't use
+type PathError struct {
+	Status  int
+	Message string
+}
+
+func (e *PathError) Error() string {
+	return e.Message
+}
+
+// writePathError responds to a request whose path couldn't be given. errors
+// other than a PathError are failures of the server's own
+func writePathError(w http.ResponseWriter, enc *json.Encoder, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*PathError); ok {
+		status = e.Status
+	} else {
+		fmt.Println("path error", err)
 	}
+	w.WriteHeader(status)
+	enc.Encode(map[string]string{
+		"error": err.Error(),
+	})
 }
 
 // RequestPath generates the path from a given request by comparing
-// any dirs specified in configuration with "dir" request param, and
-// adding that the "object_name" request param
+// the dirs the signed in user can upload to with "dir" request param, and
+// adding that the "object_name" request param. Requests made with an invite
+// that's been used up are refused, other than ones replacing an earlier upload.
+// Refused requests give a *PathError
 func RequestPath(r *http.Request) (string, error) {
+	return requestPath(r, r.FormValue("object_name"))
+}
+
+// requestPath is RequestPath for a given object name, for requests that
+// name more than one file
+func requestPath(r *http.Request, objectName string) (string, error) {
 	// trim off left & right slashes from the specified dir
 	dir := strings.Trim(r.FormValue("dir"), "/")
-	// get object name from request
-	objectName := r.FormValue("object_name")
-
-	if len(cfg.UploadDirs) > 0 {
-		for _, d := range cfg.UploadDirs {
-			if dir == strings.Trim(d, "/") {
-				return filepath.Join(dir, objectName), nil
-			}
+	if isManifest(objectName) {
+		return "", &PathError{http.StatusBadRequest, fmt.Sprintf("file names cannot end in '%s'", manifestSuffix)}
+	}
+	// names end up in scripts & headers, where control characters like
+	// newlines could add commands
+	if strings.IndexFunc(objectName, unicode.IsControl) >= 0 {
+		return "", &PathError{http.StatusBadRequest, "invalid object_name: names cannot contain control characters"}
+	}
+	// names can include subdirectories, but never climb out of dir
+	if clean := filepath.Clean(objectName); filepath.IsAbs(objectName) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", &PathError{http.StatusBadRequest, fmt.Sprintf("invalid object_name: '%s'", objectName)}
+	}
+
+	if dirs := allowedUploadDirs(r); len(dirs) > 0 {
+		if !isAllowedDir(dirs, dir) {
+			return "", &PathError{http.StatusForbidden, fmt.Sprintf("invalid directory for uploading: '%s'", dir)}
 		}
-		return "", fmt.Errorf("invalid directory for uploading: '%s'", dir)
+		objectName = filepath.Join(dir, objectName)
 	} else if dir != "" {
 		fmt.Printf("attempting to upload to directory: %s\n", dir)
-		return "", fmt.Errorf("this server does not support uploading to a directory")
+		return "", &PathError{http.StatusForbidden, "this server does not support uploading to a directory"}
+	}
+	// storage checks keys the same way, so every path that's signed can be
+	// uploaded to
+	if objectName != "" {
+		objectName = filepath.ToSlash(filepath.Clean(objectName))
+		if err := checkKey(objectName); err != nil {
+			return "", &PathError{http.StatusBadRequest, err.Error()}
+		}
+	}
+
+	if inv := requestInvite(r); inv != nil && r.FormValue("replaces") == "" {
+		if err := inv.usable(); err != nil {
+			return "", &PathError{http.StatusForbidden, err.Error()}
+		}
 	}
 
 	return objectName, nil
 }
 
+// replacesUpload checks the optional "replaces" request param, the key of an
+// earlier upload whose path was taken by another file before it arrived. The
+// upload page asks for a new path with it after a 412, so the new path
+// doesn't count as another file. The earlier upload must have been requested
+// by the same user & still be unconfirmed, with a file at its key that isn't
+// the one declared. It's marked replaced, so it can't be replaced again
+func replacesUpload(r *http.Request) bool {
+	key := r.FormValue("replaces")
+	if key == "" {
+		return false
+	}
+
+	rec, err := registry.Get(key)
+	if err != nil || rec.Manifest == nil || rec.Status != ManifestRequested {
+		return false
+	}
+	if !requestedBy(rec, r) {
+		return false
+	}
+
+	// a file that matches what was declared is the earlier upload itself
+	obj, err := store.Head(key)
+	if err != nil || len(verifyUpload(rec.Manifest, obj)) == 0 {
+		return false
+	}
+
+	replaced, err := registry.MarkReplaced(key)
+	if err != nil {
+		fmt.Println("error replacing upload", err)
+	}
+	return replaced
+}
+
 // GetEmptyPath finds an untaken path in the bucket.
-// It examines the contents of the bucket & compares it to the desired path
-// it will then append increasing numeric suffixes until an empty filepath is found
-// and return the resulting path
-func GetEmptyPath(svc *s3.S3, path string) (string, error) {
-	i := 0
-	// Strip off the file extension and any existing numeric suffixes
-	base := strings.TrimSuffix(strings.TrimSuffix(path, filepath.Ext(path)), fmt.Sprintf("_%d", i))
+// It lists every object in the bucket that shares the desired path's base name,
+// then picks the desired path if it's free, or appends the lowest numeric
+// suffix that gives a free path. Paths handed out by GetEmptyPath are reserved
+// for the reserveFor duration, so concurrent requests for the same name never
+// receive the same path, even before anything has been uploaded to it.
+func GetEmptyPath(svc Storage, path string, reserveFor time.Duration) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
 
 	// request a list of objects that contain this base address
 	// for much of the time, this will return an empty list
-	res, err := svc.ListObjects(&s3.ListObjectsInput{
-		Bucket: aws.String(cfg.AwsS3BucketName),
-		Prefix: aws.String(base),
-	})
-
+	objects, err := svc.List(base)
 	if err != nil {
 		return path, err
 	}
 
-	// taken indicates weather path is taken
-	taken := true
-	for taken {
-		taken = false
-		// iterate over the returned object names that match the base prefix
-		for i, o := range res.Contents {
-			// if the object's key matches the path, we set taken to true
-			// increment the path, and loop again with the new path
-			if *o.Key == path {
-				taken = true
-				path = fmt.Sprintf("%s_%d%s", base, i+1, filepath.Ext(path))
-				i++
-				break
-			}
-		}
+	taken := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		taken[o.Key] = true
 	}
 
-	return path, nil
+	return reservedPaths.reserve(base, ext, taken, reserveFor), nil
 }
 
-type Stat struct {
-	Created time.Time `json:"created"`
-	Size    int64     `json:"size"`
+// reservedPaths tracks paths recently issued by GetEmptyPath
+var reservedPaths = &pathReservations{paths: map[string]time.Time{}}
+
+// pathReservations is a set of paths with expiry times, safe for
+// concurrent use
+type pathReservations struct {
+	sync.Mutex
+	paths map[string]time.Time
 }
 
-func PathStats(svc *s3.S3, path string) ([]*Stat, error) {
-	res, err := svc.ListObjects(&s3.ListObjectsInput{
-		Bucket: aws.String(cfg.AwsS3BucketName),
-		Prefix: aws.String(path),
-	})
+// reserve picks the first of base+ext, base_1+ext, base_2+ext... that is
+// neither taken nor already reserved, reserving it until ttl elapses
+func (p *pathReservations) reserve(base, ext string, taken map[string]bool, ttl time.Duration) string {
+	p.Lock()
+	defer p.Unlock()
 
-	if err != nil {
-		return nil, err
+	now := time.Now()
+	for path, expires := range p.paths {
+		if now.After(expires) {
+			delete(p.paths, path)
+		}
 	}
 
-	stats := make([]*Stat, 0)
-	for _, o := range res.Contents {
-		stat := &Stat{
-			Created: *o.LastModified,
-			Size:    *o.Size,
-		}
-		stats = append(stats, stat)
+	path := base + ext
+	for i := 1; taken[path] || !p.paths[path].IsZero(); i++ {
+		path = fmt.Sprintf("%s_%d%s", base, i, ext)
 	}
 
-	return stats, err
+	p.paths[path] = now.Add(ttl)
+	return path
 }
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// s3Storage is a Storage backed by an AWS S3 bucket, using STS to issue
+// temporary credentials
+type s3Storage struct {
+	bucket string
+	// endpoint is a custom S3-compatible endpoint url, blank for AWS
+	endpoint  string
+	pathStyle bool
+	// publicUrlBase overrides the url objects are linked to
+	publicUrlBase string
+	s3            *s3.S3
+	sts           *sts.STS
+	// roleArn is the role temporary credentials are issued from, blank to
+	// issue federation tokens instead
+	roleArn string
+}
+
+// newS3Storage creates S3 & STS clients from configuration
+func newS3Storage(cfg *config) *s3Storage {
+	// without access keys the sdk finds credentials in the environment
+	awsCfg := &aws.Config{Region: aws.String(cfg.AwsRegion)}
+	if cfg.AwsAccessKeyId != "" {
+		awsCfg.Credentials = credentials.NewStaticCredentials(cfg.AwsAccessKeyId, cfg.AwsSecretAccessKey, "")
+	}
+	sess := session.New(awsCfg)
+
+	// S3 & STS each have their own custom endpoint
+	stsCfg := &aws.Config{}
+	if cfg.AwsStsEndpoint != "" {
+		stsCfg.Endpoint = aws.String(cfg.AwsStsEndpoint)
+	}
+	s3Cfg := &aws.Config{
+		S3ForcePathStyle: aws.Bool(cfg.AwsS3ForcePathStyle),
+	}
+	if cfg.AwsS3Endpoint != "" {
+		s3Cfg.Endpoint = aws.String(cfg.AwsS3Endpoint)
+	}
+
+	return &s3Storage{
+		bucket:        cfg.AwsS3BucketName,
+		endpoint:      cfg.AwsS3Endpoint,
+		pathStyle:     cfg.AwsS3ForcePathStyle,
+		publicUrlBase: cfg.PublicUrlBase,
+		s3:            s3.New(sess, s3Cfg),
+		sts:           sts.New(sess, stsCfg),
+		roleArn:       cfg.BurnerRoleArn,
+	}
+}
+
+func (s *s3Storage) PresignPut(key string, opts *PutOptions, expires time.Duration) (string, http.Header, error) {
+	req := s.putObjectRequest(s.putObjectInput(key, opts), opts)
+
+	url, err := req.Presign(expires)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return url, signedHeaders(url, req.HTTPRequest.Header), nil
+}
+
+func (s *s3Storage) PutObject(key string, body io.ReadSeeker, opts *PutOptions) error {
+	input := s.putObjectInput(key, opts)
+	input.Body = body
+
+	if err := s.putObjectRequest(input, opts).Send(); err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok {
+			switch {
+			case aerr.StatusCode() == http.StatusPreconditionFailed:
+				return ErrExists
+			case aerr.Code() == "BadDigest":
+				return ErrBadDigest
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// putObjectRequest creates a PutObject request, adding the conditional &
+// checksum headers the sdk doesn't have fields for. headers set here are
+// signed when the request is presigned, so the client must send them too
+func (s *s3Storage) putObjectRequest(input *s3.PutObjectInput, opts *PutOptions) *request.Request {
+	req, _ := s.s3.PutObjectRequest(input)
+	if opts == nil {
+		return req
+	}
+
+	if opts.NoOverwrite {
+		// S3 will refuse the PUT if the key exists
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+	if opts.ContentMD5 != "" {
+		// S3 will refuse a body that doesn't match the checksum
+		req.HTTPRequest.Header.Set("Content-MD5", opts.ContentMD5)
+	}
+	if opts.ContentLength > 0 {
+		// S3 will refuse a body of any other size
+		req.HTTPRequest.Header.Set("Content-Length", strconv.FormatInt(opts.ContentLength, 10))
+	}
+
+	return req
+}
+
+// putObjectInput builds the PutObject params for key & opts
+func (s *s3Storage) putObjectInput(key string, opts *PutOptions) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		ACL:    aws.String("public-read"),
+	}
+	if opts == nil {
+		return input
+	}
+	if opts.Private {
+		input.ACL = aws.String("private")
+	}
+
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if len(opts.Metadata) > 0 {
+		input.Metadata = aws.StringMap(opts.Metadata)
+	}
+
+	return input
+}
+
+// signedHeaders picks out the headers a presigned url was signed with, which
+// the client will need to send. Host & Content-Length are left out, as
+// clients set them automatically.
+func signedHeaders(signedURL string, header http.Header) http.Header {
+	signed := http.Header{}
+
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		return signed
+	}
+
+	for _, name := range strings.Split(u.Query().Get("X-Amz-SignedHeaders"), ";") {
+		if name == "" || name == "host" || name == "content-length" {
+			continue
+		}
+		if value := header.Get(name); value != "" {
+			signed.Set(name, value)
+		}
+	}
+
+	return signed
+}
+
+// maxPostSize is the largest object S3 accepts in a single upload
+const maxPostSize = 5 << 30
+
+// PresignPost builds a POST policy that only accepts an upload to key with
+// the content type & metadata in opts, sized within the allowed range, and
+// signs it with signature version 4
+func (s *s3Storage) PresignPost(key string, opts *PutOptions, expires time.Duration) (*PostForm, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+
+	creds, err := s.s3.Config.Credentials.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	// the bucket's url, from a request the sdk addresses for us
+	req, _ := s.s3.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err := req.Build(); err != nil {
+		return nil, err
+	}
+	u := *req.HTTPRequest.URL
+	u.RawQuery = ""
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	region := aws.StringValue(s.s3.Config.Region)
+	fields := map[string]string{
+		"key":              key,
+		"acl":              "public-read",
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": fmt.Sprintf("%s/%s/%s/s3/aws4_request", creds.AccessKeyID, date, region),
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	if opts.ContentType != "" {
+		fields["Content-Type"] = opts.ContentType
+	}
+	for k, v := range opts.Metadata {
+		fields["x-amz-meta-"+strings.ToLower(k)] = v
+	}
+
+	// every field must match exactly, sorted so policies are repeatable
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	conditions := []interface{}{map[string]string{"bucket": s.bucket}}
+	for _, name := range names {
+		conditions = append(conditions, map[string]string{name: fields[name]})
+	}
+
+	min, max := int64(0), int64(maxPostSize)
+	if opts.MaxContentLength > 0 && opts.MaxContentLength < max {
+		max = opts.MaxContentLength
+	}
+	if opts.ContentLength > 0 {
+		min, max = opts.ContentLength, opts.ContentLength
+	}
+	conditions = append(conditions, []interface{}{"content-length-range", min, max})
+
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": now.Add(expires).Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+	fields["x-amz-signature"] = hex.EncodeToString(postSignature(creds.SecretAccessKey, date, region, fields["policy"]))
+
+	return &PostForm{URL: u.String(), Fields: fields}, nil
+}
+
+// postSignature signs an encoded POST policy with the signature version 4
+// key derived for date & region
+func postSignature(secret, date, region, policy string) []byte {
+	sum := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+
+	key := sum([]byte("AWS4"+secret), date)
+	key = sum(key, region)
+	key = sum(key, "s3")
+	key = sum(key, "aws4_request")
+	return sum(key, policy)
+}
+
+// List returns all objects matching prefix, paging through results
+func (s *s3Storage) List(prefix string) ([]*Object, error) {
+	objects := make([]*Object, 0)
+	err := s.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			objects = append(objects, &Object{
+				Key:          aws.StringValue(o.Key),
+				Size:         aws.Int64Value(o.Size),
+				LastModified: aws.TimeValue(o.LastModified),
+				ETag:         aws.StringValue(o.ETag),
+				StorageClass: aws.StringValue(o.StorageClass),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// ListDir pages through prefix with a delimiter, so subdirectories are
+// rolled up by S3 rather than listed. pages are continued with S3's
+// continuation token
+func (s *s3Storage) ListDir(prefix, after string, limit int) (*Listing, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(int64(limit)),
+	}
+	if after != "" {
+		input.ContinuationToken = aws.String(after)
+	}
+	page, err := s.s3.ListObjectsV2(input)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listing{Objects: make([]*Object, 0), Dirs: make([]string, 0)}
+	for _, o := range page.Contents {
+		l.Objects = append(l.Objects, &Object{
+			Key:          aws.StringValue(o.Key),
+			Size:         aws.Int64Value(o.Size),
+			LastModified: aws.TimeValue(o.LastModified),
+			ETag:         aws.StringValue(o.ETag),
+			StorageClass: aws.StringValue(o.StorageClass),
+		})
+	}
+	for _, p := range page.CommonPrefixes {
+		l.Dirs = append(l.Dirs, aws.StringValue(p.Prefix))
+	}
+	if aws.BoolValue(page.IsTruncated) {
+		l.Next = aws.StringValue(page.NextContinuationToken)
+	}
+	return l, nil
+}
+
+func (s *s3Storage) Head(key string) (*Object, error) {
+	res, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &Object{
+		Key:          key,
+		Size:         aws.Int64Value(res.ContentLength),
+		LastModified: aws.TimeValue(res.LastModified),
+		ETag:         aws.StringValue(res.ETag),
+		ContentType:  aws.StringValue(res.ContentType),
+		Metadata:     aws.StringValueMap(res.Metadata),
+	}, nil
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, error) {
+	res, err := s.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+// TempCredentials issues a federation token from the configured aws user,
+// or assumes the configured role, limited by a policy granting only scope
+func (s *s3Storage) TempCredentials(name string, scope *CredentialScope, duration time.Duration) (*Credentials, error) {
+	policy, err := BurnerPolicyDocument(s.bucket, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds *sts.Credentials
+	if s.roleArn != "" {
+		creds, err = s.assumeRole(name, policy, scope.Tags, duration)
+	} else {
+		var res *sts.GetFederationTokenOutput
+		res, err = s.sts.GetFederationToken(&sts.GetFederationTokenInput{
+			DurationSeconds: aws.Int64(int64(duration / time.Second)),
+			Name:            aws.String(name),
+			Policy:          aws.String(policy),
+		})
+		if res != nil {
+			creds = res.Credentials
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credentials{
+		AccessKeyId:     aws.StringValue(creds.AccessKeyId),
+		SecretAccessKey: aws.StringValue(creds.SecretAccessKey),
+		SessionToken:    aws.StringValue(creds.SessionToken),
+		Expiration:      aws.TimeValue(creds.Expiration),
+	}, nil
+}
+
+// assumeRole assumes the configured role as session name, with policy as
+// the session policy. The session's permissions are those both the role &
+// policy allow
+func (s *s3Storage) assumeRole(name, policy string, tags map[string]string, duration time.Duration) (*sts.Credentials, error) {
+	req, res := s.sts.AssumeRoleRequest(&sts.AssumeRoleInput{
+		DurationSeconds: aws.Int64(int64(duration / time.Second)),
+		RoleArn:         aws.String(s.roleArn),
+		RoleSessionName: aws.String(name),
+		Policy:          aws.String(policy),
+	})
+	if len(tags) > 0 {
+		req.Handlers.Build.PushBack(func(r *request.Request) {
+			addSessionTags(r, tags)
+		})
+	}
+
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	return res.Credentials, nil
+}
+
+// addSessionTags adds tags to a built AssumeRole request. The sdk predates
+// session tags, so they're appended to the encoded params. values are
+// trimmed to the characters & length STS accepts
+func addSessionTags(r *request.Request, tags map[string]string) {
+	if r.Error != nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		r.Error = err
+		return
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := url.Values{}
+	for i, k := range keys {
+		params.Set(fmt.Sprintf("Tags.member.%d.Key", i+1), sessionTagValue(k, 128))
+		params.Set(fmt.Sprintf("Tags.member.%d.Value", i+1), sessionTagValue(tags[k], 256))
+	}
+	r.SetBufferBody([]byte(string(body) + "&" + params.Encode()))
+}
+
+// sessionTagValue replaces characters session tags can't contain with "_",
+// truncating to max characters
+func sessionTagValue(value string, max int) string {
+	tag := []rune(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || strings.ContainsRune("_.:/=+-@", r) {
+			return r
+		}
+		return '_'
+	}, value))
+	if len(tag) > max {
+		tag = tag[:max]
+	}
+	return string(tag)
+}
+
+// revokedCredentialsSid identifies the bucket policy statement that denies
+// revoked credentials
+const revokedCredentialsSid = "UploadServerRevokedCredentials"
+
+// maxBucketPolicySize is the largest bucket policy S3 accepts, in bytes
+const maxBucketPolicySize = 20 * 1024
+
+// DenyCredentials adds a statement to the bucket policy denying every
+// request from the named federated users & role sessions, whose aws:userid
+// ends in ":[name]". The rest of the bucket policy is left as it is
+func (s *s3Storage) DenyCredentials(names []string) error {
+	policy := map[string]interface{}{}
+	res, err := s.s3.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: aws.String(s.bucket)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NoSuchBucketPolicy" {
+			return err
+		}
+	} else if err := json.Unmarshal([]byte(aws.StringValue(res.Policy)), &policy); err != nil {
+		return fmt.Errorf("error reading bucket policy: %s", err)
+	}
+
+	// keep every statement but the last list of denied credentials
+	var statements []interface{}
+	switch st := policy["Statement"].(type) {
+	case []interface{}:
+		for _, stmt := range st {
+			if m, ok := stmt.(map[string]interface{}); !ok || m["Sid"] != revokedCredentialsSid {
+				statements = append(statements, stmt)
+			}
+		}
+	case map[string]interface{}:
+		if st["Sid"] != revokedCredentialsSid {
+			statements = append(statements, st)
+		}
+	}
+
+	if len(names) > 0 {
+		userIds := make([]string, len(names))
+		for i, name := range names {
+			userIds[i] = "*:" + name
+		}
+		statements = append(statements, &PolicyStatement{
+			Sid:       revokedCredentialsSid,
+			Effect:    "Deny",
+			Principal: "*",
+			Action:    []string{"s3:*"},
+			Resource:  []string{"arn:aws:s3:::" + s.bucket, "arn:aws:s3:::" + s.bucket + "/*"},
+			Condition: map[string]map[string][]string{
+				"StringLike": {"aws:userid": userIds},
+			},
+		})
+	}
+
+	if len(statements) == 0 {
+		_, err := s.s3.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{Bucket: aws.String(s.bucket)})
+		return err
+	}
+
+	policy["Statement"] = statements
+	if policy["Version"] == nil {
+		policy["Version"] = "2012-10-17"
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxBucketPolicySize {
+		return fmt.Errorf("bucket policy would be %d bytes denying %d credentials, over S3's limit of %d", len(data), len(names), maxBucketPolicySize)
+	}
+
+	_, err = s.s3.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(s.bucket),
+		Policy: aws.String(string(data)),
+	})
+	return err
+}
+
+// ObjectURL builds an object's url from the public url base if one is set,
+// otherwise from the endpoint & addressing style
+func (s *s3Storage) ObjectURL(key string) string {
+	if s.publicUrlBase != "" {
+		return fmt.Sprintf("%s/%s", strings.TrimRight(s.publicUrlBase, "/"), key)
+	}
+
+	endpoint := s.endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		// fall back to treating the endpoint as a bare hostname
+		u = &url.URL{Scheme: "https", Host: endpoint}
+	}
+
+	if s.pathStyle {
+		u.Path = fmt.Sprintf("/%s/%s", s.bucket, key)
+	} else {
+		u.Host = fmt.Sprintf("%s.%s", s.bucket, u.Host)
+		u.Path = "/" + key
+	}
+
+	return u.String()
+}
+
+func (s *s3Storage) CreateMultipartUpload(key string, opts *PutOptions) (string, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		ACL:    aws.String("public-read"),
+	}
+	if opts != nil {
+		if opts.ContentType != "" {
+			input.ContentType = aws.String(opts.ContentType)
+		}
+		if len(opts.Metadata) > 0 {
+			input.Metadata = aws.StringMap(opts.Metadata)
+		}
+	}
+
+	res, err := s.s3.CreateMultipartUpload(input)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(res.UploadId), nil
+}
+
+func (s *s3Storage) PresignUploadPart(key, uploadId string, partNumber int64, contentMD5 string, expires time.Duration) (string, http.Header, error) {
+	req, _ := s.s3.UploadPartRequest(&s3.UploadPartInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadId),
+		PartNumber: aws.Int64(partNumber),
+	})
+	if contentMD5 != "" {
+		// S3 will refuse a part that doesn't match the checksum. the sdk
+		// has no field for it, and headers set here are signed
+		req.HTTPRequest.Header.Set("Content-MD5", contentMD5)
+	}
+
+	url, err := req.Presign(expires)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return url, signedHeaders(url, req.HTTPRequest.Header), nil
+}
+
+func (s *s3Storage) ListParts(key, uploadId string) ([]*Part, error) {
+	parts := make([]*Part, 0)
+	err := s.s3.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			parts = append(parts, &Part{
+				PartNumber: aws.Int64Value(p.PartNumber),
+				ETag:       aws.StringValue(p.ETag),
+				Size:       aws.Int64Value(p.Size),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchUpload" {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+func (s *s3Storage) CompleteMultipartUpload(key, uploadId string, parts []*Part) error {
+	completed := make([]*s3.CompletedPart, len(parts))
+	for i, p := range parts {
+		completed[i] = &s3.CompletedPart{
+			PartNumber: aws.Int64(p.PartNumber),
+			ETag:       aws.String(p.ETag),
+		}
+	}
+
+	req, _ := s.s3.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+
+	if err := req.Send(); err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusPreconditionFailed {
+			return ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *s3Storage) AbortMultipartUpload(key, uploadId string) error {
+	_, err := s.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	})
+	return err
+}
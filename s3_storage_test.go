@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSTS starts a stand-in STS endpoint that answers AssumeRole &
+// GetFederationToken, passing each request's params to got
+func newTestSTS(t *testing.T, got func(url.Values)) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		got(r.PostForm)
+
+		action := r.PostForm.Get("Action")
+		fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><%[1]sResult><Credentials>
+<AccessKeyId>ASIATEST</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>
+<Expiration>%[2]s</Expiration></Credentials></%[1]sResult></%[1]sResponse>`, action, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestS3Storage(stsEndpoint, roleArn string) *s3Storage {
+	return newS3Storage(&config{
+		AwsRegion:          "us-east-1",
+		AwsS3BucketName:    "bucket",
+		AwsAccessKeyId:     "AKIATEST",
+		AwsSecretAccessKey: "secret",
+		AwsStsEndpoint:     stsEndpoint,
+		BurnerRoleArn:      roleArn,
+	})
+}
+
+// policyResources gives the resources of every statement in a policy document
+func policyResources(t *testing.T, policy string) []string {
+	doc := struct {
+		Statement []struct {
+			Resource []string
+		}
+	}{}
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		t.Fatalf("error reading policy %s: %s", policy, err)
+	}
+	var resources []string
+	for _, stmt := range doc.Statement {
+		resources = append(resources, stmt.Resource...)
+	}
+	return resources
+}
+
+func TestTempCredentialsAssumeRole(t *testing.T) {
+	var params url.Values
+	srv := newTestSTS(t, func(p url.Values) { params = p })
+	s := newTestS3Storage(srv.URL, "arn:aws:iam::123456789012:role/uploader")
+
+	creds, err := s.TempCredentials("burner-1", &CredentialScope{
+		Keys: []string{"docs/a.txt"},
+		Tags: map[string]string{
+			"uploader":   "ip:192.0.2.1",
+			"dir":        "docs",
+			"request-id": "burner-1",
+			"note":       strings.Repeat("é", 300) + "<script>",
+		},
+	}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyId != "ASIATEST" || creds.SessionToken != "token" {
+		t.Errorf("expected the credentials sts returned, got %+v", creds)
+	}
+
+	expect := map[string]string{
+		"Action":          "AssumeRole",
+		"RoleArn":         "arn:aws:iam::123456789012:role/uploader",
+		"RoleSessionName": "burner-1",
+		"DurationSeconds": "3600",
+		// tags are sorted by key
+		"Tags.member.1.Key":   "dir",
+		"Tags.member.1.Value": "docs",
+		"Tags.member.2.Key":   "note",
+		"Tags.member.2.Value": strings.Repeat("é", 256),
+		"Tags.member.3.Key":   "request-id",
+		"Tags.member.3.Value": "burner-1",
+		"Tags.member.4.Key":   "uploader",
+		"Tags.member.4.Value": "ip:192.0.2.1",
+	}
+	for k, v := range expect {
+		if params.Get(k) != v {
+			t.Errorf("expected %s to be '%s', got '%s'", k, v, params.Get(k))
+		}
+	}
+	if params.Get("Tags.member.5.Key") != "" {
+		t.Errorf("expected 4 tags, got a fifth: %s", params.Get("Tags.member.5.Key"))
+	}
+	if resources := policyResources(t, params.Get("Policy")); len(resources) != 1 || resources[0] != "arn:aws:s3:::bucket/docs/a.txt" {
+		t.Errorf("expected the policy to only allow docs/a.txt, got %v", resources)
+	}
+}
+
+func TestTempCredentialsFederationToken(t *testing.T) {
+	var params url.Values
+	srv := newTestSTS(t, func(p url.Values) { params = p })
+	s := newTestS3Storage(srv.URL, "")
+
+	_, err := s.TempCredentials("burner-1", &CredentialScope{
+		Prefix: "docs/0a1b2c/",
+		Tags:   map[string]string{"dir": "docs"},
+	}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"Action":          "GetFederationToken",
+		"Name":            "burner-1",
+		"DurationSeconds": "86400",
+	}
+	for k, v := range expect {
+		if params.Get(k) != v {
+			t.Errorf("expected %s to be '%s', got '%s'", k, v, params.Get(k))
+		}
+	}
+	for k := range params {
+		if strings.HasPrefix(k, "Tags.") {
+			t.Errorf("expected federation tokens not to be tagged, got %s", k)
+		}
+	}
+	if resources := policyResources(t, params.Get("Policy")); len(resources) != 1 || resources[0] != "arn:aws:s3:::bucket/docs/0a1b2c/*" {
+		t.Errorf("expected the policy to only allow the prefix, got %v", resources)
+	}
+}
+
+func TestSessionTagValue(t *testing.T) {
+	cases := []struct {
+		value, tag string
+		max        int
+	}{
+		{"ip:192.0.2.1", "ip:192.0.2.1", 256},
+		{"user@example.org", "user@example.org", 256},
+		{"a<b>&c", "a_b__c", 256},
+		{"abcdef", "abc", 3},
+	}
+	for _, c := range cases {
+		if tag := sessionTagValue(c.value, c.max); tag != c.tag {
+			t.Errorf("expected '%s' to be tagged as '%s', got '%s'", c.value, c.tag, tag)
+		}
+	}
+}
+
+func TestDenyCredentials(t *testing.T) {
+	existing := `{"Version":"2012-10-17","Statement":[{"Sid":"PublicRead","Effect":"Allow","Principal":"*","Action":["s3:GetObject"],"Resource":["arn:aws:s3:::bucket/*"]}]}`
+	var put string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.Method {
+		case "GET":
+			w.Write([]byte(existing))
+		case "PUT":
+			put = string(body)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	s := newS3Storage(&config{
+		AwsRegion:           "us-east-1",
+		AwsS3BucketName:     "bucket",
+		AwsAccessKeyId:      "AKIATEST",
+		AwsSecretAccessKey:  "secret",
+		AwsS3Endpoint:       srv.URL,
+		AwsS3ForcePathStyle: true,
+	})
+
+	if err := s.DenyCredentials([]string{"burner-1", "burner-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(put, `"Sid":"PublicRead"`) {
+		t.Errorf("expected the rest of the bucket policy to be kept, got %s", put)
+	}
+	if !strings.Contains(put, `"aws:userid":["*:burner-1","*:burner-2"]`) {
+		t.Errorf("expected both credentials to be denied, got %s", put)
+	}
+
+	// a policy S3 would refuse isn't sent
+	put = ""
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("burner-%032d", i)
+	}
+	if err := s.DenyCredentials(names); err == nil {
+		t.Error("expected a bucket policy over 20KB to be refused")
+	}
+	if put != "" {
+		t.Error("expected a bucket policy over 20KB not to be sent")
+	}
+}
+
+func TestPresignUploadPartSignsMD5(t *testing.T) {
+	s := newTestS3Storage("", "")
+	sum := base64MD5("part one")
+
+	signed, headers, err := s.PresignUploadPart("docs/a.bin", "upload-1", 2, sum, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(u.Query().Get("X-Amz-SignedHeaders"), "content-md5") {
+		t.Errorf("expected Content-MD5 to be signed, got %s", u.Query().Get("X-Amz-SignedHeaders"))
+	}
+	if headers.Get("Content-MD5") != sum {
+		t.Errorf("expected the client to be told to send Content-MD5 %s, got %v", sum, headers)
+	}
+
+	_, headers, err = s.PresignUploadPart("docs/a.bin", "upload-1", 2, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 0 {
+		t.Errorf("expected no headers without a checksum, got %v", headers)
+	}
+}
+
+func TestPostSignature(t *testing.T) {
+	cases := []struct {
+		secret, date, region, policy string
+		signature                    string
+	}{
+		// the example from AWS's "Example: Browser-Based Upload using HTTP POST" docs
+		{"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "20151229", "us-east-1", "eyAiZXhwaXJhdGlvbiI6ICIyMDE1LTEyLTMwVDEyOjAwOjAwLjAwMFoiLA0KICAiY29uZGl0aW9ucyI6IFsNCiAgICB7ImJ1Y2tldCI6ICJzaWd2NGV4YW1wbGVidWNrZXQifSwNCiAgICBbInN0YXJ0cy13aXRoIiwgIiRrZXkiLCAidXNlci91c2VyMS8iXSwNCiAgICB7ImFjbCI6ICJwdWJsaWMtcmVhZCJ9LA0KICAgIHsic3VjY2Vzc19hY3Rpb25fcmVkaXJlY3QiOiAiaHR0cDovL3NpZ3Y0ZXhhbXBsZWJ1Y2tldC5zMy5hbWF6b25hd3MuY29tL3N1Y2Nlc3NmdWxfdXBsb2FkLmh0bWwifSwNCiAgICBbInN0YXJ0cy13aXRoIiwgIiRDb250ZW50LVR5cGUiLCAiaW1hZ2UvIl0sDQogICAgeyJ4LWFtei1tZXRhLXV1aWQiOiAiMTQzNjUxMjM2NTEyNzQifSwNCiAgICB7IngtYW16LXNlcnZlci1zaWRlLWVuY3J5cHRpb24iOiAiQUVTMjU2In0sDQogICAgWyJzdGFydHMtd2l0aCIsICIkeC1hbXotbWV0YS10YWciLCAiIl0sDQoNCiAgICB7IngtYW16LWNyZWRlbnRpYWwiOiAiQUtJQUlPU0ZPRE5ON0VYQU1QTEUvMjAxNTEyMjkvdXMtZWFzdC0xL3MzL2F3czRfcmVxdWVzdCJ9LA0KICAgIHsieC1hbXotYWxnb3JpdGhtIjogIkFXUzQtSE1BQy1TSEEyNTYifSwNCiAgICB7IngtYW16LWRhdGUiOiAiMjAxNTEyMjlUMDAwMDAwWiIgfQ0KICBdDQp9", "8afdbf4008c03f22c2cd3cdb72e4afbb1f6a588f3255ac628749a66d7f09699e"},
+		{"secret", "20170220", "us-west-2", "eyJjb25kaXRpb25zIjpbXX0=", "d1c4313a994db77ccff3cce114895d979979d171b333fcf2c1f1c3b1c452ae9f"},
+	}
+	for _, c := range cases {
+		if got := hex.EncodeToString(postSignature(c.secret, c.date, c.region, c.policy)); got != c.signature {
+			t.Errorf("%s %s: expected signature %s, got %s", c.date, c.region, c.signature, got)
+		}
+	}
+}
+
+func TestPresignPost(t *testing.T) {
+	s := newTestS3Storage("", "")
+
+	cases := []struct {
+		description string
+		opts        *PutOptions
+		// fields lists the form fields expected besides the signing fields
+		fields   map[string]string
+		min, max int64
+	}{
+		{"no options", nil, map[string]string{}, 0, maxPostSize},
+		{"content type & metadata", &PutOptions{
+			ContentType: "text/csv",
+			Metadata:    map[string]string{"Uploader": "jo", "md5": "5d41402abc4b2a76b9719d911017c592"},
+		}, map[string]string{
+			"Content-Type":        "text/csv",
+			"x-amz-meta-uploader": "jo",
+			"x-amz-meta-md5":      "5d41402abc4b2a76b9719d911017c592",
+		}, 0, maxPostSize},
+		{"max size", &PutOptions{MaxContentLength: 1024}, map[string]string{}, 0, 1024},
+		{"max size over the largest upload", &PutOptions{MaxContentLength: maxPostSize + 1}, map[string]string{}, 0, maxPostSize},
+		{"exact size", &PutOptions{ContentLength: 5, MaxContentLength: 1024}, map[string]string{}, 5, 5},
+	}
+	for _, c := range cases {
+		form, err := s.PresignPost("docs/a b.csv", c.opts, time.Hour)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.description, err)
+			continue
+		}
+		if form.URL != "https://bucket.s3.amazonaws.com/" {
+			t.Errorf("%s: expected the bucket's url, got %s", c.description, form.URL)
+		}
+
+		expect := map[string]string{"key": "docs/a b.csv", "acl": "public-read", "x-amz-algorithm": "AWS4-HMAC-SHA256"}
+		for k, v := range c.fields {
+			expect[k] = v
+		}
+		for k, v := range expect {
+			if form.Fields[k] != v {
+				t.Errorf("%s: expected field %s: %q, got %q", c.description, k, v, form.Fields[k])
+			}
+		}
+		date := form.Fields["x-amz-date"][:8]
+		if cred := form.Fields["x-amz-credential"]; cred != "AKIATEST/"+date+"/us-east-1/s3/aws4_request" {
+			t.Errorf("%s: unexpected credential %s", c.description, cred)
+		}
+		if sig := hex.EncodeToString(postSignature("secret", date, "us-east-1", form.Fields["policy"])); form.Fields["x-amz-signature"] != sig {
+			t.Errorf("%s: expected signature %s, got %s", c.description, sig, form.Fields["x-amz-signature"])
+		}
+
+		data, err := base64.StdEncoding.DecodeString(form.Fields["policy"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy := struct {
+			Expiration time.Time
+			Conditions []interface{}
+		}{}
+		if err := json.Unmarshal(data, &policy); err != nil {
+			t.Fatalf("%s: error reading policy %s: %s", c.description, data, err)
+		}
+		if d := time.Until(policy.Expiration); d < 59*time.Minute || d > time.Hour {
+			t.Errorf("%s: expected the policy to expire in an hour, got %s", c.description, policy.Expiration)
+		}
+
+		// every field but the policy & its signature must be an exact match
+		conditions := map[string]bool{}
+		for _, cond := range policy.Conditions {
+			conditions[fmt.Sprint(cond)] = true
+		}
+		for k, v := range form.Fields {
+			if k != "policy" && k != "x-amz-signature" && !conditions[fmt.Sprint(map[string]interface{}{k: v})] {
+				t.Errorf("%s: expected the policy to require %s: %q, got %s", c.description, k, v, data)
+			}
+		}
+		if !conditions["map[bucket:bucket]"] {
+			t.Errorf("%s: expected the policy to require the bucket, got %s", c.description, data)
+		}
+		if lengths := fmt.Sprint([]interface{}{"content-length-range", float64(c.min), float64(c.max)}); !conditions[lengths] {
+			t.Errorf("%s: expected the policy to require %s, got %s", c.description, lengths, data)
+		}
+		if len(policy.Conditions) != len(form.Fields) {
+			t.Errorf("%s: expected only the form's fields, bucket & size to be in the policy, got %s", c.description, data)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignS3HandlerPathErrors(t *testing.T) {
+	setupTest(t)
+	cfg.UploadDirs = []string{"docs"}
+	inv, err := invites.Create("docs", 1, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := invites.Token(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := invites.Use(inv.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	handler := middleware(SignS3Handler, ScopeSign)
+
+	cases := []struct {
+		description string
+		params      url.Values
+		status      int
+	}{
+		{"allowed", url.Values{"dir": {"docs"}, "object_name": {"a.txt"}}, http.StatusOK},
+		{"climbs out of dir", url.Values{"dir": {"docs"}, "object_name": {"../a.txt"}}, http.StatusBadRequest},
+		{"control character", url.Values{"dir": {"docs"}, "object_name": {"a\nb.txt"}}, http.StatusBadRequest},
+		{"manifest", url.Values{"dir": {"docs"}, "object_name": {"a.txt" + manifestSuffix}}, http.StatusBadRequest},
+		{"other dir", url.Values{"dir": {"other"}, "object_name": {"a.txt"}}, http.StatusForbidden},
+		{"used up invite", url.Values{"dir": {"docs"}, "object_name": {"a.txt"}, "invite": {token}}, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/token?"+c.params.Encode(), nil), nil)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d: %s", c.description, c.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestGetEmptyPath(t *testing.T) {
+	ls := setupTest(t)
+	reservedPaths = &pathReservations{paths: map[string]time.Time{}}
+	for _, key := range []string{"docs/a.txt", "docs/a_1.txt", "docs/b", "docs/c.tar.gz"} {
+		if err := ls.PutObject(key, strings.NewReader("x"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		path, expect string
+	}{
+		{"docs/new.txt", "docs/new.txt"},
+		{"docs/a.txt", "docs/a_2.txt"},
+		// the path was reserved by the request before
+		{"docs/a.txt", "docs/a_3.txt"},
+		{"docs/b", "docs/b_1"},
+		{"docs/c.tar.gz", "docs/c.tar_1.gz"},
+		{"other/a.txt", "other/a.txt"},
+	}
+	for _, c := range cases {
+		got, err := GetEmptyPath(ls, c.path, time.Hour)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.path, err)
+		} else if got != c.expect {
+			t.Errorf("%s: expected %s, got %s", c.path, c.expect, got)
+		}
+	}
+}
+
+func TestPathReservations(t *testing.T) {
+	p := &pathReservations{paths: map[string]time.Time{}}
+	taken := map[string]bool{"docs/a.txt": true}
+
+	cases := []struct {
+		description string
+		ttl         time.Duration
+		expect      string
+	}{
+		{"taken", -time.Second, "docs/a_1.txt"},
+		// the reservation before has already expired
+		{"expired reservation", time.Hour, "docs/a_1.txt"},
+		{"reserved", time.Hour, "docs/a_2.txt"},
+		{"reserved again", time.Hour, "docs/a_3.txt"},
+	}
+	for _, c := range cases {
+		if got := p.reserve("docs/a", ".txt", taken, c.ttl); got != c.expect {
+			t.Errorf("%s: expected %s, got %s", c.description, c.expect, got)
+		}
+	}
+	if len(p.paths) != 3 {
+		t.Errorf("expected 3 reservations, got %d", len(p.paths))
+	}
+}
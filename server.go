@@ -11,34 +11,138 @@ import (
 // the config.json file and enviornment variables, see config.go for more info.
 var cfg *config
 
-func init() {
+// setup reads configuration & opens the stores the server shares across
+// requests. It's called from main rather than init, so tests can set up
+// only what they need
+func setup() {
 	var err error
 	cfg, err = initConfig()
 	if err != nil {
 		// panic if the server is missing a vital configuration detail
 		panic(fmt.Errorf("server configuration error: %s", err.Error()))
 	}
+
+	// create a single storage client to share across all requests
+	store, err = newStorage(cfg)
+	if err != nil {
+		panic(fmt.Errorf("storage configuration error: %s", err.Error()))
+	}
+
+	// open the upload registry, which must stay open for the life of the server
+	registry, err = openRegistry(cfg.RegistryPath)
+	if err != nil {
+		panic(fmt.Errorf("registry error: %s", err.Error()))
+	}
+
+	// user accounts live alongside the registry
+	seed, err := seedUsers(cfg)
+	if err != nil {
+		panic(fmt.Errorf("users configuration error: %s", err.Error()))
+	}
+	users, err = newUserStore(registry.db, seed)
+	if err != nil {
+		panic(fmt.Errorf("users error: %s", err.Error()))
+	}
+	inviteSecret, err := registry.Secret("invites", cfg.InviteSecret)
+	if err != nil {
+		panic(fmt.Errorf("invites error: %s", err.Error()))
+	}
+	invites, err = newInviteStore(registry.db, inviteSecret)
+	if err != nil {
+		panic(fmt.Errorf("invites error: %s", err.Error()))
+	}
+
+	sessionSecret, err := registry.Secret("sessions", cfg.SessionSecret)
+	if err != nil {
+		panic(fmt.Errorf("sessions error: %s", err.Error()))
+	}
+	sessions = newCookieSigner(sessionSecret)
+
+	apiKeys, err = newAPIKeyStore(registry.db)
+	if err != nil {
+		panic(fmt.Errorf("api keys error: %s", err.Error()))
+	}
+	usage, err = newUsageStore(registry.db)
+	if err != nil {
+		panic(fmt.Errorf("usage error: %s", err.Error()))
+	}
+	burners, err = newBurnerStore(registry.db)
+	if err != nil {
+		panic(fmt.Errorf("burners error: %s", err.Error()))
+	}
+	oidc = newOIDCProvider(cfg)
 }
 
 func main() {
+	setup()
+
 	// initialize a router to handle requests
 	r := httprouter.New()
 
 	// home handler, wrapped in middlware func
 	r.GET("/", middleware(HomeHandler))
 
+	// sign in with an identity provider
+	r.GET("/login", LoginHandler)
+	r.GET("/auth/callback", OIDCCallbackHandler)
+	r.GET("/logout", LogoutHandler)
+
 	// handle CORS requests
 	r.OPTIONS("/*path", CORSHandler)
 
+	// api keys can use the endpoints below with the scope given for each.
 	// token handler to generate s3 signatures
-	r.GET("/token", middleware(SignS3Handler))
-	r.GET("/burner", middleware(BurnerTokenHandler))
-	r.GET("/stats", middleware(StatsHandler))
+	r.GET("/token", middleware(SignS3Handler, ScopeSign))
+	// confirms a signed upload arrived intact
+	r.POST("/complete", middleware(CompleteHandler, ScopeSign))
+	r.GET("/burner", middleware(BurnerTokenHandler, ScopeBurner))
+	r.GET("/stats", middleware(StatsHandler, ScopeStats))
+	r.GET("/browse/*dir", middleware(BrowseHandler, ScopeStats))
+
+	// multipart upload handlers for files too large for a single signed PUT
+	r.GET("/multipart/start", middleware(MultipartStartHandler, ScopeSign))
+	r.GET("/multipart/sign", middleware(MultipartSignPartHandler, ScopeSign))
+	r.GET("/multipart/parts", middleware(MultipartListPartsHandler, ScopeSign))
+	r.POST("/multipart/complete", middleware(MultipartCompleteHandler, ScopeSign))
+	r.POST("/multipart/abort", middleware(MultipartAbortHandler, ScopeSign))
+
+	// admin api for reading the upload registry
+	r.GET("/admin/uploads", adminMiddleware(AdminUploadsHandler))
+	r.GET("/admin/upload/*key", adminMiddleware(AdminUploadHandler))
+	// admin api for managing user accounts
+	r.GET("/admin/users", adminMiddleware(AdminUsersHandler))
+	r.GET("/admin/users/:username", adminMiddleware(AdminUserHandler))
+	r.PUT("/admin/users/:username", adminMiddleware(AdminPutUserHandler))
+	r.DELETE("/admin/users/:username", adminMiddleware(AdminDeleteUserHandler))
+	// admin api for issuing invite links
+	r.GET("/admin/invites", adminMiddleware(AdminInvitesHandler))
+	r.POST("/admin/invites", adminMiddleware(AdminCreateInviteHandler))
+	r.GET("/admin/invites/:id", adminMiddleware(AdminInviteHandler))
+	r.DELETE("/admin/invites/:id", adminMiddleware(AdminRevokeInviteHandler))
+	// admin api for issuing api keys to scripts
+	r.GET("/admin/keys", adminMiddleware(AdminAPIKeysHandler))
+	r.POST("/admin/keys", adminMiddleware(AdminCreateAPIKeyHandler))
+	r.DELETE("/admin/keys/:id", adminMiddleware(AdminRevokeAPIKeyHandler))
+	// admin api for tracking & revoking burner credentials
+	r.GET("/admin/burners", adminMiddleware(AdminBurnersHandler))
+	r.GET("/admin/burners/:name", adminMiddleware(AdminBurnerHandler))
+	r.DELETE("/admin/burners/:name", adminMiddleware(AdminRevokeBurnerHandler))
+
+	// local storage accepts uploads & serves files itself
+	if cfg.StorageBackend == "local" {
+		r.PUT("/files/*key", LocalUploadHandler)
+		r.GET("/files/*key", LocalFileHandler)
+	}
 
 	// serve static content from public directory
 	r.ServeFiles("/css/*filepath", http.Dir("public/css"))
 	r.ServeFiles("/js/*filepath", http.Dir("public/js"))
 
+	// watch for files uploaded with burner credentials
+	if cfg.EnableBurnerCredentials {
+		go watchBurners(store, burnerWatchInterval)
+	}
+
 	// print notable config settings
 	printConfigInfo()
 
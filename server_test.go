@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+// setupTest points the server's shared stores at a fresh local storage dir
+// & registry, in place of setup
+func setupTest(t *testing.T) *localStorage {
+	ls := newTestLocalStorage(t)
+	cfg = &config{}
+	store = ls
+	openTestRegistry(t)
+
+	var err error
+	if invites, err = newInviteStore(registry.db, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err = newUsageStore(registry.db); err != nil {
+		t.Fatal(err)
+	}
+	if burners, err = newBurnerStore(registry.db); err != nil {
+		t.Fatal(err)
+	}
+	if users, err = newUserStore(registry.db, nil); err != nil {
+		t.Fatal(err)
+	}
+	sessions = newCookieSigner([]byte("secret"))
+	oidc = nil
+	return ls
+}
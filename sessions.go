@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sessionCookie holds the signed in user's session
+const sessionCookie = "session"
+
+// sessionDuration is how long a login lasts before signing in again
+const sessionDuration = 12 * time.Hour
+
+// sessions signs session cookies, set at startup
+var sessions *cookieSigner
+
+// Session is a signed in user, kept in a cookie signed by the server.
+// Sessions aren't stored on the server, so they last until they expire
+type Session struct {
+	Username   string   `json:"u"`
+	UploadDirs []string `json:"d,omitempty"`
+	Expires    int64    `json:"exp"`
+}
+
+// cookieSigner encodes values as JSON into cookies that can't be altered
+// without the server's secret
+type cookieSigner struct {
+	secret []byte
+}
+
+// newCookieSigner creates a cookie signer using secret
+func newCookieSigner(secret []byte) *cookieSigner {
+	return &cookieSigner{secret: secret}
+}
+
+// Encode gives v as a signed cookie value. name is signed into the value,
+// so a value can't be used for a different cookie
+func (s *cookieSigner) Encode(name string, v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.signature(name, payload), nil
+}
+
+// Decode checks a signed cookie value & reads it into v
+func (s *cookieSigner) Decode(name, value string, v interface{}) error {
+	i := strings.LastIndex(value, ".")
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(s.signature(name, value[:i]))) {
+		return fmt.Errorf("invalid %s cookie", name)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return fmt.Errorf("invalid %s cookie", name)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// signature calculates an HMAC of a cookie's name & payload
+func (s *cookieSigner) signature(name, payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "cookie\n%s\n%s", name, payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// startSession signs u in for sessionDuration
+func startSession(w http.ResponseWriter, r *http.Request, u *User) error {
+	expires := time.Now().Add(sessionDuration)
+	value, err := sessions.Encode(sessionCookie, &Session{
+		Username:   u.Username,
+		UploadDirs: u.UploadDirs,
+		Expires:    expires.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   requestSecure(r),
+		// sessions sign requests in, so the cookie isn't sent with
+		// requests other sites make
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// endSession signs the user out
+func endSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+}
+
+// hasSession checks if a request carries a session cookie
+func hasSession(r *http.Request) bool {
+	_, err := r.Cookie(sessionCookie)
+	return err == nil
+}
+
+// authenticateSession checks the session cookie sent with r, returning the
+// signed in user
+func authenticateSession(r *http.Request) (*User, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, fmt.Errorf("not signed in")
+	}
+
+	s := &Session{}
+	if err := sessions.Decode(sessionCookie, c.Value, s); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > s.Expires {
+		return nil, fmt.Errorf("session for %s has expired", s.Username)
+	}
+
+	return &User{Username: s.Username, UploadDirs: s.UploadDirs}, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// StatsHandler reports on everything uploaded to a directory as JSON.
+// The request must provide a dir query param, naming one of the signed in
+// user's upload dirs or a subdirectory of one if there are any, and can filter the objects
+// counted with these optional params:
+//
+//	from     - only objects created at or after this time
+//	to       - only objects created before this time. dates without a time
+//	           include the whole day
+//	min_size - only objects of at least this many bytes
+//
+// times can be given as RFC 3339 (2017-02-20T17:54:14Z) or dates (2017-02-20)
+func StatsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// response will be json, allocate an encoder that operates
+	// on the http writer
+	enc := json.NewEncoder(w)
+
+	// trim off left & right slashes from the specified dir
+	dir := strings.Trim(r.FormValue("dir"), "/")
+	if dir == "" {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": "please specifiy a 'dir' query param of the directory to list stats for",
+		})
+		return
+	}
+
+	// stats list every key in dir, so they're only given for the user's
+	// upload dirs. without upload dirs the whole bucket can be browsed
+	if dirs := allowedUploadDirs(r); len(dirs) > 0 && !browsableDir(dirs, dir) {
+		w.WriteHeader(http.StatusForbidden)
+		enc.Encode(map[string]string{
+			"error": fmt.Sprintf("you can't view stats for '%s'", dir),
+		})
+		return
+	}
+
+	filter, err := requestStatsFilter(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	stats, err := PathStats(store, dir, filter)
+	if err != nil {
+		fmt.Println("error generating stats json", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	stats.Registry, err = registry.StatusCounts(dir)
+	if err != nil {
+		fmt.Println("error counting registry uploads", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := enc.Encode(stats); err != nil {
+		fmt.Println("encode json error:", err.Error())
+	}
+}
+
+// Stat describes a single uploaded object
+type Stat struct {
+	Key          string    `json:"key"`
+	Created      time.Time `json:"created"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	StorageClass string    `json:"storageClass,omitempty"`
+}
+
+// DirStat totals the objects within a single directory & all of its
+// subdirectories
+type DirStat struct {
+	Dir   string `json:"dir"`
+	Count int    `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Stats summarizes the contents of a directory
+type Stats struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+	// Directories rolls up totals for each immediate subdirectory. objects
+	// directly inside the directory are totalled under the directory itself
+	Directories []*DirStat `json:"directories"`
+	Objects     []*Stat    `json:"objects"`
+	// Registry counts uploads recorded in the registry by status, including
+	// uploads that were requested but never arrived
+	Registry map[string]int `json:"registry,omitempty"`
+}
+
+// StatsFilter limits the objects included in stats. zero values are ignored
+type StatsFilter struct {
+	From    time.Time
+	To      time.Time
+	MinSize int64
+}
+
+// match reports weather o should be included in stats
+func (f *StatsFilter) match(o *Object) bool {
+	if f == nil {
+		return true
+	}
+	if !f.From.IsZero() && o.LastModified.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !o.LastModified.Before(f.To) {
+		return false
+	}
+	return o.Size >= f.MinSize
+}
+
+// PathStats lists everything within dir, returning totals for objects that
+// match filter. filter may be nil. an empty dir lists the whole bucket
+func PathStats(svc Storage, dir string, filter *StatsFilter) (*Stats, error) {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	objects, err := svc.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		Directories: make([]*DirStat, 0),
+		Objects:     make([]*Stat, 0),
+	}
+	dirs := map[string]*DirStat{}
+
+	for _, o := range objects {
+		// manifests describe uploads, they aren't uploads themselves
+		if isManifest(o.Key) || !filter.match(o) {
+			continue
+		}
+
+		stats.Objects = append(stats.Objects, &Stat{
+			Key:          o.Key,
+			Created:      o.LastModified,
+			Size:         o.Size,
+			ETag:         o.ETag,
+			StorageClass: o.StorageClass,
+		})
+		stats.Count++
+		stats.Bytes += o.Size
+
+		// roll up into the immediate subdirectory
+		name := strings.TrimSuffix(prefix, "/")
+		if i := strings.Index(strings.TrimPrefix(o.Key, prefix), "/"); i >= 0 {
+			name = prefix + strings.TrimPrefix(o.Key, prefix)[:i]
+		}
+		d := dirs[name]
+		if d == nil {
+			d = &DirStat{Dir: name}
+			dirs[name] = d
+			stats.Directories = append(stats.Directories, d)
+		}
+		d.Count++
+		d.Bytes += o.Size
+	}
+
+	sort.Sort(dirStatsByName(stats.Directories))
+	return stats, nil
+}
+
+// requestStatsFilter reads a StatsFilter from request params
+func requestStatsFilter(r *http.Request) (*StatsFilter, error) {
+	f := &StatsFilter{}
+	var err error
+
+	if from := r.FormValue("from"); from != "" {
+		if f.From, _, err = parseStatsTime(from); err != nil {
+			return nil, fmt.Errorf("invalid 'from' param: %s", err.Error())
+		}
+	}
+
+	if to := r.FormValue("to"); to != "" {
+		var dateOnly bool
+		if f.To, dateOnly, err = parseStatsTime(to); err != nil {
+			return nil, fmt.Errorf("invalid 'to' param: %s", err.Error())
+		}
+		// a date on it's own means "through the end of that day"
+		if dateOnly {
+			f.To = f.To.Add(24 * time.Hour)
+		}
+	}
+
+	if minSize := r.FormValue("min_size"); minSize != "" {
+		if f.MinSize, err = strconv.ParseInt(minSize, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid 'min_size' param: must be a number of bytes")
+		}
+	}
+
+	return f, nil
+}
+
+// parseStatsTime parses either an RFC 3339 time or a date, reporting
+// weather only a date was given
+func parseStatsTime(s string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, false, err
+}
+
+// dirStatsByName sorts directory stats alphabetically
+type dirStatsByName []*DirStat
+
+func (d dirStatsByName) Len() int           { return len(d) }
+func (d dirStatsByName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d dirStatsByName) Less(i, j int) bool { return d[i].Dir < d[j].Dir }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsHandlerChecksDir(t *testing.T) {
+	ls := setupTest(t)
+	cfg.UploadDirs = []string{"docs"}
+	for _, key := range []string{"docs/a.txt", "private/b.txt"} {
+		if err := ls.PutObject(key, strings.NewReader("x"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		dir    string
+		status int
+	}{
+		{"docs", http.StatusOK},
+		{"docs/2017", http.StatusOK},
+		{"private", http.StatusForbidden},
+		{"docs/../private", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		StatsHandler(w, httptest.NewRequest("GET", "/stats?dir="+c.dir, nil), nil)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d: %s", c.dir, c.status, w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "private/b.txt") {
+			t.Errorf("%s: expected keys outside docs not to be listed", c.dir)
+		}
+	}
+}
+
+// listingStorage is local storage that lists a fixed set of objects
+type listingStorage struct {
+	*localStorage
+	objects []*Object
+}
+
+func (s *listingStorage) List(prefix string) ([]*Object, error) {
+	objects := make([]*Object, 0)
+	for _, o := range s.objects {
+		if strings.HasPrefix(o.Key, prefix) {
+			objects = append(objects, o)
+		}
+	}
+	return objects, nil
+}
+
+func TestPathStats(t *testing.T) {
+	day := time.Date(2017, 2, 20, 0, 0, 0, 0, time.UTC)
+	svc := &listingStorage{
+		localStorage: newTestLocalStorage(t),
+		objects: []*Object{
+			{Key: "docs/a.txt", Size: 10, LastModified: day},
+			{Key: "docs/a.txt" + manifestSuffix, Size: 500, LastModified: day},
+			{Key: "docs/2017/b.txt", Size: 100, LastModified: day.Add(time.Hour)},
+			{Key: "docs/2017/c/d.txt", Size: 1000, LastModified: day.Add(48 * time.Hour)},
+			{Key: "docs/archive/e.txt", Size: 5, LastModified: day.Add(-time.Hour)},
+			{Key: "other/f.txt", Size: 7, LastModified: day},
+		},
+	}
+
+	cases := []struct {
+		description string
+		dir         string
+		filter      *StatsFilter
+		count       int
+		bytes       int64
+		dirs        string
+	}{
+		{"whole dir", "docs", nil, 4, 1115, "[docs:1:10 docs/2017:2:1100 docs/archive:1:5]"},
+		{"slashes trimmed", "/docs/", &StatsFilter{}, 4, 1115, "[docs:1:10 docs/2017:2:1100 docs/archive:1:5]"},
+		{"subdirectory", "docs/2017", nil, 2, 1100, "[docs/2017:1:100 docs/2017/c:1:1000]"},
+		{"whole bucket", "", nil, 5, 1122, "[docs:4:1115 other:1:7]"},
+		{"from", "docs", &StatsFilter{From: day}, 3, 1110, "[docs:1:10 docs/2017:2:1100]"},
+		{"to", "docs", &StatsFilter{To: day.Add(time.Hour)}, 2, 15, "[docs:1:10 docs/archive:1:5]"},
+		{"min size", "docs", &StatsFilter{MinSize: 100}, 2, 1100, "[docs/2017:2:1100]"},
+		{"nothing matches", "docs", &StatsFilter{MinSize: 1 << 20}, 0, 0, "[]"},
+		{"missing dir", "missing", nil, 0, 0, "[]"},
+	}
+	for _, c := range cases {
+		stats, err := PathStats(svc, c.dir, c.filter)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.description, err)
+			continue
+		}
+		var dirs []string
+		for _, d := range stats.Directories {
+			dirs = append(dirs, fmt.Sprintf("%s:%d:%d", d.Dir, d.Count, d.Bytes))
+		}
+		if stats.Count != c.count || stats.Bytes != c.bytes || len(stats.Objects) != c.count || fmt.Sprint(dirs) != c.dirs {
+			t.Errorf("%s: expected %d objects, %d bytes & dirs %s, got %d (%d listed), %d bytes & dirs %v", c.description, c.count, c.bytes, c.dirs, stats.Count, len(stats.Objects), stats.Bytes, dirs)
+		}
+		for _, o := range stats.Objects {
+			if isManifest(o.Key) {
+				t.Errorf("%s: expected manifests not to be counted, got %s", c.description, o.Key)
+			}
+		}
+	}
+}
+
+func TestRequestStatsFilter(t *testing.T) {
+	day := time.Date(2017, 2, 20, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		query  string
+		filter StatsFilter
+		err    string
+	}{
+		{"", StatsFilter{}, ""},
+		{"from=2017-02-20", StatsFilter{From: day}, ""},
+		{"from=2017-02-20T17:54:14Z", StatsFilter{From: day.Add(17*time.Hour + 54*time.Minute + 14*time.Second)}, ""},
+		{"to=2017-02-20", StatsFilter{To: day.Add(24 * time.Hour)}, ""},
+		{"to=2017-02-20T12:00:00Z", StatsFilter{To: day.Add(12 * time.Hour)}, ""},
+		{"min_size=1024", StatsFilter{MinSize: 1024}, ""},
+		{"from=2017-02-20&to=2017-02-21&min_size=1", StatsFilter{From: day, To: day.Add(48 * time.Hour), MinSize: 1}, ""},
+		{"from=yesterday", StatsFilter{}, "invalid 'from' param"},
+		{"to=2017-02-30", StatsFilter{}, "invalid 'to' param"},
+		{"min_size=1kb", StatsFilter{}, "invalid 'min_size' param"},
+	}
+	for _, c := range cases {
+		f, err := requestStatsFilter(httptest.NewRequest("GET", "/stats?dir=docs&"+c.query, nil))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: expected error %q, got %v", c.query, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", c.query, err)
+			continue
+		}
+		if !f.From.Equal(c.filter.From) || !f.To.Equal(c.filter.To) || f.MinSize != c.filter.MinSize {
+			t.Errorf("%q: expected filter %+v, got %+v", c.query, c.filter, *f)
+		}
+	}
+}
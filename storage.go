@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Storage methods when the requested object or
+// upload doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is returned when a write would replace an existing object
+var ErrExists = errors.New("an object already exists at this path")
+
+// ErrBadDigest is returned when a written object doesn't match the checksum
+// it was sent with
+var ErrBadDigest = errors.New("the uploaded file doesn't match its checksum")
+
+// Storage is everything the server needs from the place uploads end up.
+// Handlers should only ever talk to storage through this interface, using
+// the shared store created at startup.
+type Storage interface {
+	// PresignPut returns a url that accepts a single PUT request of an object
+	// to key, valid for the expires duration, along with any headers the
+	// client must send with the request
+	PresignPut(key string, opts *PutOptions, expires time.Duration) (string, http.Header, error)
+	// PresignPost returns a form that uploads an object to key with a single
+	// multipart/form-data POST, valid for the expires duration. Unlike a
+	// presigned PUT, the form's policy can limit the object's size to a range
+	PresignPost(key string, opts *PutOptions, expires time.Duration) (*PostForm, error)
+	// PutObject writes an object from the server itself
+	PutObject(key string, body io.ReadSeeker, opts *PutOptions) error
+	// List returns objects whose keys start with prefix
+	List(prefix string) ([]*Object, error)
+	// ListDir returns a page of at most limit objects & subdirectories
+	// directly inside prefix, which is either empty or ends in "/", in key
+	// order. after is the Next of the page before, or empty for the first
+	ListDir(prefix, after string, limit int) (*Listing, error)
+	// Head returns details for the object stored at key, or ErrNotFound
+	Head(key string) (*Object, error)
+	// Get opens the object stored at key for reading, or returns ErrNotFound.
+	// callers must close the returned reader
+	Get(key string) (io.ReadCloser, error)
+	// TempCredentials issues credentials that can only upload within scope,
+	// named for later identification
+	TempCredentials(name string, scope *CredentialScope, duration time.Duration) (*Credentials, error)
+	// DenyCredentials stops the named temporary credentials from being used
+	// before they expire, replacing the list of names previously denied.
+	// callers leave out names that have expired, so the list doesn't grow
+	// without end
+	DenyCredentials(names []string) error
+	// ObjectURL gives the public url of an object at key
+	ObjectURL(key string) string
+
+	// CreateMultipartUpload begins a multipart upload to key, returning the
+	// upload id
+	CreateMultipartUpload(key string, opts *PutOptions) (string, error)
+	// PresignUploadPart returns a url that accepts a PUT of a single part,
+	// along with any headers that must be sent with it. If contentMD5 is set
+	// parts that don't match it are refused
+	PresignUploadPart(key, uploadId string, partNumber int64, contentMD5 string, expires time.Duration) (string, http.Header, error)
+	// ListParts returns parts already uploaded, or ErrNotFound if the upload
+	// doesn't exist
+	ListParts(key, uploadId string) ([]*Part, error)
+	// CompleteMultipartUpload assembles parts into the final object at key,
+	// returning ErrExists rather than replacing an existing object
+	CompleteMultipartUpload(key, uploadId string, parts []*Part) error
+	// AbortMultipartUpload discards an upload & any uploaded parts
+	AbortMultipartUpload(key, uploadId string) error
+}
+
+// PutOptions are optional settings for objects being written
+type PutOptions struct {
+	ContentType string
+	// NoOverwrite makes the write fail if an object already exists at the key
+	NoOverwrite bool
+	// Metadata is stored alongside the object, as x-amz-meta-* headers on S3
+	Metadata map[string]string
+	// ContentMD5 is the base64 md5 digest of the object, as used by the
+	// Content-MD5 header. writes with a body that doesn't match are rejected
+	ContentMD5 string
+	// ContentLength is the exact size of the object in bytes. presigned
+	// writes of any other size are rejected. 0 leaves the size unchecked
+	ContentLength int64
+	// MaxContentLength is the largest object allowed in bytes. only presigned
+	// POSTs can enforce a maximum, 0 allows the largest object storage accepts
+	MaxContentLength int64
+	// Private objects can't be read through public urls, even though
+	// uploads are public
+	Private bool
+}
+
+// PostForm is a presigned upload form. Fields must be sent as form values
+// ahead of the file, which goes last in a field named "file"
+type PostForm struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+// Object describes a single stored object
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	StorageClass string
+	ContentType  string
+	// Metadata is only populated by Head
+	Metadata map[string]string
+}
+
+// Listing is a page of the contents of a single directory
+type Listing struct {
+	Objects []*Object
+	// Dirs are the subdirectories on the page, as prefixes ending in "/"
+	Dirs []string
+	// Next is passed to ListDir as after to get the following page. it's
+	// empty on the last page
+	Next string
+}
+
+// Part is a single uploaded part of a multipart upload
+type Part struct {
+	PartNumber int64  `json:"partNumber"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size,omitempty"`
+}
+
+// CredentialScope is what temporary credentials are allowed to do
+type CredentialScope struct {
+	// Keys are the object keys credentials can upload to
+	Keys []string
+	// Prefix lets credentials upload to any key starting with it
+	Prefix string
+	// Actions are the S3 actions allowed on the keys, eg. "s3:PutObject"
+	Actions []string
+	// Tags label the credentials for auditing, where storage supports it
+	Tags map[string]string
+}
+
+// Credentials are temporary access keys issued by a Storage
+type Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// String formats credentials for display
+func (c *Credentials) String() string {
+	return fmt.Sprintf("{\n  AccessKeyId: %q,\n  Expiration: %s,\n  SecretAccessKey: %q,\n  SessionToken: %q\n}",
+		c.AccessKeyId, c.Expiration.Format(time.RFC3339), c.SecretAccessKey, c.SessionToken)
+}
+
+// checkKey refuses keys that aren't clean relative paths, or are inside a
+// dir storage keeps to itself. Paths are checked when they're signed & again
+// by storage, so a signed upload is never refused for its key
+func checkKey(key string) error {
+	if clean := path.Clean("/" + key)[1:]; key == "" || clean != key {
+		return fmt.Errorf("invalid key: '%s'", key)
+	}
+	if reservedKey(key) {
+		return fmt.Errorf("invalid key: '%s', '%s' is reserved", key, strings.SplitN(key, "/", 2)[0])
+	}
+	return nil
+}
+
+// reservedKey checks if key is in one of local storage's internal dirs.
+// they're reserved with every backend, so uploads can move between them
+func reservedKey(key string) bool {
+	top := strings.SplitN(key, "/", 2)[0]
+	for _, d := range localInternalDirs {
+		if top == d {
+			return true
+		}
+	}
+	return false
+}
+
+// store is the shared storage backend, created at startup
+var store Storage
+
+// newStorage creates the configured storage backend
+func newStorage(cfg *config) (Storage, error) {
+	if cfg.StorageBackend == "local" {
+		return newLocalStorage(cfg.LocalStorageDir, cfg.UrlSigningSecret, cfg.PublicUrlBase)
+	}
+	return newS3Storage(cfg), nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// usersBucket is the bolt bucket user accounts are kept in, keyed by username
+var usersBucket = []byte("users")
+
+// users is the shared user store, opened at startup
+var users *UserStore
+
+// validUsername limits usernames to characters that are safe to use in
+// object metadata & urls
+var validUsername = regexp.MustCompile(`^[a-zA-Z0-9._@-]{1,64}$`)
+
+// User is an account that can sign in to the server
+type User struct {
+	Username string `json:"username"`
+	// PasswordHash is a bcrypt hash of the user's password
+	PasswordHash string `json:"password_hash,omitempty"`
+	// UploadDirs limits the directories this user can upload to. if empty
+	// the server's UPLOAD_DIRS apply
+	UploadDirs []string `json:"upload_dirs,omitempty"`
+	// Disabled users can't sign in
+	Disabled bool `json:"disabled"`
+}
+
+// validate checks a user is fit for storing
+func (u *User) validate() error {
+	if !validUsername.MatchString(u.Username) {
+		return fmt.Errorf("invalid username: '%s'. usernames can be up to 64 letters, numbers, '.', '_', '@' or '-'", u.Username)
+	}
+	if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+		return fmt.Errorf("user %s: password_hash must be a bcrypt hash", u.Username)
+	}
+	return nil
+}
+
+// SetPassword replaces the user's password hash
+func (u *User) SetPassword(password string) error {
+	if len(password) < 8 {
+		return fmt.Errorf("passwords must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// withoutPassword gives a copy of u that's safe to show, leaving out the
+// password hash
+func (u *User) withoutPassword() *User {
+	c := *u
+	c.PasswordHash = ""
+	return &c
+}
+
+// seedUsers gives the users listed in cfg & its users file
+func seedUsers(cfg *config) ([]*User, error) {
+	seed := cfg.Users
+	if cfg.UsersFile == "" {
+		return seed, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.UsersFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", cfg.UsersFile, err)
+	}
+	fileUsers := []*User{}
+	if err := json.Unmarshal(data, &fileUsers); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", cfg.UsersFile, err)
+	}
+	return append(seed, fileUsers...), nil
+}
+
+// UserStore keeps user accounts in the registry database
+type UserStore struct {
+	db *bolt.DB
+
+	// verified caches recently checked passwords, so bcrypt only runs once
+	// per password rather than on every request. entries are keyed by
+	// username & only valid while the user's password hash is unchanged
+	sync.Mutex
+	verified map[string]verifiedPassword
+}
+
+// verifiedPassword is a password known to match hash
+type verifiedPassword struct {
+	hash     string
+	password [sha256.Size]byte
+}
+
+// newUserStore creates a user store in db, adding any seed users that don't
+// exist yet. Seed users are only added once, after that they're managed
+// through the admin api
+func newUserStore(db *bolt.DB, seed []*User) (*UserStore, error) {
+	s := &UserStore{db: db, verified: map[string]verifiedPassword{}}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(usersBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range seed {
+			if err := u.validate(); err != nil {
+				return err
+			}
+			if b.Get([]byte(u.Username)) != nil {
+				continue
+			}
+			data, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(u.Username), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Any reports whether any users exist
+func (s *UserStore) Any() bool {
+	any := false
+	s.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(usersBucket).Cursor().First()
+		any = k != nil
+		return nil
+	})
+	return any
+}
+
+// Get returns the user with username, or ErrNotFound
+func (s *UserStore) Get(username string) (*User, error) {
+	u := &User{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(username))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// List returns all users, sorted by username
+func (s *UserStore) List() ([]*User, error) {
+	list := make([]*User, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			u := &User{}
+			if err := json.Unmarshal(v, u); err != nil {
+				return err
+			}
+			list = append(list, u)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// Put adds or replaces a user
+func (s *UserStore) Put(u *User) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Put([]byte(u.Username), data)
+	})
+}
+
+// Delete removes a user
+func (s *UserStore) Delete(username string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		if b.Get([]byte(username)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(username))
+	})
+}
+
+// Authenticate checks a username & password, returning the user if they
+// match an enabled account
+func (s *UserStore) Authenticate(username, password string) (*User, error) {
+	u, err := s.Get(username)
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("invalid username or password")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !s.checkPassword(u, password) {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+	if u.Disabled {
+		return nil, fmt.Errorf("account %s is disabled", u.Username)
+	}
+	return u, nil
+}
+
+// checkPassword compares password to u's hash, using the cache of
+// verified passwords where possible
+func (s *UserStore) checkPassword(u *User, password string) bool {
+	sum := sha256.Sum256([]byte(password))
+
+	s.Lock()
+	v, ok := s.verified[u.Username]
+	s.Unlock()
+	if ok && v.hash == u.PasswordHash && subtle.ConstantTimeCompare(v.password[:], sum[:]) == 1 {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return false
+	}
+
+	s.Lock()
+	s.verified[u.Username] = verifiedPassword{hash: u.PasswordHash, password: sum}
+	s.Unlock()
+	return true
+}
+
+// userContextKey is the request context key for the signed in user
+type userContextKey struct{}
+
+// withUser attaches the signed in user to a request's context
+func withUser(r *http.Request, u *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, u))
+}
+
+// requestUser returns the user signed in for a request, or nil if the
+// server doesn't require signing in
+func requestUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userContextKey{}).(*User)
+	return u
+}
+
+// requestUsername is the name of the user signed in for a request, if any
+func requestUsername(r *http.Request) string {
+	if u := requestUser(r); u != nil {
+		return u.Username
+	}
+	return ""
+}
+
+// allowedUploadDirs gives the directories the signed in user can upload to
+func allowedUploadDirs(r *http.Request) []string {
+	if u := requestUser(r); u != nil && len(u.UploadDirs) > 0 {
+		return u.UploadDirs
+	}
+	return cfg.UploadDirs
+}
+
+// isAllowedDir checks dir is one of dirs, ignoring leading & trailing slashes
+func isAllowedDir(dirs []string, dir string) bool {
+	dir = strings.Trim(dir, "/")
+	for _, d := range dirs {
+		if dir == strings.Trim(d, "/") {
+			return true
+		}
+	}
+	return false
+}
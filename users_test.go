@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// putTestUser stores a user with password, failing the test on any error
+func putTestUser(t *testing.T, username, password string, disabled bool) *User {
+	u := &User{Username: username, Disabled: disabled}
+	if err := u.SetPassword(password); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestUserStoreAuthenticate(t *testing.T) {
+	setupTest(t)
+	putTestUser(t, "jo", "correct horse", false)
+	putTestUser(t, "sam", "battery staple", true)
+
+	cases := []struct {
+		description        string
+		username, password string
+		err                string
+	}{
+		{"valid", "jo", "correct horse", ""},
+		// the password is checked from the cache of verified passwords
+		{"valid again", "jo", "correct horse", ""},
+		{"wrong password", "jo", "correct horse battery", "invalid username or password"},
+		{"empty password", "jo", "", "invalid username or password"},
+		{"unknown user", "alex", "correct horse", "invalid username or password"},
+		{"username case", "JO", "correct horse", "invalid username or password"},
+		{"disabled", "sam", "battery staple", "account sam is disabled"},
+		// disabled accounts don't reveal if a password was right
+		{"disabled wrong password", "sam", "correct horse", "invalid username or password"},
+	}
+	for _, c := range cases {
+		u, err := users.Authenticate(c.username, c.password)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error %q, got %v", c.description, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.description, err)
+		} else if u.Username != c.username {
+			t.Errorf("%s: expected user %s, got %s", c.description, c.username, u.Username)
+		}
+	}
+
+	// a changed password replaces the cached one
+	putTestUser(t, "jo", "new password", false)
+	if _, err := users.Authenticate("jo", "correct horse"); err == nil {
+		t.Error("expected the old password to be refused once changed")
+	}
+	if _, err := users.Authenticate("jo", "new password"); err != nil {
+		t.Errorf("expected the new password to be accepted, got %s", err)
+	}
+}
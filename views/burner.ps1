@@ -0,0 +1,90 @@
+# Uploads {{ if .Prefix }}a folder{{ else if eq (len .Files) 1 }}a file{{ else }}{{ len .Files }} files{{ end }} with burner credentials {{ line .Name }}, which expire {{ line .Expiry }}.
+# Requires the aws command line interface: https://aws.amazon.com/cli/
+#
+{{- if .Prefix }}
+# Usage: powershell -ExecutionPolicy Bypass -File {{ line .ScriptName }} [folder]
+#
+# Uploads everything in folder (default "dataset") to s3://{{ line .Bucket }}/{{ line .Prefix }}
+{{- else }}
+# Usage: powershell -ExecutionPolicy Bypass -File {{ line .ScriptName }} [{{ if eq (len .Files) 1 }}file{{ else }}file ...{{ end }}]
+#
+# Files are read from the current directory unless {{ if eq (len .Files) 1 }}a path is{{ else }}paths are given in this order{{ end }}:
+{{- range .Files }}
+#   {{ line .Filename }} -> s3://{{ line $.Bucket }}/{{ line .Path }}
+{{- end }}
+{{- end }}
+#
+# Each file's md5 checksum is stored with it as x-amz-meta-md5 metadata &
+# printed once it's uploaded. The aws cli checks every request it sends
+# arrives intact.
+$ErrorActionPreference = 'Stop'
+
+if (-not (Get-Command aws -ErrorAction SilentlyContinue)) {
+	Write-Error 'the aws command line interface is required, see https://aws.amazon.com/cli/'
+	exit 1
+}
+
+$env:AWS_ACCESS_KEY_ID = {{ psquote .AWS_ACCESS_KEY_ID }}
+$env:AWS_SECRET_ACCESS_KEY = {{ psquote .AWS_SECRET_ACCESS_KEY }}
+$env:AWS_SESSION_TOKEN = {{ psquote .AWS_SESSION_TOKEN }}
+$env:AWS_DEFAULT_REGION = {{ psquote .Region }}
+Remove-Item Env:AWS_PROFILE -ErrorAction SilentlyContinue
+
+# use a config of our own, leaving any existing aws cli setup alone
+$config = New-TemporaryFile
+$env:AWS_CONFIG_FILE = $config.FullName
+Set-Content -LiteralPath $config.FullName -Value @'
+[default]
+s3 =
+  multipart_threshold = {{ .MultipartThresholdMB }}MB
+  multipart_chunksize = {{ .MultipartChunkMB }}MB
+  max_concurrent_requests = {{ .MaxConcurrency }}
+{{- if .PathStyle }}
+  addressing_style = path
+{{- end }}
+'@
+
+# Send-File uploads $file to $key
+function Send-File($file, $key) {
+	if (-not (Test-Path -LiteralPath $file -PathType Leaf)) {
+		throw "$file isn't a file"
+	}
+	Write-Host "calculating checksum of $file"
+	$md5 = (Get-FileHash -LiteralPath $file -Algorithm MD5).Hash.ToLower()
+	aws s3 cp $file ({{ psquote (printf "s3://%s/" .Bucket) }} + $key) --metadata "md5=$md5"{{ if .Endpoint }} --endpoint-url {{ psquote .Endpoint }}{{ end }}
+	if ($LASTEXITCODE -ne 0) {
+		throw "uploading $file failed"
+	}
+	Write-Host "$md5  $key"
+}
+
+try {
+{{- if .Prefix }}
+	$folder = if ($args.Count -gt 0) { $args[0] } else { 'dataset' }
+	if (-not (Test-Path -LiteralPath $folder -PathType Container)) {
+		throw "$folder isn't a folder"
+	}
+	$root = (Resolve-Path -LiteralPath $folder).Path.TrimEnd('\', '/')
+
+	Get-ChildItem -LiteralPath $root -Recurse -File | ForEach-Object {
+		$rel = $_.FullName.Substring($root.Length + 1) -replace '\\', '/'
+		Send-File $_.FullName ({{ psquote .Prefix }} + $rel)
+	}
+{{- else }}
+	$files = @({{ range $i, $f := .Files }}{{ if $i }}, {{ end }}{{ psquote $f.Filename }}{{ end }})
+	$keys = @({{ range $i, $f := .Files }}{{ if $i }}, {{ end }}{{ psquote $f.Path }}{{ end }})
+	if ($args.Count -gt 0) {
+		if ($args.Count -ne $keys.Count) {
+			throw 'give {{ len .Files }} {{ if eq (len .Files) 1 }}file{{ else }}files{{ end }} to upload, or none to use the default {{ if eq (len .Files) 1 }}name{{ else }}names{{ end }}'
+		}
+		$files = $args
+	}
+
+	for ($i = 0; $i -lt $keys.Count; $i++) {
+		Send-File $files[$i] $keys[$i]
+	}
+{{- end }}
+	Write-Host 'done'
+} finally {
+	Remove-Item -LiteralPath $config.FullName -ErrorAction SilentlyContinue
+}
@@ -0,0 +1,98 @@
+#!/usr/bin/env bash
+# Uploads {{ if .Prefix }}a folder{{ else if eq (len .Files) 1 }}a file{{ else }}{{ len .Files }} files{{ end }} with burner credentials {{ line .Name }}, which expire {{ line .Expiry }}.
+# Requires the aws command line interface: https://aws.amazon.com/cli/
+#
+{{- if .Prefix }}
+# Usage: bash {{ line .ScriptName }} [folder]
+#
+# Uploads everything in folder (default "dataset") to s3://{{ line .Bucket }}/{{ line .Prefix }}
+{{- else }}
+# Usage: bash {{ line .ScriptName }} [{{ if eq (len .Files) 1 }}file{{ else }}file ...{{ end }}]
+#
+# Files are read from the current directory unless {{ if eq (len .Files) 1 }}a path is{{ else }}paths are given in this order{{ end }}:
+{{- range .Files }}
+#   {{ line .Filename }} -> s3://{{ line $.Bucket }}/{{ line .Path }}
+{{- end }}
+{{- end }}
+#
+# Each file's md5 checksum is stored with it as x-amz-meta-md5 metadata &
+# printed once it's uploaded. The aws cli checks every request it sends
+# arrives intact.
+set -euo pipefail
+
+if ! command -v aws >/dev/null 2>&1; then
+	echo "the aws command line interface is required, see https://aws.amazon.com/cli/" >&2
+	exit 1
+fi
+
+export AWS_ACCESS_KEY_ID={{ shquote .AWS_ACCESS_KEY_ID }}
+export AWS_SECRET_ACCESS_KEY={{ shquote .AWS_SECRET_ACCESS_KEY }}
+export AWS_SESSION_TOKEN={{ shquote .AWS_SESSION_TOKEN }}
+export AWS_DEFAULT_REGION={{ shquote .Region }}
+unset AWS_PROFILE
+
+# use a config of our own, leaving any existing aws cli setup alone
+AWS_CONFIG_FILE=$(mktemp)
+export AWS_CONFIG_FILE
+trap 'rm -f "$AWS_CONFIG_FILE"' EXIT
+cat > "$AWS_CONFIG_FILE" <<'EOF'
+[default]
+s3 =
+  multipart_threshold = {{ .MultipartThresholdMB }}MB
+  multipart_chunksize = {{ .MultipartChunkMB }}MB
+  max_concurrent_requests = {{ .MaxConcurrency }}
+{{- if .PathStyle }}
+  addressing_style = path
+{{- end }}
+EOF
+
+# md5hex prints a file's md5 checksum in hex, like md5sum
+md5hex() {
+	if command -v md5sum >/dev/null 2>&1; then
+		md5sum "$1" | cut -d ' ' -f 1
+	elif command -v md5 >/dev/null 2>&1; then
+		md5 -q "$1"
+	else
+		openssl dgst -md5 -r "$1" | cut -d ' ' -f 1
+	fi
+}
+
+# upload sends file $1 to key $2
+upload() {
+	if [ ! -f "$1" ]; then
+		echo "$1 isn't a file" >&2
+		exit 1
+	fi
+	echo "calculating checksum of $1"
+	local md5
+	md5=$(md5hex "$1")
+	aws s3 cp "$1" {{ shquote (printf "s3://%s/" .Bucket) }}"$2" --metadata "md5=$md5"{{ if .Endpoint }} --endpoint-url {{ shquote .Endpoint }}{{ end }}
+	echo "$md5  $2"
+}
+{{ if .Prefix }}
+folder=${1:-dataset}
+if [ ! -d "$folder" ]; then
+	echo "$folder isn't a folder" >&2
+	exit 1
+fi
+folder=${folder%/}
+
+find "$folder" -type f | while IFS= read -r file; do
+	upload "$file" {{ shquote .Prefix }}"${file#"$folder"/}"
+done
+{{- else }}
+files=({{ range $i, $f := .Files }}{{ if $i }} {{ end }}{{ shquote $f.Filename }}{{ end }})
+keys=({{ range $i, $f := .Files }}{{ if $i }} {{ end }}{{ shquote $f.Path }}{{ end }})
+if [ $# -gt 0 ]; then
+	if [ $# -ne ${#keys[@]} ]; then
+		echo "give {{ len .Files }} {{ if eq (len .Files) 1 }}file{{ else }}files{{ end }} to upload, or none to use the default {{ if eq (len .Files) 1 }}name{{ else }}names{{ end }}" >&2
+		exit 1
+	fi
+	files=("$@")
+fi
+
+for i in "${!keys[@]}"; do
+	upload "${files[$i]}" "${keys[$i]}"
+done
+{{- end }}
+echo "done"